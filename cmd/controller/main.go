@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -20,10 +22,13 @@ import (
 	"github.com/cloudflare/cloudflare-go/v6/option"
 	"github.com/go-logr/logr"
 	"go.uber.org/zap"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client/config"
 	logzap "sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 )
 
 var (
@@ -36,11 +41,33 @@ var (
 
 	cloudflaredImage           string
 	cloudflaredImagePullPolicy string
+	cloudflaredWorkload        controller.CloudflaredWorkloadConfig
 
 	cloudflareAPIToken string
 
 	cloudflareAccountID  string
 	cloudflareTunnelName string
+	cloudflareCacheTTL   time.Duration
+	cloudflareRateLimit  int
+
+	dnsOwnerID     string
+	dnsZoneInclude string
+	dnsZoneExclude string
+
+	tunnelSecretRotation controller.TunnelSecretRotationOptions
+
+	tunnelHealthEnabled            bool
+	tunnelHealthInterval           time.Duration
+	tunnelHealthUnhealthyThreshold time.Duration
+
+	metricsBindAddress string
+
+	leaderElection              bool
+	leaderElectionID            string
+	leaderElectionNamespace     string
+	leaderElectionLeaseDuration time.Duration
+	leaderElectionRenewDeadline time.Duration
+	leaderElectionRetryPeriod   time.Duration
 )
 
 func main() {
@@ -75,13 +102,26 @@ func run(logger logr.Logger) error {
 		return fmt.Errorf("could not get k8s config: %w", err)
 	}
 
-	mgr, err := manager.New(cfg, manager.Options{})
+	mgr, err := manager.New(cfg, manager.Options{
+		Cache:                   controller.CacheOptions(),
+		Metrics:                 metricsserver.Options{BindAddress: metricsBindAddress},
+		LeaderElection:          leaderElection,
+		LeaderElectionID:        leaderElectionID,
+		LeaderElectionNamespace: leaderElectionNamespace,
+		LeaseDuration:           &leaderElectionLeaseDuration,
+		RenewDeadline:           &leaderElectionRenewDeadline,
+		RetryPeriod:             &leaderElectionRetryPeriod,
+		// The process exits right after the manager stops, let a standby replica take over without waiting
+		LeaderElectionReleaseOnCancel: true,
+	})
 	if err != nil {
 		return fmt.Errorf("could not create manager: %w", err)
 	}
 
 	cf_opts := []option.RequestOption{
 		option.WithAPIToken(cloudflareAPIToken),
+		// Retried by the tunnel client, which shares the rate limit across all requests
+		option.WithMaxRetries(0),
 	}
 
 	cloudflareAPI := cloudflare.NewClient(cf_opts...)
@@ -89,7 +129,10 @@ func run(logger logr.Logger) error {
 		return errors.New("could not create cloudflare API client: NewClient returned nil")
 	}
 
-	tunnelClient := tunnel.NewClient(cloudflareAPI, cloudflareAccountID, cloudflareTunnelName, logger)
+	tunnelClient := tunnel.NewClient(tunnel.NewCloudflareAPI(cloudflareAPI), cloudflareAccountID, cloudflareTunnelName, dnsOwnerID, logger)
+	tunnelClient.SetDomainFilter(tunnel.NewDomainFilter(dnsZoneInclude, dnsZoneExclude))
+	tunnelClient.SetCacheTTL(cloudflareCacheTTL)
+	tunnelClient.SetRateLimit(cloudflareRateLimit, tunnel.DefaultRateLimitPeriod)
 
 	ctrlr, err := controller.RegisterIngressController(logger, mgr, controller.IngressControllerOptions{
 		IngressClassName:    ingressClassName,
@@ -98,24 +141,36 @@ func run(logger logr.Logger) error {
 		CloudflaredConfig: controller.CloudflaredConfig{
 			CloudflaredImage:           cloudflaredImage,
 			CloudflaredImagePullPolicy: cloudflaredImagePullPolicy,
+			Workload:                   cloudflaredWorkload,
 		},
+		TunnelSecretRotation: tunnelSecretRotation,
 	})
 	if err != nil {
 		return fmt.Errorf("could not register ingress controller: %w", err)
 	}
 
-	err = tunnelClient.EnsureTunnelExists(ctx, logger)
-	if err != nil {
-		return fmt.Errorf("could not ensure tunnel exists: %w", err)
+	healthSrv := health.NewServer(logger.WithName("health"), 8081)
+
+	if tunnelHealthEnabled {
+		monitor := tunnel.NewHealthMonitor(tunnelClient, tunnelHealthInterval, tunnelHealthUnhealthyThreshold, logger.WithName("tunnel-health"))
+		if err := mgr.Add(monitor); err != nil {
+			return fmt.Errorf("could not add tunnel health monitor to manager: %w", err)
+		}
+		healthSrv.AddCheck("/tunnelz", monitor.Check)
 	}
 
-	token, err := tunnelClient.GetTunnelToken(ctx)
+	// Only the leader talks to Cloudflare and manages cloudflared, it becomes ready once both are set up
+	err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		if err := bootstrap(ctx, logger, tunnelClient, ctrlr); err != nil {
+			return err
+		}
+		healthSrv.SetReady(true)
+		logger.Info("Controller is ready")
+		return nil
+	}))
 	if err != nil {
-		return fmt.Errorf("could not get tunnel token: %w", err)
+		return fmt.Errorf("could not add bootstrap to manager: %w", err)
 	}
-	ctrlr.SetTunnelToken(token)
-
-	healthSrv := health.NewServer(logger.WithName("health"), 8081)
 
 	var wg sync.WaitGroup
 
@@ -125,45 +180,74 @@ func run(logger logr.Logger) error {
 		}
 	})
 
+	var mgrErr error
 	wg.Go(func() {
-		if err := mgr.Start(ctx); err != nil {
-			logger.Error(err, "could not start manager")
-		}
+		// Stops the health server too when the manager fails
+		defer stop()
+		mgrErr = mgr.Start(ctx)
 	})
 
 	logger.Info("Waiting for cache to sync...")
 	for !mgr.GetCache().WaitForCacheSync(ctx) {
 		select {
 		case <-ctx.Done():
-			return nil
+			wg.Wait()
+			return mgrErr
 		case <-time.After(100 * time.Millisecond):
 		}
 	}
 
+	select {
+	case <-mgr.Elected():
+	default:
+		// Standby replicas are ready to take over, they just do not reconcile
+		logger.Info("Standing by until elected leader", "lease", leaderElectionID)
+		healthSrv.SetReady(true)
+	}
+
+	wg.Wait()
+	return mgrErr
+}
+
+// bootstrap ensures the tunnel exists and deploys cloudflared for it, before any Ingress is reconciled.
+func bootstrap(ctx context.Context, logger logr.Logger, tunnelClient *tunnel.Client, ctrlr *controller.IngressController) error {
+	logger.Info("Bootstrapping the tunnel")
+
+	err := tunnelClient.EnsureTunnelExists(ctx, logger)
+	if err != nil {
+		return fmt.Errorf("could not ensure tunnel exists: %w", err)
+	}
+
+	token, err := tunnelClient.GetTunnelToken(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get tunnel token: %w", err)
+	}
+	ctrlr.SetTunnelToken(token)
+
 	for {
 		err = ctrlr.EnsureCloudflaredDeploymentExists(ctx, logger)
-		if err != nil {
-			logger.Error(err, "could not ensure cloudflared deployment exists")
-			select {
-			case <-ctx.Done():
-				return nil
-			case <-time.After(1 * time.Second):
-			}
-			continue
+		if err == nil {
+			return nil
+		}
+		logger.Error(err, "could not ensure cloudflared deployment exists")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(1 * time.Second):
 		}
-		break
 	}
-
-	healthSrv.SetReady(true)
-	logger.Info("Controller is ready")
-
-	wg.Wait()
-	return nil
 }
 
 func loadConfig() error {
 	flag.StringVar(&ingressClassName, "ingress-class-name", "cloudflare-tunnel", "Ingress class name to watch for")
 	flag.StringVar(&controllerClassName, "controller-class-name", "clbs.io/cloudflare-tunnel-ingress-controller", "Controller class name to set on Ingress")
+	flag.StringVar(&metricsBindAddress, "metrics-bind-address", ":8080", "Address the Prometheus metrics are served on, 0 disables them")
+	flag.BoolVar(&leaderElection, "leader-elect", false, "Elect a leader among the controller replicas, only the leader reconciles")
+	flag.StringVar(&leaderElectionID, "leader-election-id", "cloudflare-tunnel-ingress-controller", "Name of the Lease used for leader election")
+	flag.StringVar(&leaderElectionNamespace, "leader-election-namespace", os.Getenv("NAMESPACE"), "Namespace of the Lease used for leader election, the controller's namespace by default")
+	flag.DurationVar(&leaderElectionLeaseDuration, "leader-election-lease-duration", 15*time.Second, "How long standby replicas wait before taking over the leadership")
+	flag.DurationVar(&leaderElectionRenewDeadline, "leader-election-renew-deadline", 10*time.Second, "How long the leader tries to renew the leadership before giving it up")
+	flag.DurationVar(&leaderElectionRetryPeriod, "leader-election-retry-period", 2*time.Second, "How often leader election is attempted")
 	flag.Parse()
 
 	if tokenFile := os.Getenv("CLOUDFLARE_API_TOKEN_FILE"); tokenFile != "" {
@@ -189,6 +273,10 @@ func loadConfig() error {
 		return errors.New("CLOUDFLARED_IMAGE_PULL_POLICY is required")
 	}
 
+	if err := loadCloudflaredWorkloadConfig(); err != nil {
+		return err
+	}
+
 	cloudflareAccountID = os.Getenv("CLOUDFLARE_ACCOUNT_ID")
 	if cloudflareAccountID == "" {
 		return errors.New("CLOUDFLARE_ACCOUNT_ID is required")
@@ -199,5 +287,199 @@ func loadConfig() error {
 		return errors.New("CLOUDFLARE_TUNNEL_NAME is required")
 	}
 
+	cloudflareCacheTTL = tunnel.DefaultCacheTTL
+	if v := os.Getenv("CLOUDFLARE_CACHE_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("could not parse CLOUDFLARE_CACHE_TTL: %w", err)
+		}
+		cloudflareCacheTTL = ttl
+	}
+
+	cloudflareRateLimit = tunnel.DefaultRateLimit
+	if v := os.Getenv("CLOUDFLARE_RATE_LIMIT"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			return fmt.Errorf("could not parse CLOUDFLARE_RATE_LIMIT: %q", v)
+		}
+		cloudflareRateLimit = limit
+	}
+
+	dnsOwnerID = os.Getenv("DNS_OWNER_ID")
+	if dnsOwnerID == "" {
+		dnsOwnerID = cloudflareTunnelName
+	}
+
+	dnsZoneInclude = os.Getenv("DNS_ZONE_INCLUDE")
+	dnsZoneExclude = os.Getenv("DNS_ZONE_EXCLUDE")
+
+	if v := os.Getenv("TUNNEL_SECRET_ROTATION_ENABLED"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("could not parse TUNNEL_SECRET_ROTATION_ENABLED: %w", err)
+		}
+		tunnelSecretRotation.Enabled = enabled
+	}
+	if v := os.Getenv("TUNNEL_SECRET_ROTATION_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval < 0 {
+			return fmt.Errorf("could not parse TUNNEL_SECRET_ROTATION_INTERVAL: %q", v)
+		}
+		tunnelSecretRotation.Interval = interval
+	}
+	tunnelSecretRotation.ConfigMapName = os.Getenv("CONTROLLER_CONFIGMAP_NAME")
+
+	tunnelHealthEnabled = true
+	if v := os.Getenv("TUNNEL_HEALTH_ENABLED"); v != "" {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("could not parse TUNNEL_HEALTH_ENABLED: %w", err)
+		}
+		tunnelHealthEnabled = enabled
+	}
+	tunnelHealthInterval = tunnel.DefaultHealthCheckInterval
+	if v := os.Getenv("TUNNEL_HEALTH_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			return fmt.Errorf("could not parse TUNNEL_HEALTH_INTERVAL: %q", v)
+		}
+		tunnelHealthInterval = interval
+	}
+	tunnelHealthUnhealthyThreshold = tunnel.DefaultUnhealthyThreshold
+	if v := os.Getenv("TUNNEL_HEALTH_UNHEALTHY_THRESHOLD"); v != "" {
+		threshold, err := time.ParseDuration(v)
+		if err != nil || threshold <= 0 {
+			return fmt.Errorf("could not parse TUNNEL_HEALTH_UNHEALTHY_THRESHOLD: %q", v)
+		}
+		tunnelHealthUnhealthyThreshold = threshold
+	}
+
+	return nil
+}
+
+// loadCloudflaredWorkloadConfig reads the settings of the cloudflared pods, the structured ones as JSON.
+func loadCloudflaredWorkloadConfig() error {
+	if v := os.Getenv("CLOUDFLARED_REPLICAS"); v != "" {
+		replicas, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || replicas <= 0 {
+			return fmt.Errorf("could not parse CLOUDFLARED_REPLICAS: %q", v)
+		}
+		cloudflaredWorkload.Replicas = int32(replicas)
+	}
+
+	if v := os.Getenv("CLOUDFLARED_METRICS_PORT"); v != "" {
+		port, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("could not parse CLOUDFLARED_METRICS_PORT: %q", v)
+		}
+		cloudflaredWorkload.MetricsPort = int32(port)
+	}
+
+	cloudflaredWorkload.PriorityClassName = os.Getenv("CLOUDFLARED_PRIORITY_CLASS_NAME")
+
+	if v := os.Getenv("CLOUDFLARED_WORKLOAD_MODE"); v != "" {
+		mode, ok := controller.ParseCloudflaredMode(v)
+		if !ok {
+			return fmt.Errorf("could not parse CLOUDFLARED_WORKLOAD_MODE: %q", v)
+		}
+		cloudflaredWorkload.Mode = mode
+	}
+
+	if v := os.Getenv("CLOUDFLARED_METRICS_MONITOR"); v != "" {
+		monitor, ok := controller.ParseMetricsMonitor(v)
+		if !ok {
+			return fmt.Errorf("could not parse CLOUDFLARED_METRICS_MONITOR: %q", v)
+		}
+		cloudflaredWorkload.Metrics.Monitor = monitor
+	}
+	cloudflaredWorkload.Metrics.MonitorInterval = os.Getenv("CLOUDFLARED_METRICS_MONITOR_INTERVAL")
+
+	boolVars := []struct {
+		name  string
+		value *bool
+	}{
+		{"CLOUDFLARED_PDB_ENABLED", &cloudflaredWorkload.PodDisruptionBudget.Enabled},
+		{"CLOUDFLARED_AUTOSCALING_ENABLED", &cloudflaredWorkload.Autoscaling.Enabled},
+		{"CLOUDFLARED_UPGRADE_GATED", &cloudflaredWorkload.Upgrade.Gated},
+	}
+	for _, v := range boolVars {
+		data := os.Getenv(v.name)
+		if data == "" {
+			continue
+		}
+		enabled, err := strconv.ParseBool(data)
+		if err != nil {
+			return fmt.Errorf("could not parse %s: %w", v.name, err)
+		}
+		*v.value = enabled
+	}
+
+	intVars := []struct {
+		name  string
+		value *int32
+	}{
+		{"CLOUDFLARED_AUTOSCALING_MIN_REPLICAS", &cloudflaredWorkload.Autoscaling.MinReplicas},
+		{"CLOUDFLARED_AUTOSCALING_MAX_REPLICAS", &cloudflaredWorkload.Autoscaling.MaxReplicas},
+		{"CLOUDFLARED_AUTOSCALING_TARGET_CPU_UTILIZATION", &cloudflaredWorkload.Autoscaling.TargetCPUUtilization},
+	}
+	for _, v := range intVars {
+		data := os.Getenv(v.name)
+		if data == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(data, 10, 32)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("could not parse %s: %q", v.name, data)
+		}
+		*v.value = int32(n)
+	}
+
+	if v := os.Getenv("CLOUDFLARED_PDB_MIN_AVAILABLE"); v != "" {
+		cloudflaredWorkload.PodDisruptionBudget.MinAvailable = ptr.To(intstr.Parse(v))
+	}
+	if v := os.Getenv("CLOUDFLARED_PDB_MAX_UNAVAILABLE"); v != "" {
+		cloudflaredWorkload.PodDisruptionBudget.MaxUnavailable = ptr.To(intstr.Parse(v))
+	}
+	if cloudflaredWorkload.PodDisruptionBudget.MinAvailable != nil && cloudflaredWorkload.PodDisruptionBudget.MaxUnavailable != nil {
+		return errors.New("CLOUDFLARED_PDB_MIN_AVAILABLE and CLOUDFLARED_PDB_MAX_UNAVAILABLE are mutually exclusive")
+	}
+
+	if v := os.Getenv("CLOUDFLARED_UPGRADE_MAX_SURGE"); v != "" {
+		cloudflaredWorkload.Upgrade.MaxSurge = ptr.To(intstr.Parse(v))
+	}
+	if v := os.Getenv("CLOUDFLARED_UPGRADE_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			return fmt.Errorf("could not parse CLOUDFLARED_UPGRADE_TIMEOUT: %q", v)
+		}
+		cloudflaredWorkload.Upgrade.Timeout = timeout
+	}
+
+	jsonVars := []struct {
+		name  string
+		value any
+	}{
+		{"CLOUDFLARED_RESOURCES", &cloudflaredWorkload.Resources},
+		{"CLOUDFLARED_NODE_SELECTOR", &cloudflaredWorkload.NodeSelector},
+		{"CLOUDFLARED_TOLERATIONS", &cloudflaredWorkload.Tolerations},
+		{"CLOUDFLARED_AFFINITY", &cloudflaredWorkload.Affinity},
+		{"CLOUDFLARED_TOPOLOGY_SPREAD_CONSTRAINTS", &cloudflaredWorkload.TopologySpreadConstraints},
+		{"CLOUDFLARED_POD_SECURITY_CONTEXT", &cloudflaredWorkload.PodSecurityContext},
+		{"CLOUDFLARED_SECURITY_CONTEXT", &cloudflaredWorkload.SecurityContext},
+		{"CLOUDFLARED_LABELS", &cloudflaredWorkload.Labels},
+		{"CLOUDFLARED_ANNOTATIONS", &cloudflaredWorkload.Annotations},
+		{"CLOUDFLARED_AUTOSCALING_METRICS", &cloudflaredWorkload.Autoscaling.Metrics},
+		{"CLOUDFLARED_METRICS_MONITOR_LABELS", &cloudflaredWorkload.Metrics.MonitorLabels},
+	}
+	for _, v := range jsonVars {
+		data := os.Getenv(v.name)
+		if data == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(data), v.value); err != nil {
+			return fmt.Errorf("could not parse %s: %w", v.name, err)
+		}
+	}
+
 	return nil
 }
@@ -28,3 +28,11 @@ const AnnotationAccessAudTag = "cloudflare-tunnel-ingress-controller.clbs.io/acc
 
 // Cloudflare Access annotation — auto-create a new Access application for this ingress hostname
 const AnnotationAccessAppName = "cloudflare-tunnel-ingress-controller.clbs.io/access-app-name"
+
+// DNS annotations
+const AnnotationDNSDisabled = "cloudflare-tunnel-ingress-controller.clbs.io/dns-disabled"
+const AnnotationDNSTakeover = "cloudflare-tunnel-ingress-controller.clbs.io/dns-takeover"
+const AnnotationDNSProxied = "cloudflare-tunnel-ingress-controller.clbs.io/dns-proxied"
+const AnnotationDNSTTL = "cloudflare-tunnel-ingress-controller.clbs.io/dns-ttl"
+const AnnotationDNSComment = "cloudflare-tunnel-ingress-controller.clbs.io/dns-comment"
+const AnnotationDNSTags = "cloudflare-tunnel-ingress-controller.clbs.io/dns-tags"
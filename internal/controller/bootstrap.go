@@ -13,15 +13,19 @@ type IngressControllerOptions struct {
 	ControllerClassName string
 	TunnelClient        *tunnel.Client
 	CloudflaredConfig   CloudflaredConfig
+
+	TunnelSecretRotation TunnelSecretRotationOptions
 }
 
 func RegisterIngressController(logger logr.Logger, mgr manager.Manager, options IngressControllerOptions) (*IngressController, error) {
-	controller, err := NewIngressController(logger.WithName("ingress-controller"), mgr.GetClient(), mgr.GetConfig(), options.TunnelClient, options.IngressClassName, options.ControllerClassName, options.CloudflaredConfig)
+	controller, err := NewIngressController(logger.WithName("ingress-controller"), mgr.GetClient(), mgr.GetConfig(), mgr.GetEventRecorder(eventRecorderName), options.TunnelClient, options.IngressClassName, options.ControllerClassName, options.CloudflaredConfig)
 	if err != nil {
 		logger.WithName("register-controller").Error(err, "could not create ingress controller")
 		return nil, err
 	}
 
+	options.TunnelClient.SetRuleOwnershipStore(newConfigMapRuleOwnershipStore(controller.clientset, namespace()))
+
 	err = builder.
 		ControllerManagedBy(mgr).
 		For(&networkingv1.Ingress{}).
@@ -32,5 +36,26 @@ func RegisterIngressController(logger logr.Logger, mgr manager.Manager, options
 		return nil, err
 	}
 
+	err = registerCloudflaredReconciler(logger.WithName("register-controller"), mgr, controller)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.TunnelSecretRotation.Enabled {
+		err = mgr.Add(newTunnelSecretRotator(logger.WithName("tunnel-secret-rotation"), controller, options.TunnelSecretRotation))
+		if err != nil {
+			logger.WithName("register-controller").Error(err, "could not register tunnel secret rotation")
+			return nil, err
+		}
+	}
+
+	if options.CloudflaredConfig.Workload.Upgrade.Gated {
+		err = mgr.Add(newCloudflaredUpgradeGate(logger.WithName("cloudflared-upgrade"), controller))
+		if err != nil {
+			logger.WithName("register-controller").Error(err, "could not register cloudflared upgrade gate")
+			return nil, err
+		}
+	}
+
 	return controller, nil
 }
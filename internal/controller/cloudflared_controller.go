@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// cloudflaredReconciler reverts deletions and changes of the objects making up cloudflared as soon as they happen,
+// independently of the Ingress reconciles.
+type cloudflaredReconciler struct {
+	controller *IngressController
+}
+
+// CacheOptions restricts the cache of the objects watched for cloudflared to the ones created by the controller,
+// which avoids caching every Secret of the cluster.
+func CacheOptions() cache.Options {
+	byObject := cache.ByObject{
+		Namespaces: map[string]cache.Config{namespace(): {}},
+		Label:      labels.SelectorFromSet(cloudflaredSelectorLabels()),
+	}
+	return cache.Options{
+		ByObject: map[client.Object]cache.ByObject{
+			&appsv1.Deployment{}:            byObject,
+			&appsv1.DaemonSet{}:             byObject,
+			&corev1.Secret{}:                byObject,
+			&policyv1.PodDisruptionBudget{}: byObject,
+		},
+	}
+}
+
+func registerCloudflaredReconciler(logger logr.Logger, mgr manager.Manager, controller *IngressController) error {
+	// Every object maps to the single cloudflared workload
+	request := handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, obj client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: namespace(), Name: appName}}}
+	})
+	managed := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetNamespace() == namespace() && isManagedByController(obj.GetLabels())
+	})
+	// Status updates, frequent while rolling, change nothing set by the controller
+	changed := predicate.Or(predicate.GenerationChangedPredicate{}, predicate.LabelChangedPredicate{}, predicate.AnnotationChangedPredicate{})
+	// Readiness changes too, the workload of the previous mode is removed once the one replacing it is ready
+	workloadChanged := predicate.Or(changed, predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			return readyConnectors(e.ObjectOld) != readyConnectors(e.ObjectNew)
+		},
+	})
+
+	err := builder.
+		ControllerManagedBy(mgr).
+		Named("cloudflared").
+		Watches(&appsv1.Deployment{}, request, builder.WithPredicates(managed, workloadChanged)).
+		Watches(&appsv1.DaemonSet{}, request, builder.WithPredicates(managed, workloadChanged)).
+		Watches(&corev1.Secret{}, request, builder.WithPredicates(managed)).
+		Watches(&policyv1.PodDisruptionBudget{}, request, builder.WithPredicates(managed, changed)).
+		Complete(&cloudflaredReconciler{controller: controller})
+	if err != nil {
+		logger.Error(err, "could not register cloudflared reconciler")
+		return err
+	}
+	return nil
+}
+
+// readyConnectors returns the ready cloudflared pods of a Deployment or a DaemonSet.
+func readyConnectors(obj client.Object) int32 {
+	switch workload := obj.(type) {
+	case *appsv1.Deployment:
+		return workload.Status.ReadyReplicas
+	case *appsv1.DaemonSet:
+		return workload.Status.NumberReady
+	}
+	return 0
+}
+
+func (r *cloudflaredReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	reqLogger := log.FromContext(ctx)
+
+	if !r.controller.hasTunnelToken() {
+		// Deployed by the bootstrap once the tunnel is set up
+		return ctrl.Result{}, nil
+	}
+
+	reverted, err := r.controller.ensureCloudflared(ctx, reqLogger)
+	if reverted {
+		tunnel.ObserveDriftCorrection(tunnel.DriftResourceCloudflared)
+	}
+	if err != nil {
+		reqLogger.Error(err, "failed to ensure cloudflared deployment exists")
+		return ctrl.Result{}, err
+	}
+
+	return ctrl.Result{}, nil
+}
@@ -0,0 +1,110 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel"
+	"github.com/go-logr/logr"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	crfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+func TestCloudflaredReconciler(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloudflaredController("")
+	c.client = crfake.NewClientBuilder().Build()
+	c.cloudflaredDeploymentConfig.workload.PodDisruptionBudget.Enabled = true
+	r := &cloudflaredReconciler{controller: c}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: namespace(), Name: appName}}
+	deployment := &appsv1.Deployment{}
+
+	// before the bootstrap
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.client.Get(ctx, req.NamespacedName, deployment); !apierrors.IsNotFound(err) {
+		t.Fatalf("expected nothing to be deployed without a tunnel token, got %v", err)
+	}
+
+	c.SetTunnelToken("token")
+	if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reverted := cloudflaredDriftCorrections(t)
+
+	// unchanged
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cloudflaredDriftCorrections(t) - reverted; got != 0 {
+		t.Errorf("expected no drift correction, got %v", got)
+	}
+
+	// deleted
+	if err := c.client.Get(ctx, req.NamespacedName, deployment); err != nil {
+		t.Fatalf("failed to get Deployment: %v", err)
+	}
+	if err := c.client.Delete(ctx, deployment); err != nil {
+		t.Fatalf("failed to delete Deployment: %v", err)
+	}
+	if err := c.clientset.CoreV1().Secrets(namespace()).Delete(ctx, tunnelTokenSecretName, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete Secret: %v", err)
+	}
+	if err := c.clientset.PolicyV1().PodDisruptionBudgets(namespace()).Delete(ctx, appName, metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("failed to delete PodDisruptionBudget: %v", err)
+	}
+
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.client.Get(ctx, req.NamespacedName, deployment); err != nil {
+		t.Errorf("expected the Deployment to be recreated: %v", err)
+	}
+	if _, err := c.clientset.CoreV1().Secrets(namespace()).Get(ctx, tunnelTokenSecretName, metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the Secret to be recreated: %v", err)
+	}
+	if _, err := c.clientset.PolicyV1().PodDisruptionBudgets(namespace()).Get(ctx, appName, metav1.GetOptions{}); err != nil {
+		t.Errorf("expected the PodDisruptionBudget to be recreated: %v", err)
+	}
+	if got := cloudflaredDriftCorrections(t) - reverted; got != 1 {
+		t.Errorf("expected a drift correction, got %v", got)
+	}
+
+	// a new token is rolled out, not reverted
+	c.SetTunnelToken("rotated")
+	if _, err := r.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cloudflaredDriftCorrections(t) - reverted; got != 1 {
+		t.Errorf("expected the rollout of the token not to count as drift, got %v", got)
+	}
+}
+
+// cloudflaredDriftCorrections returns the drift corrections of cloudflared in the metrics registry.
+func cloudflaredDriftCorrections(t *testing.T) float64 {
+	t.Helper()
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatalf("failed to gather metrics: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != "cloudflare_tunnel_ingress_controller_drift_corrections_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "resource" && label.GetValue() == tunnel.DriftResourceCloudflared {
+					return m.GetCounter().GetValue()
+				}
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"context"
+	"maps"
+	"strings"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// ensureCloudflaredDaemonSet creates or updates the cloudflared DaemonSet, then removes the Deployment of the other
+// mode once the DaemonSet has a ready connector.
+func (c *IngressController) ensureCloudflaredDaemonSet(ctx context.Context, logger logr.Logger, tokenChecksum string) error {
+	desired, err := c.newCloudflaredDaemonSet(tokenChecksum)
+	if err != nil {
+		logger.Error(err, "Failed to create Cloudflared DaemonSet resource")
+		return err
+	}
+
+	found := &appsv1.DaemonSet{}
+	err = c.client.Get(ctx, types.NamespacedName{Name: appName, Namespace: namespace()}, found)
+	if apierrors.IsNotFound(err) {
+		logger.Info("Creating Cloudflared DaemonSet resource")
+		err = c.client.Create(ctx, desired)
+		if err != nil {
+			logger.Error(err, "Failed to create Cloudflared DaemonSet resource")
+			return err
+		}
+		c.cloudflaredDeploymentConfig.writes++
+		return c.removeCloudflaredDeployment(ctx, logger, false)
+	}
+	if err != nil {
+		logger.Error(err, "Failed to get Cloudflared DaemonSet resource")
+		return err
+	}
+
+	// The found spec has the defaults filled in by the API server, fields removed from the configuration are only
+	// noticed by the checksum of the desired state
+	if !equality.Semantic.DeepDerivative(desired.Labels, found.Labels) ||
+		!equality.Semantic.DeepDerivative(desired.Annotations, found.Annotations) ||
+		!equality.Semantic.DeepDerivative(desired.Spec, found.Spec) ||
+		desired.Annotations[specChecksumAnnotation] != found.Annotations[specChecksumAnnotation] {
+		desired.ResourceVersion = found.ResourceVersion
+		if err = c.client.Update(ctx, desired); err != nil {
+			logger.Error(err, "Failed to update Cloudflared DaemonSet resource")
+			return err
+		}
+		c.cloudflaredDeploymentConfig.writes++
+		logger.Info("Updated Cloudflared DaemonSet according to configuration")
+	}
+
+	return c.removeCloudflaredDeployment(ctx, logger, found.Status.NumberReady > 0)
+}
+
+// newCloudflaredDaemonSet returns cloudflared running on every node selected by the configuration, with the pods of
+// the Deployment.
+func (c *IngressController) newCloudflaredDaemonSet(tokenChecksum string) (*appsv1.DaemonSet, error) {
+	maxUnavailable := intstr.FromInt32(0)
+
+	template, err := c.newCloudflaredPodTemplate(tokenChecksum)
+	if err != nil {
+		return nil, err
+	}
+
+	daemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        appName,
+			Namespace:   namespace(),
+			Labels:      template.Labels,
+			Annotations: maps.Clone(c.cloudflaredDeploymentConfig.workload.Annotations),
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{
+				MatchLabels: cloudflaredWorkloadSelectorLabels(CloudflaredModeDaemonSet),
+			},
+			// Start the new pod of a node before stopping the old one, so the node keeps its connector while rolling
+			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{
+				Type: appsv1.RollingUpdateDaemonSetStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateDaemonSet{
+					MaxUnavailable: &maxUnavailable,
+					MaxSurge:       c.cloudflaredDeploymentConfig.workload.Upgrade.maxSurge(),
+				},
+			},
+			Template: template,
+		},
+	}
+
+	if err = setSpecChecksum(&daemonSet.ObjectMeta, daemonSet.Spec); err != nil {
+		return nil, err
+	}
+
+	return daemonSet, nil
+}
+
+// removeCloudflaredDaemonSet deletes the DaemonSet left from the DaemonSet mode once its replacement is ready, so the
+// tunnel is never left without a connector.
+func (c *IngressController) removeCloudflaredDaemonSet(ctx context.Context, logger logr.Logger, replacementReady bool) error {
+	found := &appsv1.DaemonSet{}
+	err := c.client.Get(ctx, types.NamespacedName{Name: appName, Namespace: namespace()}, found)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		logger.Error(err, "Failed to get Cloudflared DaemonSet resource")
+		return err
+	}
+	if !isManagedByController(found.Labels) {
+		return nil
+	}
+	if !replacementReady {
+		logger.Info("Keeping the Cloudflared DaemonSet until the Deployment has a ready connector")
+		return nil
+	}
+
+	logger.Info("Deleting Cloudflared DaemonSet resource replaced by the Deployment")
+	err = c.client.Delete(ctx, found)
+	if err != nil && !apierrors.IsNotFound(err) {
+		logger.Error(err, "Failed to delete Cloudflared DaemonSet resource")
+		return err
+	}
+	return nil
+}
+
+// removeCloudflaredDeployment deletes the Deployment left from the Deployment mode once its replacement is ready, so
+// the tunnel is never left without a connector.
+func (c *IngressController) removeCloudflaredDeployment(ctx context.Context, logger logr.Logger, replacementReady bool) error {
+	found := &appsv1.Deployment{}
+	err := c.client.Get(ctx, types.NamespacedName{Name: appName, Namespace: namespace()}, found)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		logger.Error(err, "Failed to get Cloudflared Deployment resource")
+		return err
+	}
+	if !isManagedByController(found.Labels) {
+		return nil
+	}
+	if !replacementReady {
+		logger.Info("Keeping the Cloudflared Deployment until the DaemonSet has a ready connector")
+		return nil
+	}
+
+	logger.Info("Deleting Cloudflared Deployment resource replaced by the DaemonSet")
+	err = c.client.Delete(ctx, found)
+	if err != nil && !apierrors.IsNotFound(err) {
+		logger.Error(err, "Failed to delete Cloudflared Deployment resource")
+		return err
+	}
+	return nil
+}
+
+// ParseCloudflaredMode returns the workload mode named case-insensitively, false if unknown.
+func ParseCloudflaredMode(name string) (string, bool) {
+	for _, mode := range []string{CloudflaredModeDeployment, CloudflaredModeDaemonSet} {
+		if strings.EqualFold(name, mode) {
+			return mode, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,135 @@
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestEnsureCloudflaredModeMigration(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloudflaredController("token")
+	c.client = crfake.NewClientBuilder().Build()
+	key := types.NamespacedName{Name: appName, Namespace: namespace()}
+	workload := &c.cloudflaredDeploymentConfig.workload
+	workload.PodDisruptionBudget.Enabled = true
+	pdbs := c.clientset.PolicyV1().PodDisruptionBudgets(namespace())
+	pdbExists := func() bool {
+		t.Helper()
+		_, err := pdbs.Get(ctx, appName, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return err == nil
+	}
+
+	ensure := func() {
+		t.Helper()
+		if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	exists := func(obj client.Object) bool {
+		t.Helper()
+		err := c.client.Get(ctx, key, obj)
+		if err != nil && !apierrors.IsNotFound(err) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return err == nil
+	}
+
+	ensure()
+	if !exists(&appsv1.Deployment{}) {
+		t.Fatal("expected a Deployment")
+	}
+	if !pdbExists() {
+		t.Fatal("expected a PodDisruptionBudget")
+	}
+
+	// to the DaemonSet, the Deployment is kept until a pod of the DaemonSet is ready
+	workload.Mode = CloudflaredModeDaemonSet
+	workload.NodeSelector = map[string]string{"node-role.kubernetes.io/edge": ""}
+	ensure()
+	daemonSet := &appsv1.DaemonSet{}
+	if !exists(daemonSet) {
+		t.Fatal("expected a DaemonSet")
+	}
+	if daemonSet.Spec.Template.Spec.NodeSelector["node-role.kubernetes.io/edge"] != "" || len(daemonSet.Spec.Template.Spec.NodeSelector) != 1 {
+		t.Errorf("expected the node selector on the DaemonSet pods, got %v", daemonSet.Spec.Template.Spec.NodeSelector)
+	}
+	if !exists(&appsv1.Deployment{}) {
+		t.Fatal("expected the Deployment to be kept while the DaemonSet is not ready")
+	}
+	deployment := &appsv1.Deployment{}
+	exists(deployment)
+	daemonSetSelector, err := metav1.LabelSelectorAsSelector(daemonSet.Spec.Selector)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !daemonSetSelector.Matches(labels.Set(daemonSet.Spec.Template.Labels)) || daemonSetSelector.Matches(labels.Set(deployment.Spec.Template.Labels)) {
+		t.Errorf("expected the DaemonSet to select its own pods only, got selector %v", daemonSetSelector)
+	}
+	pdbSelector, err := metav1.LabelSelectorAsSelector(newCloudflaredPodDisruptionBudget(workload.PodDisruptionBudget).Spec.Selector)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !pdbSelector.Matches(labels.Set(deployment.Spec.Template.Labels)) || pdbSelector.Matches(labels.Set(daemonSet.Spec.Template.Labels)) {
+		t.Errorf("expected the PodDisruptionBudget to select the pods of the Deployment only, got selector %v", pdbSelector)
+	}
+	serviceSelector := labels.SelectorFromSet(c.newCloudflaredMetricsService().Spec.Selector)
+	if !serviceSelector.Matches(labels.Set(deployment.Spec.Template.Labels)) || !serviceSelector.Matches(labels.Set(daemonSet.Spec.Template.Labels)) {
+		t.Errorf("expected the metrics Service to select the pods of both workloads, got selector %v", serviceSelector)
+	}
+	if pdbExists() {
+		t.Error("expected no PodDisruptionBudget in the DaemonSet mode")
+	}
+
+	daemonSet.Status.NumberReady = 1
+	if err := c.client.Status().Update(ctx, daemonSet); err != nil {
+		t.Fatalf("failed to update DaemonSet status: %v", err)
+	}
+	ensure()
+	if exists(&appsv1.Deployment{}) {
+		t.Fatal("expected the Deployment to be deleted once the DaemonSet is ready")
+	}
+
+	// back to the Deployment
+	workload.Mode = CloudflaredModeDeployment
+	ensure()
+	deployment = &appsv1.Deployment{}
+	if !exists(deployment) {
+		t.Fatal("expected a Deployment")
+	}
+	if !exists(&appsv1.DaemonSet{}) {
+		t.Fatal("expected the DaemonSet to be kept while the Deployment is not ready")
+	}
+
+	deployment.Status.ReadyReplicas = 1
+	if err := c.client.Status().Update(ctx, deployment); err != nil {
+		t.Fatalf("failed to update Deployment status: %v", err)
+	}
+	ensure()
+	if exists(&appsv1.DaemonSet{}) {
+		t.Error("expected the DaemonSet to be deleted once the Deployment is ready")
+	}
+	if !pdbExists() {
+		t.Error("expected the PodDisruptionBudget back in the Deployment mode")
+	}
+}
+
+func TestParseCloudflaredMode(t *testing.T) {
+	if mode, ok := ParseCloudflaredMode("daemonset"); !ok || mode != CloudflaredModeDaemonSet {
+		t.Errorf("expected %q, got %q", CloudflaredModeDaemonSet, mode)
+	}
+	if _, ok := ParseCloudflaredMode("StatefulSet"); ok {
+		t.Error("expected an unknown mode to be rejected")
+	}
+}
@@ -2,8 +2,12 @@ package controller
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
-	"strings"
+	"fmt"
+	"maps"
 	"sync"
 
 	"github.com/go-logr/logr"
@@ -14,20 +18,134 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
 )
 
 const appName = "cloudflare-tunnel-cloudflared"
 
+const DefaultCloudflaredMetricsPort = 9090
+const cloudflaredMetricsPortName = "metrics"
+
+// specChecksumAnnotation on the Deployment records the desired state it was last written with, so fields removed
+// from the configuration are removed from the Deployment too.
+const specChecksumAnnotation = "cloudflare-tunnel-ingress-controller.clbs.io/spec-checksum"
+
 type cloudflaredDeploymentConfig struct {
 	cloudflaredImage           string
 	cloudflaredImagePullPolicy string
-	tunnelTokenLck             sync.RWMutex
-	tunnelToken                string
+	workload                   CloudflaredWorkloadConfig
+	// ensureLck serializes ensuring cloudflared from the bootstrap and the reconcilers
+	ensureLck      sync.Mutex
+	tunnelTokenLck sync.RWMutex
+	tunnelToken    string
+	// writes counts the workload, Secret and PodDisruptionBudget created or updated while ensuring cloudflared, and
+	// ensuredTokenChecksum is the token they were last ensured with, both guarded by ensureLck
+	writes               int
+	ensuredTokenChecksum string
+}
+
+// Workload modes running cloudflared
+const CloudflaredModeDeployment = "Deployment"
+const CloudflaredModeDaemonSet = "DaemonSet"
+
+// CloudflaredWorkloadConfig customizes the cloudflared pods. Unset fields are left to the Kubernetes defaults.
+type CloudflaredWorkloadConfig struct {
+	// Mode runs cloudflared as a Deployment, the default, or as a DaemonSet with a connector on every node selected
+	// by the NodeSelector
+	Mode string
+	// Replicas of the cloudflared Deployment, 1 when zero, unused by the DaemonSet
+	Replicas                  int32
+	Resources                 corev1.ResourceRequirements
+	NodeSelector              map[string]string
+	Tolerations               []corev1.Toleration
+	Affinity                  *corev1.Affinity
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint
+	PriorityClassName         string
+	PodSecurityContext        *corev1.PodSecurityContext
+	SecurityContext           *corev1.SecurityContext
+	// MetricsPort serves the metrics and the readiness of cloudflared, DefaultCloudflaredMetricsPort when zero
+	MetricsPort int32
+	// Labels and Annotations are added to the workload and its pods, they cannot replace the ones set by the
+	// controller
+	Labels      map[string]string
+	Annotations map[string]string
+
+	PodDisruptionBudget CloudflaredPodDisruptionBudgetConfig
+	Autoscaling         CloudflaredAutoscalingConfig
+	Metrics             CloudflaredMetricsConfig
+	Upgrade             CloudflaredUpgradeConfig
+}
+
+// cloudflaredWorkloadLabel names the workload running a cloudflared pod, "deployment" or "daemonset", so the pods of
+// the Deployment and of the DaemonSet are told apart while migrating between the modes.
+const cloudflaredWorkloadLabel = "cloudflare-tunnel-ingress-controller.clbs.io/workload"
+
+// cloudflaredSelectorLabels select the cloudflared pods of both workloads, e.g. to scrape the metrics of all the
+// connectors while migrating between the modes.
+func cloudflaredSelectorLabels() map[string]string {
+	return map[string]string{
+		"app.kubernetes.io/name":       appName,
+		"app.kubernetes.io/managed-by": "cloudflare-tunnel-ingress-controller",
+		"app.kubernetes.io/component":  "cloudflared",
+		"app.kubernetes.io/part-of":    "cloudflare-tunnel-ingress-controller",
+	}
 }
 
+// cloudflaredWorkloadSelectorLabels select the cloudflared pods of the workload of the mode only.
+func cloudflaredWorkloadSelectorLabels(mode string) map[string]string {
+	workload := "deployment"
+	if mode == CloudflaredModeDaemonSet {
+		workload = "daemonset"
+	}
+	return labels.Merge(cloudflaredSelectorLabels(), map[string]string{cloudflaredWorkloadLabel: workload})
+}
+
+// EnsureCloudflaredDeploymentExists keeps cloudflared running as configured, as a Deployment or a DaemonSet, along
+// with the objects accompanying it.
 func (c *IngressController) EnsureCloudflaredDeploymentExists(ctx context.Context, logger logr.Logger) error {
+	_, err := c.ensureCloudflared(ctx, logger)
+	return err
+}
+
+// ensureCloudflared brings the objects making up cloudflared in line with the configuration. It reports whether the
+// workload, the token Secret or the PodDisruptionBudget had to be created or updated although they were ensured with
+// the same token before, i.e. whether changes made outside of the controller were reverted.
+func (c *IngressController) ensureCloudflared(ctx context.Context, logger logr.Logger) (bool, error) {
 	logger.Info("Ensuring Cloudflared Deployment exists")
 
+	c.cloudflaredDeploymentConfig.ensureLck.Lock()
+	defer c.cloudflaredDeploymentConfig.ensureLck.Unlock()
+
+	writes := c.cloudflaredDeploymentConfig.writes
+
+	tokenChecksum, err := c.ensureTunnelTokenSecret(ctx, logger)
+	if err != nil {
+		return false, err
+	}
+
+	if c.cloudflaredDeploymentConfig.workload.Mode == CloudflaredModeDaemonSet {
+		err = c.ensureCloudflaredDaemonSet(ctx, logger, tokenChecksum)
+	} else {
+		err = c.ensureCloudflaredDeployment(ctx, logger, tokenChecksum)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err = c.ensureCloudflaredDependents(ctx, logger); err != nil {
+		return false, err
+	}
+
+	// The configuration only changes with a restart, apart from the token
+	reverted := tokenChecksum == c.cloudflaredDeploymentConfig.ensuredTokenChecksum && c.cloudflaredDeploymentConfig.writes != writes
+	c.cloudflaredDeploymentConfig.ensuredTokenChecksum = tokenChecksum
+	return reverted, nil
+}
+
+// ensureCloudflaredDeployment creates or updates the cloudflared Deployment, then removes the DaemonSet of the
+// other mode once the Deployment has a ready connector.
+func (c *IngressController) ensureCloudflaredDeployment(ctx context.Context, logger logr.Logger, tokenChecksum string) error {
 	foundDeployment := &appsv1.Deployment{}
 	ns := namespace()
 
@@ -35,126 +153,240 @@ func (c *IngressController) EnsureCloudflaredDeploymentExists(ctx context.Contex
 	if err != nil && apierrors.IsNotFound(err) {
 		logger.Info("Creating a new Cloudflared Deployment resource")
 
-		err = c.createAndDeployCloudflaredDeployment(ctx, logger)
+		err = c.createAndDeployCloudflaredDeployment(ctx, logger, tokenChecksum)
 		if err != nil {
 			logger.Error(err, "Failed to create a new Cloudflared Deployment resource")
 			return err
 		}
 
-		return nil
+		return c.removeCloudflaredDaemonSet(ctx, logger, false)
 	} else if err != nil {
 		logger.Error(err, "Failed to get Cloudflared Deployment resource")
 		return err
 	}
 
-	err = c.updateCloudflaredDeploymentIfNeeded(ctx, logger, foundDeployment)
+	err = c.updateCloudflaredDeploymentIfNeeded(ctx, logger, foundDeployment, tokenChecksum)
 	if err != nil {
 		logger.Error(err, "Failed to update Cloudflared Deployment resource")
 		return err
 	}
 
-	return err
+	return c.removeCloudflaredDaemonSet(ctx, logger, foundDeployment.Status.ReadyReplicas > 0)
+}
+
+// ensureCloudflaredDependents keeps the objects accompanying the cloudflared Deployment.
+func (c *IngressController) ensureCloudflaredDependents(ctx context.Context, logger logr.Logger) error {
+	err := c.ensureCloudflaredDisruptionAndScaling(ctx, logger)
+	if err != nil {
+		return err
+	}
+	return c.ensureCloudflaredMetrics(ctx, logger)
 }
 
-func (c *IngressController) createAndDeployCloudflaredDeployment(ctx context.Context, logger logr.Logger) error {
+func (c *IngressController) createAndDeployCloudflaredDeployment(ctx context.Context, logger logr.Logger, tokenChecksum string) error {
 	logger.Info("Creating Cloudflared Deployment resource")
 
-	deployment, err := c.newCloudflaredDeployment()
+	deployment, err := c.newCloudflaredDeployment(tokenChecksum)
 	if err != nil {
 		logger.Error(err, "Failed to create Cloudflared Deployment resource")
 		return err
 	}
+	if deployment.Spec.Replicas == nil {
+		// Autoscaled, starting from the lower bound
+		deployment.Spec.Replicas = ptr.To(max(c.cloudflaredDeploymentConfig.workload.Autoscaling.MinReplicas, 1))
+	}
 
 	err = c.client.Create(ctx, deployment)
 	if err != nil {
 		logger.Error(err, "Failed to create Cloudflared Deployment resource")
 		return err
 	}
+	c.cloudflaredDeploymentConfig.writes++
 
 	logger.Info("Created Cloudflared Deployment resource")
 
 	return nil
 }
 
-func (c *IngressController) newCloudflaredDeployment() (*appsv1.Deployment, error) {
-	replicas := int32(1)
-	ns := namespace()
-
-	c.cloudflaredDeploymentConfig.tunnelTokenLck.RLock()
-	tunnelToken := c.cloudflaredDeploymentConfig.tunnelToken
-	c.cloudflaredDeploymentConfig.tunnelTokenLck.RUnlock()
-
-	_, cloudflaredVersion, _ := strings.Cut(c.cloudflaredDeploymentConfig.cloudflaredImage, ":")
-	if cloudflaredVersion == "" || cloudflaredVersion == "latest" {
-		return nil, errors.New("cloudflared image version is required, latest is not allowed")
-	}
+// newCloudflaredDeployment returns the cloudflared Deployment reading the tunnel token from its Secret, rolled
+// whenever the checksum of the token changes.
+func (c *IngressController) newCloudflaredDeployment(tokenChecksum string) (*appsv1.Deployment, error) {
+	workload := c.cloudflaredDeploymentConfig.workload
 
-	additionalLabels := map[string]string{
-		"app.kubernetes.io/version": cloudflaredVersion,
+	// Left to the HorizontalPodAutoscaler when autoscaling
+	var replicas *int32
+	if !workload.Autoscaling.Enabled {
+		replicas = ptr.To(max(workload.Replicas, 1))
 	}
+	maxUnavailable := intstr.FromInt32(0)
 
-	selectorLabels := map[string]string{
-		"app.kubernetes.io/name":       appName,
-		"app.kubernetes.io/managed-by": "cloudflare-tunnel-ingress-controller",
-		"app.kubernetes.io/component":  "cloudflared",
-		"app.kubernetes.io/part-of":    "cloudflare-tunnel-ingress-controller",
+	template, err := c.newCloudflaredPodTemplate(tokenChecksum)
+	if err != nil {
+		return nil, err
 	}
 
-	labels := labels.Merge(selectorLabels, additionalLabels)
-
 	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      appName,
-			Namespace: ns,
-			Labels:    labels,
+			Name:        appName,
+			Namespace:   namespace(),
+			Labels:      template.Labels,
+			Annotations: maps.Clone(workload.Annotations),
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: &replicas,
+			Replicas: replicas,
+			// The selector of the Deployments of the previous versions, which cannot be changed. It selects the pods of
+			// the DaemonSet as well, but the ReplicaSets of the Deployment only select their own pod-template-hash
 			Selector: &metav1.LabelSelector{
-				MatchLabels: selectorLabels,
+				MatchLabels: cloudflaredSelectorLabels(),
 			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Name:   appName,
-					Labels: labels,
+			// Start a new pod before stopping an old one, so the tunnel keeps a connector while rolling
+			Strategy: appsv1.DeploymentStrategy{
+				Type: appsv1.RollingUpdateDeploymentStrategyType,
+				RollingUpdate: &appsv1.RollingUpdateDeployment{
+					MaxUnavailable: &maxUnavailable,
+					MaxSurge:       workload.Upgrade.maxSurge(),
 				},
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
+			},
+			Template: template,
+		},
+	}
+
+	if err = setSpecChecksum(&deployment.ObjectMeta, deployment.Spec); err != nil {
+		return nil, err
+	}
+
+	return deployment, nil
+}
+
+// newCloudflaredPodTemplate returns the cloudflared pods, the same in the Deployment and the DaemonSet modes.
+func (c *IngressController) newCloudflaredPodTemplate(tokenChecksum string) (corev1.PodTemplateSpec, error) {
+	workload := c.cloudflaredDeploymentConfig.workload
+
+	metricsPort := workload.MetricsPort
+	if metricsPort == 0 {
+		metricsPort = DefaultCloudflaredMetricsPort
+	}
+	cloudflaredReadyHandler := corev1.ProbeHandler{
+		HTTPGet: &corev1.HTTPGetAction{
+			Path: "/ready",
+			Port: intstr.FromString(cloudflaredMetricsPortName),
+		},
+	}
+
+	// The version is also matched with the one of the connectors when upgrading, so an image by digest only is rejected
+	cloudflaredVersion := imageTag(c.cloudflaredDeploymentConfig.cloudflaredImage)
+	if cloudflaredVersion == "" || cloudflaredVersion == "latest" {
+		return corev1.PodTemplateSpec{}, errors.New("cloudflared image version is required, latest is not allowed")
+	}
+
+	additionalLabels := map[string]string{
+		cloudflaredVersionLabel: cloudflaredVersion,
+	}
+
+	labels := labels.Merge(workload.Labels, labels.Merge(cloudflaredWorkloadSelectorLabels(workload.Mode), additionalLabels))
+
+	podAnnotations := map[string]string{}
+	maps.Copy(podAnnotations, workload.Annotations)
+	podAnnotations[tunnelTokenChecksumAnnotation] = tokenChecksum
+
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        appName,
+			Labels:      labels,
+			Annotations: podAnnotations,
+		},
+		Spec: corev1.PodSpec{
+			NodeSelector:              workload.NodeSelector,
+			Tolerations:               workload.Tolerations,
+			Affinity:                  workload.Affinity,
+			TopologySpreadConstraints: workload.TopologySpreadConstraints,
+			PriorityClassName:         workload.PriorityClassName,
+			SecurityContext:           workload.PodSecurityContext,
+			Containers: []corev1.Container{
+				{
+					Name:            appName,
+					Image:           c.cloudflaredDeploymentConfig.cloudflaredImage,
+					ImagePullPolicy: corev1.PullPolicy(c.cloudflaredDeploymentConfig.cloudflaredImagePullPolicy),
+					Resources:       workload.Resources,
+					SecurityContext: workload.SecurityContext,
+					Command: []string{
+						"cloudflared",
+						"--no-autoupdate",
+						"tunnel",
+						"--metrics",
+						fmt.Sprintf("0.0.0.0:%d", metricsPort),
+						"run",
+					},
+					Ports: []corev1.ContainerPort{
+						{
+							Name:          cloudflaredMetricsPortName,
+							ContainerPort: metricsPort,
+							Protocol:      corev1.ProtocolTCP,
+						},
+					},
+					// /ready answers 200 while cloudflared has a connection to the Cloudflare edge
+					ReadinessProbe: &corev1.Probe{
+						ProbeHandler:     cloudflaredReadyHandler,
+						PeriodSeconds:    5,
+						FailureThreshold: 2,
+					},
+					// Restarts a connector that could not reconnect for a minute
+					LivenessProbe: &corev1.Probe{
+						ProbeHandler:        cloudflaredReadyHandler,
+						InitialDelaySeconds: 10,
+						PeriodSeconds:       10,
+						FailureThreshold:    6,
+					},
+					Env: []corev1.EnvVar{
 						{
-							Name:            appName,
-							Image:           c.cloudflaredDeploymentConfig.cloudflaredImage,
-							ImagePullPolicy: corev1.PullPolicy(c.cloudflaredDeploymentConfig.cloudflaredImagePullPolicy),
-							Command: []string{
-								"cloudflared",
-								"--no-autoupdate",
-								"tunnel",
-								"--metrics",
-								"0.0.0.0:9090",
-								"run",
-								"--token",
-								tunnelToken,
+							Name: "TUNNEL_TOKEN",
+							ValueFrom: &corev1.EnvVarSource{
+								SecretKeyRef: &corev1.SecretKeySelector{
+									LocalObjectReference: corev1.LocalObjectReference{Name: tunnelTokenSecretName},
+									Key:                  tunnelTokenSecretKey,
+								},
 							},
 						},
 					},
-					RestartPolicy: corev1.RestartPolicyAlways,
 				},
 			},
+			RestartPolicy: corev1.RestartPolicyAlways,
 		},
-	}
+	}, nil
+}
 
-	return deployment, nil
+// setSpecChecksum records the checksum of the labels, annotations and spec of a desired workload in its annotations.
+func setSpecChecksum(meta *metav1.ObjectMeta, spec any) error {
+	data, err := json.Marshal(struct {
+		Labels      map[string]string `json:"labels"`
+		Annotations map[string]string `json:"annotations"`
+		Spec        any               `json:"spec"`
+	}{meta.Labels, meta.Annotations, spec})
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[specChecksumAnnotation] = hex.EncodeToString(sum[:])
+	return nil
 }
 
-func (c *IngressController) updateCloudflaredDeploymentIfNeeded(ctx context.Context, logger logr.Logger, foundDeployment *appsv1.Deployment) error {
+func (c *IngressController) updateCloudflaredDeploymentIfNeeded(ctx context.Context, logger logr.Logger, foundDeployment *appsv1.Deployment, tokenChecksum string) error {
 	ns := namespace()
 
-	desired, err := c.newCloudflaredDeployment()
+	desired, err := c.newCloudflaredDeployment(tokenChecksum)
 	if err != nil {
 		logger.Error(err, "Failed to create new Deployment resource", "Deployment.Namespace", ns, "Deployment.Name", appName)
 		return err
 	}
 
-	needsUpdate := false
+	needsUpdate, err := c.gateCloudflaredUpgrade(logger, desired, foundDeployment)
+	if err != nil {
+		logger.Error(err, "Failed to gate the cloudflared upgrade")
+		return err
+	}
 
 	if !equality.Semantic.DeepDerivative(desired.Labels, foundDeployment.Labels) {
 		logger.V(1).Info("Found difference in the Deployment labels according to configuration", "currentDeployment", foundDeployment.Labels, "newDeployment", desired.Labels)
@@ -167,18 +399,30 @@ func (c *IngressController) updateCloudflaredDeploymentIfNeeded(ctx context.Cont
 		needsUpdate = true
 	}
 
-	if !equality.Semantic.DeepEqual(desired.Spec, foundDeployment.Spec) {
+	// The found spec has the defaults filled in by the API server, only the fields set by the controller are compared
+	if !equality.Semantic.DeepDerivative(desired.Spec, foundDeployment.Spec) {
 		logger.V(1).Info("Found difference in the Deployment spec according to configuration", "currentDeployment", foundDeployment.Spec, "newDeployment", desired.Spec)
 		needsUpdate = true
 	}
 
+	// Fields removed from the configuration are only noticed by the checksum of the desired state
+	if desired.Annotations[specChecksumAnnotation] != foundDeployment.Annotations[specChecksumAnnotation] {
+		logger.V(1).Info("Found difference in the Deployment configuration", "currentChecksum", foundDeployment.Annotations[specChecksumAnnotation], "newChecksum", desired.Annotations[specChecksumAnnotation])
+		needsUpdate = true
+	}
+
 	if needsUpdate {
 		// Copy ResourceVersion from the existing object for optimistic concurrency
 		desired.ResourceVersion = foundDeployment.ResourceVersion
+		if desired.Spec.Replicas == nil {
+			// Keep the replicas set by the HorizontalPodAutoscaler
+			desired.Spec.Replicas = foundDeployment.Spec.Replicas
+		}
 		if err = c.client.Update(ctx, desired); err != nil {
 			logger.Error(err, "Failed to update Deployment", "Deployment.Namespace", ns, "Deployment.Name", appName)
 			return err
 		}
+		c.cloudflaredDeploymentConfig.writes++
 		logger.Info("Updated Deployment according to configuration", "Deployment.Namespace", ns, "Deployment.Name", appName)
 	}
 
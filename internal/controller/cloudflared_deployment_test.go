@@ -0,0 +1,328 @@
+package controller
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+	crfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newTestCloudflaredController(token string) *IngressController {
+	c := &IngressController{
+		clientset: fake.NewClientset(),
+		cloudflaredDeploymentConfig: cloudflaredDeploymentConfig{
+			cloudflaredImage:           "cloudflare/cloudflared:2026.6.0",
+			cloudflaredImagePullPolicy: "IfNotPresent",
+		},
+	}
+	c.SetTunnelToken(token)
+	return c
+}
+
+func TestNewCloudflaredDeployment_TokenFromSecret(t *testing.T) {
+	c := newTestCloudflaredController("secret-token")
+
+	deployment, err := c.newCloudflaredDeployment(tunnelTokenChecksum("secret-token"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	container := deployment.Spec.Template.Spec.Containers[0]
+	if slices.ContainsFunc(container.Command, func(arg string) bool { return strings.Contains(arg, "secret-token") }) || slices.Contains(container.Command, "--token") {
+		t.Errorf("expected no token on the command line, got %v", container.Command)
+	}
+	if len(container.Env) != 1 || container.Env[0].Name != "TUNNEL_TOKEN" || container.Env[0].ValueFrom == nil || container.Env[0].ValueFrom.SecretKeyRef == nil {
+		t.Fatalf("expected TUNNEL_TOKEN from the Secret, got %+v", container.Env)
+	}
+	if ref := container.Env[0].ValueFrom.SecretKeyRef; ref.Name != tunnelTokenSecretName || ref.Key != tunnelTokenSecretKey {
+		t.Errorf("unexpected Secret reference %+v", ref)
+	}
+	if deployment.Spec.Template.Annotations[tunnelTokenChecksumAnnotation] != tunnelTokenChecksum("secret-token") {
+		t.Error("expected the token checksum on the pod template")
+	}
+}
+
+func TestEnsureTunnelTokenSecret(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloudflaredController("")
+
+	if _, err := c.ensureTunnelTokenSecret(ctx, logr.Discard()); err == nil {
+		t.Error("expected an error without a token")
+	}
+
+	c.SetTunnelToken("first")
+	checksum, err := c.ensureTunnelTokenSecret(ctx, logr.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	secret, err := c.clientset.CoreV1().Secrets(namespace()).Get(ctx, tunnelTokenSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected the Secret to be created: %v", err)
+	}
+	if string(secret.Data[tunnelTokenSecretKey]) != "first" || secret.Labels["app.kubernetes.io/managed-by"] != "cloudflare-tunnel-ingress-controller" {
+		t.Errorf("unexpected Secret %+v", secret)
+	}
+
+	c.SetTunnelToken("second")
+	rotated, err := c.ensureTunnelTokenSecret(ctx, logr.Discard())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rotated == checksum {
+		t.Error("expected the checksum to change with the token")
+	}
+	secret, _ = c.clientset.CoreV1().Secrets(namespace()).Get(ctx, tunnelTokenSecretName, metav1.GetOptions{})
+	if string(secret.Data[tunnelTokenSecretKey]) != "second" {
+		t.Errorf("expected the Secret to be updated, got %q", secret.Data[tunnelTokenSecretKey])
+	}
+}
+
+func TestNewCloudflaredDeployment_Workload(t *testing.T) {
+	c := newTestCloudflaredController("token")
+	c.cloudflaredDeploymentConfig.workload = CloudflaredWorkloadConfig{
+		Replicas: 3,
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("50m")},
+		},
+		NodeSelector:      map[string]string{"node-role.kubernetes.io/edge": ""},
+		Tolerations:       []corev1.Toleration{{Key: "edge", Operator: corev1.TolerationOpExists}},
+		PriorityClassName: "system-cluster-critical",
+		Labels:            map[string]string{"team": "network", "app.kubernetes.io/name": "other"},
+		Annotations:       map[string]string{"example.com/owner": "network", tunnelTokenChecksumAnnotation: "other"},
+	}
+
+	deployment, err := c.newCloudflaredDeployment(tunnelTokenChecksum("token"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	spec := deployment.Spec.Template.Spec
+	if *deployment.Spec.Replicas != 3 {
+		t.Errorf("expected 3 replicas, got %d", *deployment.Spec.Replicas)
+	}
+	if !spec.Containers[0].Resources.Requests.Cpu().Equal(resource.MustParse("50m")) {
+		t.Errorf("unexpected resources %+v", spec.Containers[0].Resources)
+	}
+	if len(spec.NodeSelector) != 1 || len(spec.Tolerations) != 1 || spec.PriorityClassName != "system-cluster-critical" {
+		t.Errorf("unexpected scheduling settings %+v", spec)
+	}
+	template := deployment.Spec.Template
+	if template.Labels["team"] != "network" || template.Labels["app.kubernetes.io/name"] != appName || deployment.Labels["team"] != "network" {
+		t.Errorf("expected extra labels next to the controller ones, got %v", template.Labels)
+	}
+	if template.Annotations["example.com/owner"] != "network" || template.Annotations[tunnelTokenChecksumAnnotation] != tunnelTokenChecksum("token") {
+		t.Errorf("expected extra annotations next to the controller ones, got %v", template.Annotations)
+	}
+}
+
+func TestUpdateCloudflaredDeploymentIfNeeded(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloudflaredController("token")
+	c.client = crfake.NewClientBuilder().Build()
+	c.cloudflaredDeploymentConfig.workload.NodeSelector = map[string]string{"edge": "true"}
+
+	if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	get := func() *appsv1.Deployment {
+		t.Helper()
+		deployment := &appsv1.Deployment{}
+		if err := c.client.Get(ctx, types.NamespacedName{Name: appName, Namespace: namespace()}, deployment); err != nil {
+			t.Fatalf("failed to get Deployment: %v", err)
+		}
+		return deployment
+	}
+	created := get()
+
+	// unchanged configuration
+	if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if get().ResourceVersion != created.ResourceVersion {
+		t.Error("expected the Deployment not to be updated without changes")
+	}
+
+	// removed setting
+	c.cloudflaredDeploymentConfig.workload.NodeSelector = nil
+	c.cloudflaredDeploymentConfig.workload.Replicas = 2
+	if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	updated := get()
+	if len(updated.Spec.Template.Spec.NodeSelector) != 0 || *updated.Spec.Replicas != 2 {
+		t.Errorf("expected the Deployment to follow the configuration, got %+v", updated.Spec)
+	}
+
+	// manual edit
+	updated.Spec.Template.Spec.Containers[0].Image = "cloudflare/cloudflared:2020.1.0"
+	if err := c.client.Update(ctx, updated); err != nil {
+		t.Fatalf("failed to update Deployment: %v", err)
+	}
+	if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if get().Spec.Template.Spec.Containers[0].Image != c.cloudflaredDeploymentConfig.cloudflaredImage {
+		t.Error("expected the manual edit to be reverted")
+	}
+}
+
+func TestEnsureCloudflaredDisruptionAndScaling(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloudflaredController("token")
+	c.client = crfake.NewClientBuilder().Build()
+	c.cloudflaredDeploymentConfig.workload.Replicas = 3
+	c.cloudflaredDeploymentConfig.workload.PodDisruptionBudget.Enabled = true
+
+	if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pdb, err := c.clientset.PolicyV1().PodDisruptionBudgets(namespace()).Get(ctx, appName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected a PodDisruptionBudget: %v", err)
+	}
+	if pdb.Spec.MaxUnavailable == nil || pdb.Spec.MaxUnavailable.IntValue() != 1 || pdb.Spec.Selector.MatchLabels["app.kubernetes.io/name"] != appName {
+		t.Errorf("unexpected PodDisruptionBudget %+v", pdb.Spec)
+	}
+
+	// autoscaled by the HorizontalPodAutoscaler
+	c.cloudflaredDeploymentConfig.workload.Autoscaling = CloudflaredAutoscalingConfig{Enabled: true, MinReplicas: 2, MaxReplicas: 5}
+	if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hpa, err := c.clientset.AutoscalingV2().HorizontalPodAutoscalers(namespace()).Get(ctx, appName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected a HorizontalPodAutoscaler: %v", err)
+	}
+	if *hpa.Spec.MinReplicas != 2 || hpa.Spec.MaxReplicas != 5 || len(hpa.Spec.Metrics) != 1 || *hpa.Spec.Metrics[0].Resource.Target.AverageUtilization != defaultTargetCPUUtilization {
+		t.Errorf("unexpected HorizontalPodAutoscaler %+v", hpa.Spec)
+	}
+
+	deployment := &appsv1.Deployment{}
+	key := types.NamespacedName{Name: appName, Namespace: namespace()}
+	if err := c.client.Get(ctx, key, deployment); err != nil {
+		t.Fatalf("failed to get Deployment: %v", err)
+	}
+	deployment.Spec.Replicas = ptr.To(int32(4))
+	if err := c.client.Update(ctx, deployment); err != nil {
+		t.Fatalf("failed to scale Deployment: %v", err)
+	}
+	c.cloudflaredDeploymentConfig.workload.PriorityClassName = "system-cluster-critical"
+	if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := c.client.Get(ctx, key, deployment); err != nil {
+		t.Fatalf("failed to get Deployment: %v", err)
+	}
+	if *deployment.Spec.Replicas != 4 || deployment.Spec.Template.Spec.PriorityClassName != "system-cluster-critical" {
+		t.Errorf("expected the scaled replicas to be kept while updating, got %d", *deployment.Spec.Replicas)
+	}
+
+	// disabled
+	c.cloudflaredDeploymentConfig.workload.PodDisruptionBudget.Enabled = false
+	c.cloudflaredDeploymentConfig.workload.Autoscaling.Enabled = false
+	if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := c.clientset.PolicyV1().PodDisruptionBudgets(namespace()).Get(ctx, appName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the PodDisruptionBudget to be deleted, got %v", err)
+	}
+	if _, err := c.clientset.AutoscalingV2().HorizontalPodAutoscalers(namespace()).Get(ctx, appName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the HorizontalPodAutoscaler to be deleted, got %v", err)
+	}
+	if err := c.client.Get(ctx, key, deployment); err != nil {
+		t.Fatalf("failed to get Deployment: %v", err)
+	}
+	if *deployment.Spec.Replicas != 3 {
+		t.Errorf("expected the configured replicas again, got %d", *deployment.Spec.Replicas)
+	}
+}
+
+func TestNewCloudflaredDeployment_Probes(t *testing.T) {
+	c := newTestCloudflaredController("token")
+	c.cloudflaredDeploymentConfig.workload.MetricsPort = 2000
+
+	deployment, err := c.newCloudflaredDeployment(tunnelTokenChecksum("token"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	container := deployment.Spec.Template.Spec.Containers[0]
+	if !slices.Contains(container.Command, "0.0.0.0:2000") {
+		t.Errorf("expected metrics to be served on port 2000, got %v", container.Command)
+	}
+	if len(container.Ports) != 1 || container.Ports[0].Name != cloudflaredMetricsPortName || container.Ports[0].ContainerPort != 2000 {
+		t.Errorf("expected the named metrics port, got %+v", container.Ports)
+	}
+	for name, probe := range map[string]*corev1.Probe{"readiness": container.ReadinessProbe, "liveness": container.LivenessProbe} {
+		if probe == nil || probe.HTTPGet == nil || probe.HTTPGet.Path != "/ready" || probe.HTTPGet.Port.StrVal != cloudflaredMetricsPortName {
+			t.Errorf("expected the %s probe on /ready, got %+v", name, probe)
+		}
+	}
+}
+
+func TestEnsureCloudflaredMetrics(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCloudflaredController("token")
+	c.client = crfake.NewClientBuilder().Build()
+
+	// without the Prometheus Operator
+	if err := c.ensureCloudflaredMetrics(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	service, err := c.clientset.CoreV1().Services(namespace()).Get(ctx, cloudflaredMetricsServiceName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected a metrics Service: %v", err)
+	}
+	if service.Spec.ClusterIP != corev1.ClusterIPNone || service.Spec.Ports[0].Port != DefaultCloudflaredMetricsPort || service.Spec.Ports[0].TargetPort.StrVal != cloudflaredMetricsPortName {
+		t.Errorf("unexpected metrics Service %+v", service.Spec)
+	}
+
+	c.clientset.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{{
+		GroupVersion: monitoringGroupVersion.String(),
+		APIResources: []metav1.APIResource{
+			{Name: "servicemonitors", Kind: MetricsMonitorServiceMonitor, Namespaced: true},
+			{Name: "podmonitors", Kind: MetricsMonitorPodMonitor, Namespaced: true},
+		},
+	}}
+	getMonitor := func(kind string) error {
+		monitor := &unstructured.Unstructured{}
+		monitor.SetGroupVersionKind(monitoringGroupVersion.WithKind(kind))
+		return c.client.Get(ctx, types.NamespacedName{Name: appName, Namespace: namespace()}, monitor)
+	}
+
+	c.cloudflaredDeploymentConfig.workload.MetricsPort = 2000
+	c.cloudflaredDeploymentConfig.workload.Metrics.MonitorLabels = map[string]string{"release": "prometheus"}
+	if err := c.ensureCloudflaredMetrics(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := getMonitor(MetricsMonitorServiceMonitor); err != nil {
+		t.Errorf("expected a ServiceMonitor: %v", err)
+	}
+	if service, _ = c.clientset.CoreV1().Services(namespace()).Get(ctx, cloudflaredMetricsServiceName, metav1.GetOptions{}); service.Spec.Ports[0].Port != 2000 {
+		t.Errorf("expected the Service port to follow the metrics port, got %d", service.Spec.Ports[0].Port)
+	}
+
+	c.cloudflaredDeploymentConfig.workload.Metrics.Monitor = MetricsMonitorPodMonitor
+	if err := c.ensureCloudflaredMetrics(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := getMonitor(MetricsMonitorPodMonitor); err != nil {
+		t.Errorf("expected a PodMonitor: %v", err)
+	}
+	if err := getMonitor(MetricsMonitorServiceMonitor); !apierrors.IsNotFound(err) {
+		t.Errorf("expected the ServiceMonitor to be deleted, got %v", err)
+	}
+}
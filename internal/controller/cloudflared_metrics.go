@@ -0,0 +1,262 @@
+package controller
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const cloudflaredMetricsServiceName = appName + "-metrics"
+
+// Kinds of the Prometheus Operator monitors scraping cloudflared
+const MetricsMonitorServiceMonitor = "ServiceMonitor"
+const MetricsMonitorPodMonitor = "PodMonitor"
+const MetricsMonitorNone = "None"
+
+var monitoringGroupVersion = schema.GroupVersion{Group: "monitoring.coreos.com", Version: "v1"}
+
+type CloudflaredMetricsConfig struct {
+	// Monitor is the kind of the Prometheus Operator object scraping cloudflared, MetricsMonitorServiceMonitor when
+	// empty. It is only created when the Prometheus Operator is installed.
+	Monitor string
+	// MonitorLabels are added to the monitor, to match the selector of the Prometheus instance
+	MonitorLabels map[string]string
+	// MonitorInterval between scrapes, the Prometheus default when empty
+	MonitorInterval string
+}
+
+// ensureCloudflaredMetrics exposes the metrics port of the cloudflared pods through a headless Service, and has them
+// scraped by the Prometheus Operator when it is installed.
+func (c *IngressController) ensureCloudflaredMetrics(ctx context.Context, logger logr.Logger) error {
+	config := c.cloudflaredDeploymentConfig.workload.Metrics
+
+	if err := c.ensureCloudflaredMetricsService(ctx, logger); err != nil {
+		return err
+	}
+
+	available, err := c.availableMonitorKinds()
+	if err != nil {
+		logger.Error(err, "Failed to discover the Prometheus Operator resources")
+		return err
+	}
+
+	monitor := config.Monitor
+	if monitor == "" {
+		monitor = MetricsMonitorServiceMonitor
+	}
+
+	for _, kind := range []string{MetricsMonitorServiceMonitor, MetricsMonitorPodMonitor} {
+		if !available[kind] {
+			continue
+		}
+		if kind == monitor {
+			err = c.ensureCloudflaredMonitor(ctx, logger, newCloudflaredMonitor(kind, config))
+		} else {
+			err = c.deleteCloudflaredMonitor(ctx, logger, kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *IngressController) ensureCloudflaredMetricsService(ctx context.Context, logger logr.Logger) error {
+	services := c.clientset.CoreV1().Services(namespace())
+	desired := c.newCloudflaredMetricsService()
+
+	found, err := services.Get(ctx, cloudflaredMetricsServiceName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		logger.Info("Creating cloudflared metrics Service")
+		_, err = services.Create(ctx, desired, metav1.CreateOptions{})
+		if err != nil {
+			logger.Error(err, "Failed to create cloudflared metrics Service")
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		logger.Error(err, "Failed to get cloudflared metrics Service")
+		return err
+	}
+
+	if !equality.Semantic.DeepDerivative(desired.Spec, found.Spec) || !equality.Semantic.DeepDerivative(desired.Labels, found.Labels) {
+		logger.Info("Updating cloudflared metrics Service")
+		found = found.DeepCopy()
+		found.Labels = desired.Labels
+		found.Spec.Selector = desired.Spec.Selector
+		found.Spec.Ports = desired.Spec.Ports
+		_, err = services.Update(ctx, found, metav1.UpdateOptions{})
+		if err != nil {
+			logger.Error(err, "Failed to update cloudflared metrics Service")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *IngressController) newCloudflaredMetricsService() *corev1.Service {
+	metricsPort := c.cloudflaredDeploymentConfig.workload.MetricsPort
+	if metricsPort == 0 {
+		metricsPort = DefaultCloudflaredMetricsPort
+	}
+
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      cloudflaredMetricsServiceName,
+			Namespace: namespace(),
+			Labels:    cloudflaredSelectorLabels(),
+		},
+		Spec: corev1.ServiceSpec{
+			// Prometheus scrapes every pod, there is nothing to balance. The pods of both workloads are selected, so the
+			// connectors stay monitored while migrating between the modes
+			ClusterIP: corev1.ClusterIPNone,
+			Selector:  cloudflaredSelectorLabels(),
+			Ports: []corev1.ServicePort{
+				{
+					Name:       cloudflaredMetricsPortName,
+					Port:       metricsPort,
+					TargetPort: intstr.FromString(cloudflaredMetricsPortName),
+					Protocol:   corev1.ProtocolTCP,
+				},
+			},
+		},
+	}
+}
+
+// availableMonitorKinds returns the monitor kinds served by the cluster, none without the Prometheus Operator. It is
+// discovered every time, so installing the Prometheus Operator later is noticed.
+func (c *IngressController) availableMonitorKinds() (map[string]bool, error) {
+	resources, err := c.clientset.Discovery().ServerResourcesForGroupVersion(monitoringGroupVersion.String())
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	available := map[string]bool{}
+	for _, resource := range resources.APIResources {
+		if resource.Kind == MetricsMonitorServiceMonitor || resource.Kind == MetricsMonitorPodMonitor {
+			available[resource.Kind] = true
+		}
+	}
+	return available, nil
+}
+
+func newCloudflaredMonitor(kind string, config CloudflaredMetricsConfig) *unstructured.Unstructured {
+	endpoint := map[string]any{
+		"port": cloudflaredMetricsPortName,
+		"path": "/metrics",
+	}
+	if config.MonitorInterval != "" {
+		endpoint["interval"] = config.MonitorInterval
+	}
+
+	selectorLabels := map[string]any{}
+	for k, v := range cloudflaredSelectorLabels() {
+		selectorLabels[k] = v
+	}
+
+	spec := map[string]any{
+		"selector": map[string]any{
+			"matchLabels": selectorLabels,
+		},
+		"namespaceSelector": map[string]any{
+			"matchNames": []any{namespace()},
+		},
+	}
+	if kind == MetricsMonitorServiceMonitor {
+		spec["endpoints"] = []any{endpoint}
+	} else {
+		spec["podMetricsEndpoints"] = []any{endpoint}
+	}
+
+	monitor := &unstructured.Unstructured{Object: map[string]any{"spec": spec}}
+	monitor.SetGroupVersionKind(monitoringGroupVersion.WithKind(kind))
+	monitor.SetName(appName)
+	monitor.SetNamespace(namespace())
+	monitor.SetLabels(labels.Merge(config.MonitorLabels, cloudflaredSelectorLabels()))
+	return monitor
+}
+
+func (c *IngressController) ensureCloudflaredMonitor(ctx context.Context, logger logr.Logger, desired *unstructured.Unstructured) error {
+	kind := desired.GetKind()
+	logger = logger.WithValues("kind", kind)
+
+	found := &unstructured.Unstructured{}
+	found.SetGroupVersionKind(desired.GroupVersionKind())
+	err := c.client.Get(ctx, client.ObjectKeyFromObject(desired), found)
+	if apierrors.IsNotFound(err) {
+		logger.Info("Creating cloudflared monitor")
+		err = c.client.Create(ctx, desired)
+		if err != nil {
+			logger.Error(err, "Failed to create cloudflared monitor")
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		logger.Error(err, "Failed to get cloudflared monitor")
+		return err
+	}
+
+	if !equality.Semantic.DeepDerivative(desired.Object["spec"], found.Object["spec"]) || !equality.Semantic.DeepDerivative(desired.GetLabels(), found.GetLabels()) {
+		logger.Info("Updating cloudflared monitor")
+		desired.SetResourceVersion(found.GetResourceVersion())
+		err = c.client.Update(ctx, desired)
+		if err != nil {
+			logger.Error(err, "Failed to update cloudflared monitor")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteCloudflaredMonitor removes the monitor of the kind no longer configured, if created by the controller.
+func (c *IngressController) deleteCloudflaredMonitor(ctx context.Context, logger logr.Logger, kind string) error {
+	found := &unstructured.Unstructured{}
+	found.SetGroupVersionKind(monitoringGroupVersion.WithKind(kind))
+	err := c.client.Get(ctx, client.ObjectKey{Name: appName, Namespace: namespace()}, found)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		logger.Error(err, "Failed to get cloudflared monitor", "kind", kind)
+		return err
+	}
+	if !isManagedByController(found.GetLabels()) {
+		return nil
+	}
+
+	logger.Info("Deleting cloudflared monitor", "kind", kind)
+	err = c.client.Delete(ctx, found)
+	if err != nil && !apierrors.IsNotFound(err) {
+		logger.Error(err, "Failed to delete cloudflared monitor", "kind", kind)
+		return err
+	}
+	return nil
+}
+
+// ParseMetricsMonitor returns the monitor kind named case-insensitively, false if unknown.
+func ParseMetricsMonitor(name string) (string, bool) {
+	for _, kind := range []string{MetricsMonitorServiceMonitor, MetricsMonitorPodMonitor, MetricsMonitorNone} {
+		if strings.EqualFold(name, kind) {
+			return kind, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,221 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+)
+
+const defaultTargetCPUUtilization = 80
+
+type CloudflaredPodDisruptionBudgetConfig struct {
+	Enabled bool
+	// MinAvailable and MaxUnavailable are exclusive, one pod may be unavailable when neither is set
+	MinAvailable   *intstr.IntOrString
+	MaxUnavailable *intstr.IntOrString
+}
+
+type CloudflaredAutoscalingConfig struct {
+	Enabled     bool
+	MinReplicas int32
+	MaxReplicas int32
+	// TargetCPUUtilization is the average CPU utilization of the pods scaled to, used when no Metrics are set
+	TargetCPUUtilization int32
+	// Metrics replace the CPU utilization target, e.g. to scale on the requests per tunnel reported by cloudflared
+	Metrics []autoscalingv2.MetricSpec
+}
+
+// ensureCloudflaredDisruptionAndScaling keeps the PodDisruptionBudget and the HorizontalPodAutoscaler of the
+// cloudflared workload in line with the configuration, removing the disabled ones.
+func (c *IngressController) ensureCloudflaredDisruptionAndScaling(ctx context.Context, logger logr.Logger) error {
+	workload := c.cloudflaredDeploymentConfig.workload
+
+	pdb := workload.PodDisruptionBudget
+	autoscaling := workload.Autoscaling
+	if workload.Mode == CloudflaredModeDaemonSet {
+		// DaemonSets have no scale subresource, the disruption controller cannot evaluate a budget over their pods
+		// and the DaemonSet runs a pod per node, there is nothing to scale either
+		pdb.Enabled = false
+		autoscaling.Enabled = false
+	}
+
+	if err := c.ensureCloudflaredPodDisruptionBudget(ctx, logger, pdb); err != nil {
+		return err
+	}
+	return c.ensureCloudflaredHorizontalPodAutoscaler(ctx, logger, autoscaling)
+}
+
+func (c *IngressController) ensureCloudflaredPodDisruptionBudget(ctx context.Context, logger logr.Logger, config CloudflaredPodDisruptionBudgetConfig) error {
+	pdbs := c.clientset.PolicyV1().PodDisruptionBudgets(namespace())
+
+	found, err := pdbs.Get(ctx, appName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logger.Error(err, "Failed to get cloudflared PodDisruptionBudget")
+		return err
+	}
+	exists := err == nil
+
+	if !config.Enabled {
+		if exists && isManagedByController(found.Labels) {
+			logger.Info("Deleting cloudflared PodDisruptionBudget")
+			err = pdbs.Delete(ctx, appName, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				logger.Error(err, "Failed to delete cloudflared PodDisruptionBudget")
+				return err
+			}
+		}
+		return nil
+	}
+
+	desired := newCloudflaredPodDisruptionBudget(config)
+
+	if !exists {
+		logger.Info("Creating cloudflared PodDisruptionBudget")
+		_, err = pdbs.Create(ctx, desired, metav1.CreateOptions{})
+		if err != nil {
+			logger.Error(err, "Failed to create cloudflared PodDisruptionBudget")
+			return err
+		}
+		c.cloudflaredDeploymentConfig.writes++
+		return nil
+	}
+
+	if !equality.Semantic.DeepEqual(desired.Spec, found.Spec) || !equality.Semantic.DeepDerivative(desired.Labels, found.Labels) {
+		logger.Info("Updating cloudflared PodDisruptionBudget")
+		desired.ResourceVersion = found.ResourceVersion
+		_, err = pdbs.Update(ctx, desired, metav1.UpdateOptions{})
+		if err != nil {
+			logger.Error(err, "Failed to update cloudflared PodDisruptionBudget")
+			return err
+		}
+		c.cloudflaredDeploymentConfig.writes++
+	}
+
+	return nil
+}
+
+func newCloudflaredPodDisruptionBudget(config CloudflaredPodDisruptionBudgetConfig) *policyv1.PodDisruptionBudget {
+	spec := policyv1.PodDisruptionBudgetSpec{
+		MinAvailable:   config.MinAvailable,
+		MaxUnavailable: config.MaxUnavailable,
+		// Only used in the Deployment mode, the pods of a DaemonSet left from the other mode are not counted
+		Selector: &metav1.LabelSelector{
+			MatchLabels: cloudflaredWorkloadSelectorLabels(CloudflaredModeDeployment),
+		},
+	}
+	if spec.MinAvailable == nil && spec.MaxUnavailable == nil {
+		spec.MaxUnavailable = ptr.To(intstr.FromInt32(1))
+	}
+
+	return &policyv1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      appName,
+			Namespace: namespace(),
+			Labels:    cloudflaredSelectorLabels(),
+		},
+		Spec: spec,
+	}
+}
+
+func (c *IngressController) ensureCloudflaredHorizontalPodAutoscaler(ctx context.Context, logger logr.Logger, config CloudflaredAutoscalingConfig) error {
+	hpas := c.clientset.AutoscalingV2().HorizontalPodAutoscalers(namespace())
+
+	found, err := hpas.Get(ctx, appName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		logger.Error(err, "Failed to get cloudflared HorizontalPodAutoscaler")
+		return err
+	}
+	exists := err == nil
+
+	if !config.Enabled {
+		if exists && isManagedByController(found.Labels) {
+			logger.Info("Deleting cloudflared HorizontalPodAutoscaler")
+			err = hpas.Delete(ctx, appName, metav1.DeleteOptions{})
+			if err != nil && !apierrors.IsNotFound(err) {
+				logger.Error(err, "Failed to delete cloudflared HorizontalPodAutoscaler")
+				return err
+			}
+		}
+		return nil
+	}
+
+	desired := newCloudflaredHorizontalPodAutoscaler(config)
+
+	if !exists {
+		logger.Info("Creating cloudflared HorizontalPodAutoscaler")
+		_, err = hpas.Create(ctx, desired, metav1.CreateOptions{})
+		if err != nil {
+			logger.Error(err, "Failed to create cloudflared HorizontalPodAutoscaler")
+			return err
+		}
+		return nil
+	}
+
+	// The found spec has the scaling behavior defaulted by the API server
+	if !equality.Semantic.DeepDerivative(desired.Spec, found.Spec) || len(desired.Spec.Metrics) != len(found.Spec.Metrics) || !equality.Semantic.DeepDerivative(desired.Labels, found.Labels) {
+		logger.Info("Updating cloudflared HorizontalPodAutoscaler")
+		desired.ResourceVersion = found.ResourceVersion
+		_, err = hpas.Update(ctx, desired, metav1.UpdateOptions{})
+		if err != nil {
+			logger.Error(err, "Failed to update cloudflared HorizontalPodAutoscaler")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newCloudflaredHorizontalPodAutoscaler(config CloudflaredAutoscalingConfig) *autoscalingv2.HorizontalPodAutoscaler {
+	minReplicas := max(config.MinReplicas, 1)
+
+	metrics := config.Metrics
+	if len(metrics) == 0 {
+		target := config.TargetCPUUtilization
+		if target == 0 {
+			target = defaultTargetCPUUtilization
+		}
+		metrics = []autoscalingv2.MetricSpec{
+			{
+				Type: autoscalingv2.ResourceMetricSourceType,
+				Resource: &autoscalingv2.ResourceMetricSource{
+					Name: corev1.ResourceCPU,
+					Target: autoscalingv2.MetricTarget{
+						Type:               autoscalingv2.UtilizationMetricType,
+						AverageUtilization: &target,
+					},
+				},
+			},
+		}
+	}
+
+	return &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      appName,
+			Namespace: namespace(),
+			Labels:    cloudflaredSelectorLabels(),
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       appName,
+			},
+			MinReplicas: &minReplicas,
+			MaxReplicas: max(config.MaxReplicas, minReplicas),
+			Metrics:     metrics,
+		},
+	}
+}
+
+// isManagedByController tells whether an object was created by the controller, others are never deleted.
+func isManagedByController(objectLabels map[string]string) bool {
+	return objectLabels["app.kubernetes.io/managed-by"] == "cloudflare-tunnel-ingress-controller"
+}
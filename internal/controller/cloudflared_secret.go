@@ -0,0 +1,92 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const tunnelTokenSecretName = "cloudflare-tunnel-token"
+const tunnelTokenSecretKey = "token"
+
+// tunnelTokenChecksumAnnotation on the cloudflared pod template rolls the pods when the token changes, as the
+// environment of running containers is not updated from the Secret.
+const tunnelTokenChecksumAnnotation = "cloudflare-tunnel-ingress-controller.clbs.io/tunnel-token-checksum"
+
+// ensureTunnelTokenSecret keeps the tunnel token in the Secret read by cloudflared and returns the checksum of the
+// token.
+func (c *IngressController) ensureTunnelTokenSecret(ctx context.Context, logger logr.Logger) (string, error) {
+	c.cloudflaredDeploymentConfig.tunnelTokenLck.RLock()
+	tunnelToken := c.cloudflaredDeploymentConfig.tunnelToken
+	c.cloudflaredDeploymentConfig.tunnelTokenLck.RUnlock()
+
+	if tunnelToken == "" {
+		return "", errors.New("tunnel token is not known yet")
+	}
+
+	secrets := c.clientset.CoreV1().Secrets(namespace())
+	desired := newTunnelTokenSecret(tunnelToken)
+
+	found, err := secrets.Get(ctx, tunnelTokenSecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		logger.Info("Creating tunnel token Secret")
+		_, err = secrets.Create(ctx, desired, metav1.CreateOptions{})
+		if err != nil {
+			logger.Error(err, "Failed to create tunnel token Secret")
+			return "", err
+		}
+		c.cloudflaredDeploymentConfig.writes++
+		return tunnelTokenChecksum(tunnelToken), nil
+	}
+	if err != nil {
+		logger.Error(err, "Failed to get tunnel token Secret")
+		return "", err
+	}
+
+	if string(found.Data[tunnelTokenSecretKey]) != tunnelToken || !labels.SelectorFromSet(desired.Labels).Matches(labels.Set(found.Labels)) {
+		logger.Info("Updating tunnel token Secret")
+		found = found.DeepCopy()
+		found.Labels = labels.Merge(found.Labels, desired.Labels)
+		found.Data = desired.Data
+		_, err = secrets.Update(ctx, found, metav1.UpdateOptions{})
+		if err != nil {
+			logger.Error(err, "Failed to update tunnel token Secret")
+			return "", err
+		}
+		c.cloudflaredDeploymentConfig.writes++
+	}
+
+	return tunnelTokenChecksum(tunnelToken), nil
+}
+
+func (c *IngressController) hasTunnelToken() bool {
+	c.cloudflaredDeploymentConfig.tunnelTokenLck.RLock()
+	defer c.cloudflaredDeploymentConfig.tunnelTokenLck.RUnlock()
+	return c.cloudflaredDeploymentConfig.tunnelToken != ""
+}
+
+func newTunnelTokenSecret(tunnelToken string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      tunnelTokenSecretName,
+			Namespace: namespace(),
+			Labels:    cloudflaredSelectorLabels(),
+		},
+		Type: corev1.SecretTypeOpaque,
+		Data: map[string][]byte{
+			tunnelTokenSecretKey: []byte(tunnelToken),
+		},
+	}
+}
+
+func tunnelTokenChecksum(tunnelToken string) string {
+	sum := sha256.Sum256([]byte(tunnelToken))
+	return hex.EncodeToString(sum[:])
+}
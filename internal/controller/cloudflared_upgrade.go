@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+const DefaultCloudflaredUpgradeTimeout = 5 * time.Minute
+
+const cloudflaredUpgradeCheckInterval = 10 * time.Second
+
+const cloudflaredVersionLabel = "app.kubernetes.io/version"
+
+// Annotations of the cloudflared Deployment tracking a gated upgrade: the image upgraded from, when the upgrade
+// started, and the image rolled back from, which is not tried again until the configured image changes.
+const upgradeFromImageAnnotation = "cloudflare-tunnel-ingress-controller.clbs.io/upgrade-from-image"
+const upgradeStartedAtAnnotation = "cloudflare-tunnel-ingress-controller.clbs.io/upgrade-started-at"
+const upgradeFailedImageAnnotation = "cloudflare-tunnel-ingress-controller.clbs.io/upgrade-failed-image"
+
+type CloudflaredUpgradeConfig struct {
+	// MaxSurge is the number or percentage of new pods started before old ones are stopped while rolling, 1 when
+	// unset
+	MaxSurge *intstr.IntOrString
+	// Gated upgrades of the cloudflared image keep the old pods until the connectors of the new version show in the
+	// Cloudflare API, and roll back to the previous image when they do not within the Timeout. Only the Deployment
+	// mode is gated.
+	Gated bool
+	// Timeout of a gated upgrade, DefaultCloudflaredUpgradeTimeout when zero
+	Timeout time.Duration
+}
+
+func (config CloudflaredUpgradeConfig) maxSurge() *intstr.IntOrString {
+	if config.MaxSurge != nil {
+		return config.MaxSurge
+	}
+	maxSurge := intstr.FromInt32(1)
+	return &maxSurge
+}
+
+func (config CloudflaredUpgradeConfig) timeout() time.Duration {
+	if config.Timeout > 0 {
+		return config.Timeout
+	}
+	return DefaultCloudflaredUpgradeTimeout
+}
+
+// gateCloudflaredUpgrade adapts the desired Deployment to the gated upgrade of the found one. A new image starts an
+// upgrade: the new pods only count as available after the timeout, so the old pods are kept until the connectors
+// of the new version are seen by the cloudflaredUpgradeGate, or until it rolls back. It tells whether the found
+// Deployment must be updated even if the desired one looks the same.
+func (c *IngressController) gateCloudflaredUpgrade(logger logr.Logger, desired, found *appsv1.Deployment) (bool, error) {
+	upgrade := c.cloudflaredDeploymentConfig.workload.Upgrade
+	if !upgrade.Gated {
+		// Releases the pods of an upgrade gated before the gating was disabled
+		return found.Annotations[upgradeStartedAtAnnotation] != "", nil
+	}
+
+	foundImage := cloudflaredImage(found)
+	desiredImage := cloudflaredImage(desired)
+	fromImage := found.Annotations[upgradeFromImageAnnotation]
+	startedAt := found.Annotations[upgradeStartedAtAnnotation]
+
+	switch {
+	case found.Annotations[upgradeFailedImageAnnotation] == desiredImage && fromImage != "":
+		// Rolled back, the image is only tried again once the configuration changes
+		setCloudflaredImage(desired, fromImage)
+		delete(desired.Annotations, specChecksumAnnotation)
+		if err := setSpecChecksum(&desired.ObjectMeta, desired.Spec); err != nil {
+			return false, err
+		}
+		desired.Annotations[upgradeFromImageAnnotation] = fromImage
+		desired.Annotations[upgradeFailedImageAnnotation] = desiredImage
+		logger.V(1).Info("Keeping the cloudflared image rolled back to", "image", fromImage, "failedImage", desiredImage)
+
+	case startedAt != "" && desiredImage == foundImage:
+		// In progress
+		desired.Annotations[upgradeFromImageAnnotation] = fromImage
+		desired.Annotations[upgradeStartedAtAnnotation] = startedAt
+		desired.Spec.MinReadySeconds = found.Spec.MinReadySeconds
+
+	case startedAt != "" && desiredImage == fromImage:
+		logger.Info("Cloudflared upgrade cancelled by the configuration", "image", desiredImage)
+
+	case desiredImage != foundImage:
+		if startedAt == "" {
+			fromImage = foundImage
+		}
+		logger.Info("Gating the cloudflared upgrade on the new connectors", "fromImage", fromImage, "image", desiredImage, "timeout", upgrade.timeout())
+		desired.Annotations[upgradeFromImageAnnotation] = fromImage
+		desired.Annotations[upgradeStartedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		desired.Spec.MinReadySeconds = int32(upgrade.timeout().Seconds())
+	}
+
+	return false, nil
+}
+
+// cloudflaredUpgradeGate completes the gated upgrades of cloudflared: once every new pod has a connector of the new
+// version in the Cloudflare API, the new pods become available and the old ones are stopped. Otherwise the
+// Deployment is rolled back to the previous image after the timeout.
+type cloudflaredUpgradeGate struct {
+	logger     logr.Logger
+	controller *IngressController
+	now        func() time.Time
+}
+
+// Updating the Deployment is left to the leader
+var _ manager.LeaderElectionRunnable = (*cloudflaredUpgradeGate)(nil)
+
+func newCloudflaredUpgradeGate(logger logr.Logger, controller *IngressController) *cloudflaredUpgradeGate {
+	return &cloudflaredUpgradeGate{
+		logger:     logger,
+		controller: controller,
+		now:        time.Now,
+	}
+}
+
+func (g *cloudflaredUpgradeGate) NeedLeaderElection() bool {
+	return true
+}
+
+func (g *cloudflaredUpgradeGate) Start(ctx context.Context) error {
+	ticker := time.NewTicker(cloudflaredUpgradeCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if err := g.checkUpgrade(ctx); err != nil {
+			g.logger.Error(err, "Failed to check the cloudflared upgrade")
+		}
+	}
+}
+
+// checkUpgrade completes or rolls back the upgrade in progress, if any.
+func (g *cloudflaredUpgradeGate) checkUpgrade(ctx context.Context) error {
+	c := g.controller
+
+	found := &appsv1.Deployment{}
+	err := c.client.Get(ctx, types.NamespacedName{Name: appName, Namespace: namespace()}, found)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	startedAt, err := time.Parse(time.RFC3339, found.Annotations[upgradeStartedAtAnnotation])
+	if err != nil {
+		// No upgrade in progress
+		return nil
+	}
+
+	image := cloudflaredImage(found)
+	version := imageTag(image)
+	logger := g.logger.WithValues("image", image, "startedAt", startedAt)
+
+	connectors, err := c.tunnelClient.ListConnectors(ctx)
+	if err != nil {
+		logger.Error(err, "Failed to list the tunnel connectors")
+	}
+	registered := int32(0)
+	for _, connector := range connectors {
+		if connector.Version == version && connector.Active() {
+			registered++
+		}
+	}
+
+	if err == nil && registered >= max(found.Status.UpdatedReplicas, 1) {
+		return g.complete(ctx, logger, registered)
+	}
+	if g.now().Sub(startedAt) >= c.cloudflaredDeploymentConfig.workload.Upgrade.timeout() {
+		return g.rollback(ctx, logger, found.Annotations[upgradeFromImageAnnotation], registered)
+	}
+
+	logger.V(1).Info("Waiting for the connectors of the new cloudflared version", "registered", registered, "updatedReplicas", found.Status.UpdatedReplicas)
+	return err
+}
+
+// complete makes the new pods available right away, the Deployment then stops the old ones.
+func (g *cloudflaredUpgradeGate) complete(ctx context.Context, logger logr.Logger, registered int32) error {
+	deployment, err := g.updateDeployment(ctx, func(deployment *appsv1.Deployment) {
+		delete(deployment.Annotations, upgradeFromImageAnnotation)
+		delete(deployment.Annotations, upgradeStartedAtAnnotation)
+		delete(deployment.Annotations, upgradeFailedImageAnnotation)
+		deployment.Spec.MinReadySeconds = 0
+	})
+	if err != nil {
+		logger.Error(err, "Failed to complete the cloudflared upgrade")
+		return err
+	}
+
+	g.controller.recorder.Eventf(deployment, nil, corev1.EventTypeNormal, EventReasonCloudflaredUpgraded, "Upgrade", "%d connectors of %s registered with the tunnel, stopping the previous version", registered, cloudflaredImage(deployment))
+	logger.Info("Cloudflared upgrade completed", "registered", registered)
+	return nil
+}
+
+// rollback puts back the previous image along with making the pods available right away, so the pods of the
+// previous version, never stopped, are kept.
+func (g *cloudflaredUpgradeGate) rollback(ctx context.Context, logger logr.Logger, fromImage string, registered int32) error {
+	image := ""
+	deployment, err := g.updateDeployment(ctx, func(deployment *appsv1.Deployment) {
+		image = cloudflaredImage(deployment)
+		if fromImage != "" {
+			setCloudflaredImage(deployment, fromImage)
+			deployment.Annotations[upgradeFailedImageAnnotation] = image
+		}
+		delete(deployment.Annotations, upgradeStartedAtAnnotation)
+		deployment.Spec.MinReadySeconds = 0
+	})
+	if err != nil {
+		logger.Error(err, "Failed to roll back the cloudflared upgrade")
+		return err
+	}
+
+	g.controller.recorder.Eventf(deployment, nil, corev1.EventTypeWarning, EventReasonCloudflaredUpgradeRolledBack, "Upgrade", "Only %d connectors of %s registered with the tunnel within %s, rolled back to %s", registered, image, g.controller.cloudflaredDeploymentConfig.workload.Upgrade.timeout(), fromImage)
+	logger.Info("Cloudflared upgrade rolled back", "fromImage", fromImage, "registered", registered)
+	return nil
+}
+
+// updateDeployment applies the change to the current cloudflared Deployment, serialized with ensuring cloudflared.
+func (g *cloudflaredUpgradeGate) updateDeployment(ctx context.Context, change func(deployment *appsv1.Deployment)) (*appsv1.Deployment, error) {
+	c := g.controller
+	c.cloudflaredDeploymentConfig.ensureLck.Lock()
+	defer c.cloudflaredDeploymentConfig.ensureLck.Unlock()
+
+	deployment := &appsv1.Deployment{}
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		err := c.client.Get(ctx, types.NamespacedName{Name: appName, Namespace: namespace()}, deployment)
+		if err != nil {
+			return err
+		}
+		if deployment.Annotations == nil {
+			deployment.Annotations = map[string]string{}
+		}
+		change(deployment)
+		return c.client.Update(ctx, deployment)
+	})
+	return deployment, err
+}
+
+// cloudflaredImage returns the image of the cloudflared container.
+func cloudflaredImage(deployment *appsv1.Deployment) string {
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name == appName {
+			return container.Image
+		}
+	}
+	return ""
+}
+
+// imageTag returns the tag of the image reference, which is the cloudflared version, or an empty string for an image
+// referenced by digest only. The tag follows the last colon of the last path segment, a colon before it separates
+// the port of the registry.
+func imageTag(image string) string {
+	name, _, _ := strings.Cut(image, "@")
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// setCloudflaredImage replaces the image of the cloudflared container, along with the version labels.
+func setCloudflaredImage(deployment *appsv1.Deployment, image string) {
+	version := imageTag(image)
+	for i, container := range deployment.Spec.Template.Spec.Containers {
+		if container.Name == appName {
+			deployment.Spec.Template.Spec.Containers[i].Image = image
+		}
+	}
+	if deployment.Labels != nil {
+		deployment.Labels[cloudflaredVersionLabel] = version
+	}
+	if deployment.Spec.Template.Labels != nil {
+		deployment.Spec.Template.Labels[cloudflaredVersionLabel] = version
+	}
+}
@@ -0,0 +1,167 @@
+package controller
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel"
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel/fake"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/events"
+	crfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCloudflaredUpgradeGate(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	tunnelID := f.AddTunnel("test-tunnel", false)
+
+	tunnelClient := tunnel.NewClient(&tunnel.CloudflareAPI{
+		Tunnels:            f.Tunnels,
+		CloudflaredTunnels: f.CloudflaredTunnels,
+		TunnelTokens:       f.TunnelTokens,
+		TunnelConnections:  f.TunnelConnections,
+	}, "account", "test-tunnel", "owner", logr.Discard())
+	if err := tunnelClient.EnsureTunnelExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("failed to ensure tunnel exists: %v", err)
+	}
+
+	c := newTestCloudflaredController("token")
+	c.client = crfake.NewClientBuilder().Build()
+	c.tunnelClient = tunnelClient
+	recorder := events.NewFakeRecorder(10)
+	c.recorder = recorder
+	c.cloudflaredDeploymentConfig.workload.Upgrade = CloudflaredUpgradeConfig{Gated: true, Timeout: 5 * time.Minute}
+
+	g := newCloudflaredUpgradeGate(logr.Discard(), c)
+	deployment := &appsv1.Deployment{}
+	key := types.NamespacedName{Name: appName, Namespace: namespace()}
+
+	ensure := func(image string) {
+		t.Helper()
+		c.cloudflaredDeploymentConfig.cloudflaredImage = image
+		if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := c.client.Get(ctx, key, deployment); err != nil {
+			t.Fatalf("failed to get Deployment: %v", err)
+		}
+	}
+	check := func() {
+		t.Helper()
+		if err := g.checkUpgrade(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := c.client.Get(ctx, key, deployment); err != nil {
+			t.Fatalf("failed to get Deployment: %v", err)
+		}
+	}
+	nextEvent := func() string {
+		t.Helper()
+		select {
+		case e := <-recorder.Events:
+			return e
+		default:
+			return ""
+		}
+	}
+
+	ensure("cloudflare/cloudflared:2026.6.0")
+	if deployment.Spec.MinReadySeconds != 0 || deployment.Annotations[upgradeStartedAtAnnotation] != "" {
+		t.Fatal("expected the first rollout not to be gated")
+	}
+
+	// upgrade gated until the new connector registers
+	ensure("cloudflare/cloudflared:2026.7.0")
+	ensure("cloudflare/cloudflared:2026.7.0")
+	if deployment.Spec.MinReadySeconds != 300 || deployment.Annotations[upgradeFromImageAnnotation] != "cloudflare/cloudflared:2026.6.0" {
+		t.Fatalf("expected the upgrade to be gated, got minReadySeconds %d and annotations %v", deployment.Spec.MinReadySeconds, deployment.Annotations)
+	}
+	deployment.Status.UpdatedReplicas = 1
+	if err := c.client.Status().Update(ctx, deployment); err != nil {
+		t.Fatalf("failed to update Deployment status: %v", err)
+	}
+
+	f.AddConnector(tunnelID, "2026.6.0")
+	check()
+	if deployment.Spec.MinReadySeconds != 300 {
+		t.Fatal("expected the upgrade to wait for a connector of the new version")
+	}
+
+	f.AddConnector(tunnelID, "2026.7.0")
+	check()
+	if deployment.Spec.MinReadySeconds != 0 || deployment.Annotations[upgradeStartedAtAnnotation] != "" {
+		t.Fatalf("expected the upgrade to complete, got minReadySeconds %d and annotations %v", deployment.Spec.MinReadySeconds, deployment.Annotations)
+	}
+	if e := nextEvent(); !strings.Contains(e, EventReasonCloudflaredUpgraded) {
+		t.Errorf("expected an upgrade event, got %q", e)
+	}
+
+	// rolled back after the timeout
+	ensure("cloudflare/cloudflared:2026.8.0")
+	g.now = func() time.Time { return time.Now().Add(10 * time.Minute) }
+	check()
+	if image := cloudflaredImage(deployment); image != "cloudflare/cloudflared:2026.7.0" || deployment.Spec.MinReadySeconds != 0 {
+		t.Fatalf("expected a rollback to the previous image, got %q and minReadySeconds %d", image, deployment.Spec.MinReadySeconds)
+	}
+	if e := nextEvent(); !strings.Contains(e, EventReasonCloudflaredUpgradeRolledBack) {
+		t.Errorf("expected a rollback event, got %q", e)
+	}
+
+	// the failed image is not tried again
+	ensure("cloudflare/cloudflared:2026.8.0")
+	if image := cloudflaredImage(deployment); image != "cloudflare/cloudflared:2026.7.0" || deployment.Labels[cloudflaredVersionLabel] != "2026.7.0" {
+		t.Errorf("expected the rolled back image to be kept, got %q", image)
+	}
+	if deployment.Annotations[upgradeStartedAtAnnotation] != "" {
+		t.Error("expected no upgrade in progress")
+	}
+
+	// the image of a registry with a port
+	g.now = time.Now
+	ensure("registry.example.com:5000/cloudflare/cloudflared:2026.9.0@sha256:0123456789abcdef")
+	if deployment.Spec.MinReadySeconds != 300 || deployment.Spec.Template.Labels[cloudflaredVersionLabel] != "2026.9.0" {
+		t.Fatalf("expected the upgrade to be gated, got minReadySeconds %d and labels %v", deployment.Spec.MinReadySeconds, deployment.Spec.Template.Labels)
+	}
+	f.AddConnector(tunnelID, "2026.9.0")
+	check()
+	if deployment.Spec.MinReadySeconds != 0 || deployment.Annotations[upgradeStartedAtAnnotation] != "" {
+		t.Fatalf("expected the upgrade to complete, got minReadySeconds %d and annotations %v", deployment.Spec.MinReadySeconds, deployment.Annotations)
+	}
+}
+
+func TestImageTag(t *testing.T) {
+	tests := []struct {
+		image string
+		tag   string
+	}{
+		{image: "cloudflare/cloudflared:2026.6.0", tag: "2026.6.0"},
+		{image: "cloudflared:2026.6.0", tag: "2026.6.0"},
+		{image: "registry.example.com:5000/cloudflare/cloudflared:2026.6.0", tag: "2026.6.0"},
+		{image: "registry.example.com:5000/cloudflare/cloudflared", tag: ""},
+		{image: "cloudflare/cloudflared:2026.6.0@sha256:0123456789abcdef", tag: "2026.6.0"},
+		{image: "cloudflare/cloudflared@sha256:0123456789abcdef", tag: ""},
+		{image: "registry.example.com:5000/cloudflared@sha256:0123456789abcdef", tag: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			if got := imageTag(tt.image); got != tt.tag {
+				t.Errorf("imageTag() = %q, want %q", got, tt.tag)
+			}
+		})
+	}
+}
+
+func TestNewCloudflaredDeployment_ImageByDigest(t *testing.T) {
+	c := newTestCloudflaredController("token")
+	c.cloudflaredDeploymentConfig.cloudflaredImage = "cloudflare/cloudflared@sha256:0123456789abcdef"
+
+	if _, err := c.newCloudflaredDeployment(tunnelTokenChecksum("token")); err == nil {
+		t.Error("expected an image by digest only to be rejected")
+	}
+}
@@ -4,14 +4,17 @@ import (
 	"context"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel"
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/types"
 	kclientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/events"
 	"k8s.io/utils/env"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -23,6 +26,7 @@ type IngressController struct {
 
 	client       client.Client
 	clientset    kclientset.Interface
+	recorder     events.EventRecorder
 	tunnelClient *tunnel.Client
 
 	ingressClassName    string
@@ -38,14 +42,18 @@ type IngressController struct {
 type CloudflaredConfig struct {
 	CloudflaredImage           string
 	CloudflaredImagePullPolicy string
+	Workload                   CloudflaredWorkloadConfig
 }
 
+const dnsConflictRequeueInterval = 5 * time.Minute
+const permanentErrorRequeueInterval = 10 * time.Minute
+
 var (
 	_namespaceOnce sync.Once
 	_namespace     string
 )
 
-func NewIngressController(logger logr.Logger, client client.Client, config *rest.Config, tunnelClient *tunnel.Client, ingressClassName, controllerClassName string, cloudflaredConfig CloudflaredConfig) (*IngressController, error) {
+func NewIngressController(logger logr.Logger, client client.Client, config *rest.Config, recorder events.EventRecorder, tunnelClient *tunnel.Client, ingressClassName, controllerClassName string, cloudflaredConfig CloudflaredConfig) (*IngressController, error) {
 	kubernetes_api_tunnel_enabled, _ := env.GetBool("KUBERNETES_API_TUNNEL_ENABLED", false)
 	kubernetes_api_tunnel_server := os.Getenv("KUBERNETES_API_TUNNEL_SERVER")
 	kubernetes_api_tunnel_domain := os.Getenv("KUBERNETES_API_TUNNEL_DOMAIN")
@@ -60,17 +68,21 @@ func NewIngressController(logger logr.Logger, client client.Client, config *rest
 		logger:              logger,
 		client:              client,
 		clientset:           clientset,
+		recorder:            recorder,
 		tunnelClient:        tunnelClient,
 		ingressClassName:    ingressClassName,
 		controllerClassName: controllerClassName,
 		cloudflaredDeploymentConfig: cloudflaredDeploymentConfig{
 			cloudflaredImage:           cloudflaredConfig.CloudflaredImage,
 			cloudflaredImagePullPolicy: cloudflaredConfig.CloudflaredImagePullPolicy,
+			workload:                   cloudflaredConfig.Workload,
 		},
 		tunnelConfigLck:         sync.Mutex{},
 		tunnelConfigInitialized: false,
 		tunnelConfig: &tunnel.Config{
 			Ingresses:         make(map[types.UID]*tunnel.IngressRecords),
+			IngressDNS:        make(map[types.UID]*tunnel.IngressDNSConfig),
+			RulePaths:         make(map[*tunnel.IngressRecord]tunnel.RulePath),
 			AccessAppRequests: make(map[string]string),
 			KubernetesApiTunnelConfig: tunnel.KubernetesApiTunnelConfig{
 				Enabled:                 kubernetes_api_tunnel_enabled,
@@ -82,11 +94,9 @@ func NewIngressController(logger logr.Logger, client client.Client, config *rest
 	}, nil
 }
 
-func (c *IngressController) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (c *IngressController) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
 	reqLogger := log.FromContext(ctx)
 
-	var err error
-
 	err = c.ensureCloudflareTunnelExists(ctx, reqLogger)
 	if err != nil {
 		reqLogger.Error(err, "failed to ensure cloudflare tunnel exists")
@@ -106,6 +116,7 @@ func (c *IngressController) Reconcile(ctx context.Context, req ctrl.Request) (ct
 	}, ingress)
 	if apierrors.IsNotFound(err) {
 		reqLogger.Info("Ingress resource not found")
+		forgetReconciles(req)
 		return ctrl.Result{}, nil
 	}
 	if err != nil {
@@ -118,6 +129,8 @@ func (c *IngressController) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, nil
 	}
 
+	defer func() { observeReconcile(req, result, err) }()
+
 	c.tunnelConfigLck.Lock()
 	defer c.tunnelConfigLck.Unlock()
 
@@ -147,7 +160,10 @@ func (c *IngressController) Reconcile(ctx context.Context, req ctrl.Request) (ct
 
 	if ingress.GetDeletionTimestamp() != nil {
 		err = c.finalizeIngress(ctx, reqLogger, c.tunnelConfig, ingress)
-		return ctrl.Result{}, err
+		if err != nil {
+			return c.cloudflareErrorResult(ingress, err)
+		}
+		return ctrl.Result{}, nil
 	}
 
 	err = c.ensureFinalizers(ctx, reqLogger, ingress)
@@ -156,21 +172,44 @@ func (c *IngressController) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, err
 	}
 
-	err = c.ensureCloudflareTunnelConfiguration(ctx, reqLogger, c.tunnelConfig, ingress)
+	syncResult, err := c.ensureCloudflareTunnelConfiguration(ctx, reqLogger, c.tunnelConfig, ingress)
 	if err != nil {
 		reqLogger.Error(err, "failed to ensure tunnel configuration")
-		return ctrl.Result{}, err
+		return c.cloudflareErrorResult(ingress, err)
 	}
 
-	err = c.ensureStatus(ctx, reqLogger, ingress)
+	failedHosts, dnsErr := c.reportDNSFailures(c.tunnelConfig, ingress, syncResult)
+
+	err = c.ensureStatus(ctx, reqLogger, ingress, failedHosts)
 	if err != nil {
 		reqLogger.Error(err, "failed to ensure status")
 		return ctrl.Result{}, err
 	}
 
+	if dnsErr != nil {
+		// Retried with backoff, unlike conflicts the failures are usually transient
+		return ctrl.Result{}, dnsErr
+	}
+
+	if len(failedHosts) > 0 {
+		// Conflicting and rejected records are resolved outside of the controller, check back later
+		return ctrl.Result{RequeueAfter: dnsConflictRequeueInterval}, nil
+	}
+
 	return ctrl.Result{}, nil
 }
 
+// cloudflareErrorResult reports errors the Cloudflare API keeps returning until the configuration or the Ingress
+// changes as events and checks back later. Transient errors are retried with backoff.
+func (c *IngressController) cloudflareErrorResult(ingress *networkingv1.Ingress, err error) (ctrl.Result, error) {
+	if !tunnel.IsPermanentError(err) {
+		return ctrl.Result{}, err
+	}
+
+	c.recorder.Eventf(ingress, nil, corev1.EventTypeWarning, EventReasonCloudflareAPIError, "Reconcile", "Cloudflare API rejected the request: %s", err.Error())
+	return ctrl.Result{RequeueAfter: permanentErrorRequeueInterval}, nil
+}
+
 func namespace() string {
 	_namespaceOnce.Do(func() {
 		_namespace = "default"
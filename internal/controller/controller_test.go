@@ -0,0 +1,256 @@
+package controller
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel"
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel/fake"
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/dns"
+	"github.com/cloudflare/cloudflare-go/v6/option"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/events"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+const testIngressClassName = "cloudflare-tunnel"
+
+// startEnvtest starts a Kubernetes API server, skipping the test when its binaries are not installed. See
+// setup-envtest for installing them and setting KUBEBUILDER_ASSETS.
+func startEnvtest(t *testing.T) (*rest.Config, client.Client) {
+	t.Helper()
+
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" {
+		t.Skip("KUBEBUILDER_ASSETS not set")
+	}
+
+	env := &envtest.Environment{}
+	cfg, err := env.Start()
+	if err != nil {
+		t.Fatalf("failed to start envtest: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := env.Stop(); err != nil {
+			t.Errorf("failed to stop envtest: %v", err)
+		}
+	})
+
+	k8sClient, err := client.New(cfg, client.Options{Scheme: scheme.Scheme})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return cfg, k8sClient
+}
+
+// newTestIngressController returns a controller using cloudflare-go against the fake Cloudflare API, retrying in
+// the tunnel client instead of the SDK like the controller.
+func newTestIngressController(t *testing.T, cfg *rest.Config, k8sClient client.Client, f *fake.Cloudflare) (*IngressController, *events.FakeRecorder) {
+	t.Helper()
+
+	server := fake.NewServer(f)
+	t.Cleanup(server.Close)
+
+	cloudflareAPI := cloudflare.NewClient(
+		option.WithBaseURL(fake.BaseURL(server)),
+		option.WithAPIToken("token"),
+		option.WithMaxRetries(0),
+	)
+	tunnelClient := tunnel.NewClient(tunnel.NewCloudflareAPI(cloudflareAPI), "account", "test-tunnel", "owner", logr.Discard())
+	tunnelClient.SetCacheTTL(0)
+
+	recorder := events.NewFakeRecorder(100)
+	controller, err := NewIngressController(logr.Discard(), k8sClient, cfg, recorder, tunnelClient, testIngressClassName, "clbs.io/cloudflare-tunnel-ingress-controller", CloudflaredConfig{
+		CloudflaredImage:           "cloudflare/cloudflared:2026.6.0",
+		CloudflaredImagePullPolicy: "IfNotPresent",
+	})
+	if err != nil {
+		t.Fatalf("failed to create controller: %v", err)
+	}
+	tunnelClient.SetRuleOwnershipStore(newConfigMapRuleOwnershipStore(controller.clientset, namespace()))
+	return controller, recorder
+}
+
+func newTestIngress(name string, hostnames ...string) *networkingv1.Ingress {
+	pathType := networkingv1.PathTypePrefix
+	className := testIngressClassName
+
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       networkingv1.IngressSpec{IngressClassName: &className},
+	}
+	for _, hostname := range hostnames {
+		ingress.Spec.Rules = append(ingress.Spec.Rules, networkingv1.IngressRule{
+			Host: hostname,
+			IngressRuleValue: networkingv1.IngressRuleValue{
+				HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: []networkingv1.HTTPIngressPath{{
+						Path:     "/",
+						PathType: &pathType,
+						Backend: networkingv1.IngressBackend{
+							Service: &networkingv1.IngressServiceBackend{
+								Name: name,
+								Port: networkingv1.ServiceBackendPort{Number: 80},
+							},
+						},
+					}},
+				},
+			},
+		})
+	}
+	return ingress
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := context.Background()
+	cfg, k8sClient := startEnvtest(t)
+
+	f := fake.New()
+	zoneID := f.AddZone("example.com")
+	controller, _ := newTestIngressController(t, cfg, k8sClient, f)
+
+	ingress := newTestIngress("app", "app.example.com")
+	if err := k8sClient.Create(ctx, ingress); err != nil {
+		t.Fatalf("failed to create Ingress: %v", err)
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: ingress.Namespace, Name: ingress.Name}}
+
+	// Transient API errors are retried within the reconcile
+	f.InjectError(fake.OpTunnelConfigurationsGet, fake.RateLimitError(http.MethodGet, 0))
+	unavailable := fake.APIError(http.MethodPut, http.StatusServiceUnavailable, 10000, "Service unavailable")
+	unavailable.Response.Header.Set("Retry-After", "0")
+	f.InjectError(fake.OpTunnelConfigurationsUpdate, unavailable)
+
+	res, err := controller.Reconcile(ctx, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.RequeueAfter != 0 {
+		t.Errorf("expected no requeue, got %v", res.RequeueAfter)
+	}
+
+	if f.Calls(fake.OpTunnelsNew) != 1 {
+		t.Errorf("expected a single tunnel to be created, got %d", f.Calls(fake.OpTunnelsNew))
+	}
+	if _, ok := f.Record(zoneID, dns.RecordResponseTypeCNAME, "app.example.com"); !ok {
+		t.Error("expected CNAME record for app.example.com")
+	}
+
+	deployment := &appsv1.Deployment{}
+	if err := k8sClient.Get(ctx, types.NamespacedName{Namespace: namespace(), Name: appName}, deployment); err != nil {
+		t.Errorf("expected cloudflared Deployment: %v", err)
+	}
+
+	if err := k8sClient.Get(ctx, req.NamespacedName, ingress); err != nil {
+		t.Fatalf("failed to get Ingress: %v", err)
+	}
+	if !slices.Contains(ingress.Finalizers, ingressTunnelFinalizer) {
+		t.Error("expected finalizer to be added")
+	}
+	if lb := ingress.Status.LoadBalancer.Ingress; len(lb) != 1 || lb[0].Hostname != "app.example.com" {
+		t.Errorf("expected hostname in status, got %+v", lb)
+	}
+
+	// Deletion removes the records and releases the Ingress
+	if err := k8sClient.Delete(ctx, ingress); err != nil {
+		t.Fatalf("failed to delete Ingress: %v", err)
+	}
+	if _, err := controller.Reconcile(ctx, req); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if records := f.Records(zoneID); len(records) != 0 {
+		t.Errorf("expected records to be deleted, got %+v", records)
+	}
+	if err := k8sClient.Get(ctx, req.NamespacedName, ingress); !apierrors.IsNotFound(err) {
+		t.Errorf("expected Ingress to be gone, got %v", err)
+	}
+}
+
+func TestReconcile_DNSConflict(t *testing.T) {
+	ctx := context.Background()
+	cfg, k8sClient := startEnvtest(t)
+
+	f := fake.New()
+	zoneID := f.AddZone("example.com")
+	f.AddRecord(zoneID, "A", "taken.example.com", "192.0.2.1")
+	controller, recorder := newTestIngressController(t, cfg, k8sClient, f)
+
+	ingress := newTestIngress("conflict", "taken.example.com", "free.example.com")
+	if err := k8sClient.Create(ctx, ingress); err != nil {
+		t.Fatalf("failed to create Ingress: %v", err)
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: ingress.Namespace, Name: ingress.Name}}
+
+	res, err := controller.Reconcile(ctx, req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.RequeueAfter != dnsConflictRequeueInterval {
+		t.Errorf("expected requeue after %v, got %v", dnsConflictRequeueInterval, res.RequeueAfter)
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Warning "+EventReasonDNSConflict) {
+			t.Errorf("expected %s event, got %q", EventReasonDNSConflict, event)
+		}
+	default:
+		t.Error("expected an event")
+	}
+
+	if err := k8sClient.Get(ctx, req.NamespacedName, ingress); err != nil {
+		t.Fatalf("failed to get Ingress: %v", err)
+	}
+	if lb := ingress.Status.LoadBalancer.Ingress; len(lb) != 1 || lb[0].Hostname != "free.example.com" {
+		t.Errorf("expected only the free hostname in status, got %+v", lb)
+	}
+}
+
+func TestReconcile_PermanentError(t *testing.T) {
+	ctx := context.Background()
+	cfg, k8sClient := startEnvtest(t)
+
+	f := fake.New()
+	f.AddZone("example.com")
+	controller, recorder := newTestIngressController(t, cfg, k8sClient, f)
+
+	ingress := newTestIngress("forbidden", "app.example.com")
+	if err := k8sClient.Create(ctx, ingress); err != nil {
+		t.Fatalf("failed to create Ingress: %v", err)
+	}
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: ingress.Namespace, Name: ingress.Name}}
+
+	f.InjectError(fake.OpTunnelConfigurationsGet, fake.APIError(http.MethodGet, http.StatusForbidden, 10000, "Authentication error"))
+	res, err := controller.Reconcile(ctx, req)
+	if err != nil {
+		t.Fatalf("expected no error to avoid a tight requeue loop, got %v", err)
+	}
+	if res.RequeueAfter != permanentErrorRequeueInterval {
+		t.Errorf("expected requeue after %v, got %v", permanentErrorRequeueInterval, res.RequeueAfter)
+	}
+	if f.Calls(fake.OpTunnelConfigurationsGet) != 1 {
+		t.Errorf("expected no retries, got %d calls", f.Calls(fake.OpTunnelConfigurationsGet))
+	}
+
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Warning "+EventReasonCloudflareAPIError) {
+			t.Errorf("expected %s event, got %q", EventReasonCloudflareAPIError, event)
+		}
+	default:
+		t.Error("expected an event")
+	}
+}
@@ -0,0 +1,16 @@
+package controller
+
+const eventRecorderName = "cloudflare-tunnel-ingress-controller"
+
+// Reasons of the events emitted on Ingress resources
+const EventReasonInvalidPath = "InvalidPath"
+const EventReasonDNSConflict = "DNSConflict"
+const EventReasonDNSRecordFailed = "DNSRecordFailed"
+const EventReasonCloudflareAPIError = "CloudflareAPIError"
+
+// Reasons of the events emitted on the tunnel token Secret
+const EventReasonTunnelSecretRotated = "TunnelSecretRotated"
+
+// Reasons of the events emitted on the cloudflared Deployment
+const EventReasonCloudflaredUpgraded = "CloudflaredUpgraded"
+const EventReasonCloudflaredUpgradeRolledBack = "CloudflaredUpgradeRolledBack"
@@ -0,0 +1,39 @@
+package controller
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Outcomes of the reconciliation of an Ingress
+const reconcileResultSuccess = "success"
+const reconcileResultRequeue = "requeue"
+const reconcileResultError = "error"
+
+var ingressReconcilesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloudflare_tunnel_ingress_controller_ingress_reconciles_total",
+	Help: "Number of reconciliations of the Ingresses of the class by result (success, requeue, error).",
+}, []string{"namespace", "ingress", "result"})
+
+func init() {
+	metrics.Registry.MustRegister(ingressReconcilesTotal)
+}
+
+// observeReconcile records the outcome of the reconciliation of the Ingress. Requeued reconciliations are waiting
+// for something outside of the controller, like a DNS conflict or a request rejected by the Cloudflare API.
+func observeReconcile(req ctrl.Request, result ctrl.Result, err error) {
+	outcome := reconcileResultSuccess
+	switch {
+	case err != nil:
+		outcome = reconcileResultError
+	case result.RequeueAfter > 0:
+		outcome = reconcileResultRequeue
+	}
+	ingressReconcilesTotal.WithLabelValues(req.Namespace, req.Name, outcome).Inc()
+}
+
+// forgetReconciles drops the reconciliation metrics of an Ingress which no longer exists.
+func forgetReconciles(req ctrl.Request) {
+	ingressReconcilesTotal.DeletePartialMatch(prometheus.Labels{"namespace": req.Namespace, "ingress": req.Name})
+}
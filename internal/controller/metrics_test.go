@@ -0,0 +1,32 @@
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+func TestObserveReconcile(t *testing.T) {
+	req := ctrl.Request{NamespacedName: types.NamespacedName{Namespace: "default", Name: "metrics-app"}}
+	series := testutil.CollectAndCount(ingressReconcilesTotal)
+
+	observeReconcile(req, ctrl.Result{}, nil)
+	observeReconcile(req, ctrl.Result{RequeueAfter: time.Minute}, nil)
+	observeReconcile(req, ctrl.Result{}, errors.New("failed"))
+	observeReconcile(req, ctrl.Result{}, nil)
+
+	for result, want := range map[string]float64{reconcileResultSuccess: 2, reconcileResultRequeue: 1, reconcileResultError: 1} {
+		if got := testutil.ToFloat64(ingressReconcilesTotal.WithLabelValues("default", "metrics-app", result)); got != want {
+			t.Errorf("expected %v %s reconciles, got %v", want, result, got)
+		}
+	}
+
+	forgetReconciles(req)
+	if got := testutil.CollectAndCount(ingressReconcilesTotal); got != series {
+		t.Errorf("expected the metrics of the deleted Ingress to be dropped, got %d series", got)
+	}
+}
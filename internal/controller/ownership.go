@@ -0,0 +1,112 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kclientset "k8s.io/client-go/kubernetes"
+)
+
+const managedRulesConfigMapName = "cloudflare-tunnel-managed-rules"
+const managedRulesConfigMapKey = "rules.json"
+const rulesAdoptedConfigMapKey = "adopted"
+
+// configMapRuleOwnershipStore keeps the keys of the tunnel ingress rules owned by the controller in a ConfigMap
+// next to the cloudflared Deployment.
+type configMapRuleOwnershipStore struct {
+	clientset kclientset.Interface
+	namespace string
+}
+
+var _ tunnel.RuleOwnershipStore = (*configMapRuleOwnershipStore)(nil)
+
+func newConfigMapRuleOwnershipStore(clientset kclientset.Interface, namespace string) *configMapRuleOwnershipStore {
+	return &configMapRuleOwnershipStore{
+		clientset: clientset,
+		namespace: namespace,
+	}
+}
+
+func (s *configMapRuleOwnershipStore) LoadManagedRules(ctx context.Context) ([]tunnel.RuleKey, error) {
+	cm, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, managedRulesConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, ok := cm.Data[managedRulesConfigMapKey]
+	if !ok {
+		return nil, nil
+	}
+
+	var keys []tunnel.RuleKey
+	if err := json.Unmarshal([]byte(data), &keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *configMapRuleOwnershipStore) SaveManagedRules(ctx context.Context, keys []tunnel.RuleKey) error {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return s.save(ctx, managedRulesConfigMapKey, string(data))
+}
+
+// LoadRulesAdopted reports whether the adoption was recorded. The ConfigMap is only deleted by hand, in which case
+// the rules are adopted again, still only those generated by the previous versions of the controller.
+func (s *configMapRuleOwnershipStore) LoadRulesAdopted(ctx context.Context) (bool, error) {
+	cm, err := s.clientset.CoreV1().ConfigMaps(s.namespace).Get(ctx, managedRulesConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return cm.Data[rulesAdoptedConfigMapKey] == "true", nil
+}
+
+func (s *configMapRuleOwnershipStore) SaveRulesAdopted(ctx context.Context) error {
+	return s.save(ctx, rulesAdoptedConfigMapKey, "true")
+}
+
+// save sets the key of the ConfigMap, creating it when missing.
+func (s *configMapRuleOwnershipStore) save(ctx context.Context, key, value string) error {
+	configMaps := s.clientset.CoreV1().ConfigMaps(s.namespace)
+
+	cm, err := configMaps.Get(ctx, managedRulesConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      managedRulesConfigMapName,
+				Namespace: s.namespace,
+				Labels: map[string]string{
+					"app.kubernetes.io/managed-by": "cloudflare-tunnel-ingress-controller",
+					"app.kubernetes.io/part-of":    "cloudflare-tunnel-ingress-controller",
+				},
+			},
+			Data: map[string]string{
+				key: value,
+			},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	cm.Data[key] = value
+
+	_, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,182 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// AnnotationRotateTunnelSecret on the controller's ConfigMap requests a rotation of the tunnel secret. Every new value
+// of the annotation requests another rotation, e.g. the current time.
+const AnnotationRotateTunnelSecret = "cloudflare-tunnel-ingress-controller.clbs.io/rotate-tunnel-secret"
+
+// Annotations of the tunnel token Secret recording the last rotation of the tunnel secret
+const tunnelSecretRotatedAtAnnotation = "cloudflare-tunnel-ingress-controller.clbs.io/tunnel-secret-rotated-at"
+const tunnelSecretRotationRequestAnnotation = "cloudflare-tunnel-ingress-controller.clbs.io/tunnel-secret-rotation-request"
+
+const tunnelSecretRotationCheckInterval = time.Minute
+
+type TunnelSecretRotationOptions struct {
+	Enabled bool
+	// Interval between scheduled rotations, zero rotates on request only
+	Interval time.Duration
+	// ConfigMapName is the controller's ConfigMap annotated to request a rotation
+	ConfigMapName string
+}
+
+// tunnelSecretRotator rotates the tunnel secret on schedule and on request. The time of the last rotation is kept on
+// the token Secret, so the schedule survives restarts of the controller.
+type tunnelSecretRotator struct {
+	logger     logr.Logger
+	controller *IngressController
+	options    TunnelSecretRotationOptions
+	now        func() time.Time
+}
+
+// Rotating needs the tunnel and the token Secret set up by the leader
+var _ manager.LeaderElectionRunnable = (*tunnelSecretRotator)(nil)
+
+func newTunnelSecretRotator(logger logr.Logger, controller *IngressController, options TunnelSecretRotationOptions) *tunnelSecretRotator {
+	return &tunnelSecretRotator{
+		logger:     logger,
+		controller: controller,
+		options:    options,
+		now:        time.Now,
+	}
+}
+
+func (r *tunnelSecretRotator) NeedLeaderElection() bool {
+	return true
+}
+
+func (r *tunnelSecretRotator) Start(ctx context.Context) error {
+	r.logger.Info("Tunnel secret rotation enabled", "interval", r.options.Interval, "configMap", r.options.ConfigMapName)
+
+	ticker := time.NewTicker(tunnelSecretRotationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		if err := r.rotateIfNeeded(ctx); err != nil {
+			r.logger.Error(err, "Failed to rotate the tunnel secret")
+		}
+	}
+}
+
+// rotateIfNeeded rotates the tunnel secret when a new rotation is requested on the ConfigMap, or when the last
+// rotation is older than the interval.
+func (r *tunnelSecretRotator) rotateIfNeeded(ctx context.Context) error {
+	secret, err := r.controller.clientset.CoreV1().Secrets(namespace()).Get(ctx, tunnelTokenSecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// Not bootstrapped yet
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	request, err := r.rotationRequest(ctx)
+	if err != nil {
+		return err
+	}
+
+	if request != "" && request != secret.Annotations[tunnelSecretRotationRequestAnnotation] {
+		return r.rotate(ctx, r.logger.WithValues("reason", "requested", "request", request), request)
+	}
+
+	if r.options.Interval > 0 {
+		rotatedAt := secret.CreationTimestamp.Time
+		if v, ok := secret.Annotations[tunnelSecretRotatedAtAnnotation]; ok {
+			if t, err := time.Parse(time.RFC3339, v); err == nil {
+				rotatedAt = t
+			}
+		}
+		if r.now().Sub(rotatedAt) >= r.options.Interval {
+			return r.rotate(ctx, r.logger.WithValues("reason", "scheduled", "rotatedAt", rotatedAt), "")
+		}
+	}
+
+	return nil
+}
+
+// rotationRequest returns the value of the rotation annotation on the controller's ConfigMap, empty if not requested.
+func (r *tunnelSecretRotator) rotationRequest(ctx context.Context) (string, error) {
+	if r.options.ConfigMapName == "" {
+		return "", nil
+	}
+
+	cm, err := r.controller.clientset.CoreV1().ConfigMaps(namespace()).Get(ctx, r.options.ConfigMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return cm.Annotations[AnnotationRotateTunnelSecret], nil
+}
+
+// rotate replaces the tunnel secret, then rolls cloudflared onto the new token. The Deployment surges a new pod before
+// stopping an old one, the old pods keep serving with their established connections meanwhile. The rotation is
+// recorded as soon as the secret is replaced, a failing rollout is retried by the reconcilers and must not rotate
+// the secret again.
+func (r *tunnelSecretRotator) rotate(ctx context.Context, logger logr.Logger, request string) error {
+	logger.Info("Rotating the tunnel secret")
+
+	c := r.controller
+
+	// Held while rotating, so a concurrent reconcile does not put back the previous token
+	c.cloudflaredDeploymentConfig.tunnelTokenLck.Lock()
+	token, err := c.tunnelClient.RotateTunnelSecret(ctx, logger)
+	if err == nil {
+		c.cloudflaredDeploymentConfig.tunnelToken = token
+	}
+	c.cloudflaredDeploymentConfig.tunnelTokenLck.Unlock()
+	if err != nil {
+		return err
+	}
+
+	var secret *corev1.Secret
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		secrets := c.clientset.CoreV1().Secrets(namespace())
+		found, err := secrets.Get(ctx, tunnelTokenSecretName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		found = found.DeepCopy()
+		if found.Annotations == nil {
+			found.Annotations = map[string]string{}
+		}
+		found.Annotations[tunnelSecretRotatedAtAnnotation] = r.now().UTC().Format(time.RFC3339)
+		if request != "" {
+			found.Annotations[tunnelSecretRotationRequestAnnotation] = request
+		}
+		secret, err = secrets.Update(ctx, found, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		logger.Error(err, "Failed to record the tunnel secret rotation")
+		return err
+	}
+
+	c.recorder.Eventf(secret, nil, corev1.EventTypeNormal, EventReasonTunnelSecretRotated, "Rotate", "Tunnel secret rotated, rolling cloudflared onto the new token")
+	logger.Info("Tunnel secret rotated")
+
+	err = c.EnsureCloudflaredDeploymentExists(ctx, logger)
+	if err != nil {
+		logger.Error(err, "Failed to roll cloudflared onto the rotated token, leaving it to the reconcilers")
+		return err
+	}
+
+	return nil
+}
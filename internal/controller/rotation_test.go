@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel"
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel/fake"
+	"github.com/go-logr/logr"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kfake "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/events"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	crfake "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+const testConfigMapName = "cloudflare-tunnel-ingress-controller"
+
+func TestTunnelSecretRotator(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	tunnelID := f.AddTunnel("test-tunnel", false)
+
+	tunnelClient := tunnel.NewClient(&tunnel.CloudflareAPI{
+		Tunnels:            f.Tunnels,
+		CloudflaredTunnels: f.CloudflaredTunnels,
+		TunnelTokens:       f.TunnelTokens,
+	}, "account", "test-tunnel", "owner", logr.Discard())
+
+	c := newTestCloudflaredController("")
+	c.client = crfake.NewClientBuilder().Build()
+	c.clientset = kfake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: testConfigMapName, Namespace: namespace()},
+	})
+	c.tunnelClient = tunnelClient
+	recorder := events.NewFakeRecorder(10)
+	c.recorder = recorder
+
+	if err := c.ensureCloudflareTunnelExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("failed to ensure tunnel exists: %v", err)
+	}
+	if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("failed to ensure cloudflared deployment exists: %v", err)
+	}
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r := newTunnelSecretRotator(logr.Discard(), c, TunnelSecretRotationOptions{
+		Enabled:       true,
+		Interval:      24 * time.Hour,
+		ConfigMapName: testConfigMapName,
+	})
+	r.now = func() time.Time { return now }
+
+	secrets := c.clientset.CoreV1().Secrets(namespace())
+	secret, _ := secrets.Get(ctx, tunnelTokenSecretName, metav1.GetOptions{})
+	secret.Annotations = map[string]string{tunnelSecretRotatedAtAnnotation: now.Add(-time.Hour).Format(time.RFC3339)}
+	if _, err := secrets.Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update Secret: %v", err)
+	}
+
+	assertRotations := func(want int) {
+		t.Helper()
+		if err := r.rotateIfNeeded(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := f.Calls(fake.OpTunnelsEdit); got != want {
+			t.Fatalf("expected %d rotations, got %d", want, got)
+		}
+	}
+
+	// rotated recently, not requested
+	assertRotations(0)
+
+	// requested on the ConfigMap
+	cm, _ := c.clientset.CoreV1().ConfigMaps(namespace()).Get(ctx, testConfigMapName, metav1.GetOptions{})
+	cm.Annotations = map[string]string{AnnotationRotateTunnelSecret: "1"}
+	if _, err := c.clientset.CoreV1().ConfigMaps(namespace()).Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("failed to update ConfigMap: %v", err)
+	}
+	assertRotations(1)
+
+	token, _ := tunnelClient.GetTunnelToken(ctx)
+	secret, _ = secrets.Get(ctx, tunnelTokenSecretName, metav1.GetOptions{})
+	if string(secret.Data[tunnelTokenSecretKey]) != token || token == "token-"+tunnelID {
+		t.Errorf("expected the Secret to hold the rotated token %q, got %q", token, secret.Data[tunnelTokenSecretKey])
+	}
+	if secret.Annotations[tunnelSecretRotationRequestAnnotation] != "1" {
+		t.Errorf("expected the request to be recorded, got %v", secret.Annotations)
+	}
+	deployment := &appsv1.Deployment{}
+	if err := c.client.Get(ctx, types.NamespacedName{Name: appName, Namespace: namespace()}, deployment); err != nil {
+		t.Fatalf("failed to get Deployment: %v", err)
+	}
+	if deployment.Spec.Template.Annotations[tunnelTokenChecksumAnnotation] != tunnelTokenChecksum(token) {
+		t.Error("expected cloudflared to be rolled onto the rotated token")
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected a rotation event, got %d", len(recorder.Events))
+	}
+
+	// the request is handled once
+	assertRotations(1)
+
+	// scheduled
+	now = now.Add(25 * time.Hour)
+	assertRotations(2)
+	assertRotations(2)
+}
+
+func TestTunnelSecretRotator_FailedRollout(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	f.AddTunnel("test-tunnel", false)
+
+	tunnelClient := tunnel.NewClient(&tunnel.CloudflareAPI{
+		Tunnels:            f.Tunnels,
+		CloudflaredTunnels: f.CloudflaredTunnels,
+		TunnelTokens:       f.TunnelTokens,
+	}, "account", "test-tunnel", "owner", logr.Discard())
+
+	rolloutFailing := false
+	c := newTestCloudflaredController("")
+	c.client = crfake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+		Update: func(ctx context.Context, cl client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+			if _, ok := obj.(*appsv1.Deployment); ok && rolloutFailing {
+				return errors.New("deployment update failed")
+			}
+			return cl.Update(ctx, obj, opts...)
+		},
+	}).Build()
+	c.clientset = kfake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        testConfigMapName,
+			Namespace:   namespace(),
+			Annotations: map[string]string{AnnotationRotateTunnelSecret: "1"},
+		},
+	})
+	c.tunnelClient = tunnelClient
+	c.recorder = events.NewFakeRecorder(10)
+
+	if err := c.ensureCloudflareTunnelExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("failed to ensure tunnel exists: %v", err)
+	}
+	if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("failed to ensure cloudflared deployment exists: %v", err)
+	}
+
+	r := newTunnelSecretRotator(logr.Discard(), c, TunnelSecretRotationOptions{
+		Enabled:       true,
+		ConfigMapName: testConfigMapName,
+	})
+
+	rolloutFailing = true
+	if err := r.rotateIfNeeded(ctx); err == nil {
+		t.Fatal("expected the rollout to fail")
+	}
+	for range 2 {
+		if err := r.rotateIfNeeded(ctx); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if got := f.Calls(fake.OpTunnelsEdit); got != 1 {
+		t.Errorf("expected a single rotation, got %d", got)
+	}
+
+	// rolled by the next reconcile
+	rolloutFailing = false
+	if err := c.EnsureCloudflaredDeploymentExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	token, _ := tunnelClient.GetTunnelToken(ctx)
+	deployment := &appsv1.Deployment{}
+	if err := c.client.Get(ctx, types.NamespacedName{Name: appName, Namespace: namespace()}, deployment); err != nil {
+		t.Fatalf("failed to get Deployment: %v", err)
+	}
+	if deployment.Spec.Template.Annotations[tunnelTokenChecksumAnnotation] != tunnelTokenChecksum(token) {
+		t.Error("expected cloudflared to be rolled onto the rotated token")
+	}
+}
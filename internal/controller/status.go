@@ -2,6 +2,7 @@ package controller
 
 import (
 	"context"
+	"maps"
 	"slices"
 
 	"github.com/go-logr/logr"
@@ -9,16 +10,19 @@ import (
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func (c *IngressController) ensureStatus(ctx context.Context, logger logr.Logger, ing *networkingv1.Ingress) error {
-	host_add := make(map[string]struct{})
+// ensureStatus publishes the hostnames of the Ingress in its load balancer status, except the failed hosts.
+func (c *IngressController) ensureStatus(ctx context.Context, logger logr.Logger, ing *networkingv1.Ingress, failedHosts map[string]struct{}) error {
+	valid_hosts := make(map[string]struct{})
 	if ingressRecords, ok := c.tunnelConfig.Ingresses[ing.UID]; ok {
 		for _, ingress := range *ingressRecords {
-			if len(ingress.Hostname) > 0 {
-				host_add[ingress.Hostname] = struct{}{}
+			if _, failed := failedHosts[ingress.Hostname]; len(ingress.Hostname) > 0 && !failed {
+				valid_hosts[ingress.Hostname] = struct{}{}
 			}
 		}
 	}
 
+	host_add := maps.Clone(valid_hosts)
+
 	has_stale := false
 	for _, lbIngress := range ing.Status.LoadBalancer.Ingress {
 		if _, ok := host_add[lbIngress.Hostname]; ok {
@@ -37,14 +41,6 @@ func (c *IngressController) ensureStatus(ctx context.Context, logger logr.Logger
 	ing = ing.DeepCopy()
 
 	if has_stale {
-		valid_hosts := make(map[string]struct{})
-		if ingressRecords, ok := c.tunnelConfig.Ingresses[ing.UID]; ok {
-			for _, ingress := range *ingressRecords {
-				if len(ingress.Hostname) > 0 {
-					valid_hosts[ingress.Hostname] = struct{}{}
-				}
-			}
-		}
 		ing.Status.LoadBalancer.Ingress = slices.DeleteFunc(ing.Status.LoadBalancer.Ingress, func(lbIngress networkingv1.IngressLoadBalancerIngress) bool {
 			_, ok := valid_hosts[lbIngress.Hostname]
 			return !ok
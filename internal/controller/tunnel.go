@@ -2,13 +2,17 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"regexp"
 	"strconv"
-	"time"
-
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel"
+	"github.com/cloudflare/cloudflare-go/v6/dns"
 	"github.com/cloudflare/cloudflare-go/v6/zero_trust"
 	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
@@ -30,20 +34,23 @@ func (c *IngressController) ensureCloudflareTunnelExists(ctx context.Context, lo
 		return err
 	}
 
+	// Held while getting the token, so the token of a concurrent secret rotation is not replaced by the previous one
+	c.cloudflaredDeploymentConfig.tunnelTokenLck.Lock()
+	defer c.cloudflaredDeploymentConfig.tunnelTokenLck.Unlock()
+
 	token, err := c.tunnelClient.GetTunnelToken(ctx)
 	if err != nil {
 		logger.Error(err, "Failed to get Cloudflare Tunnel token")
 		return err
 	}
 
-	c.cloudflaredDeploymentConfig.tunnelTokenLck.Lock()
 	c.cloudflaredDeploymentConfig.tunnelToken = token
-	c.cloudflaredDeploymentConfig.tunnelTokenLck.Unlock()
 	return nil
 }
 
 func (c *IngressController) harvestRules(ctx context.Context, logger logr.Logger, tunnelConfig *tunnel.Config, ingress *networkingv1.Ingress) error {
 	cfg := tunnel.IngressRecords{}
+	paths := make(map[*tunnel.IngressRecord]tunnel.RulePath)
 
 	for _, rule := range ingress.Spec.Rules {
 		if rule.HTTP == nil {
@@ -51,14 +58,10 @@ func (c *IngressController) harvestRules(ctx context.Context, logger logr.Logger
 		}
 
 		for _, path := range rule.HTTP.Paths {
-			if path.PathType == nil {
-				continue
-			}
-
-			// We do not support pathType=Exact
-			// pathType=Prefix and pathType=ImplementationSpecific are supported
-			// and behave the same way
-			if *path.PathType == networkingv1.PathTypeExact {
+			pathRegex, err := tunnelPath(path)
+			if err != nil {
+				logger.Error(err, "Failed to translate path, skipping path", "host", rule.Host, "path", path.Path)
+				c.recorder.Eventf(ingress, nil, corev1.EventTypeWarning, EventReasonInvalidPath, "Reconcile", "Path %q of host %q skipped: %s", path.Path, rule.Host, err.Error())
 				continue
 			}
 
@@ -66,7 +69,7 @@ func (c *IngressController) harvestRules(ctx context.Context, logger logr.Logger
 			if path.Backend.Service.Port.Name != "" {
 				service := &corev1.Service{}
 
-				err := c.client.Get(ctx, types.NamespacedName{Name: path.Backend.Service.Name, Namespace: ingress.Namespace}, service)
+				err = c.client.Get(ctx, types.NamespacedName{Name: path.Backend.Service.Name, Namespace: ingress.Namespace}, service)
 				if err != nil {
 					logger.Error(err, "Failed to get Service")
 					return err
@@ -105,16 +108,24 @@ func (c *IngressController) harvestRules(ctx context.Context, logger logr.Logger
 
 			tunnelIng := &zero_trust.TunnelCloudflaredConfigurationGetResponseConfigIngress{
 				Hostname: rule.Host,
-				Path:     path.Path,
+				Path:     pathRegex,
 				Service:  tunnelService,
 			}
 			applyOriginRequestAnnotations(logger, &tunnelIng.OriginRequest, ingress.Annotations)
 
 			cfg = append(cfg, tunnelIng)
+			paths[tunnelIng] = tunnel.RulePath{Path: path.Path, PathType: *path.PathType}
 		}
 	}
 
+	if previous, ok := tunnelConfig.Ingresses[ingress.UID]; ok {
+		for _, record := range *previous {
+			delete(tunnelConfig.RulePaths, record)
+		}
+	}
+	maps.Copy(tunnelConfig.RulePaths, paths)
 	tunnelConfig.Ingresses[ingress.UID] = &cfg
+	tunnelConfig.IngressDNS[ingress.UID] = ingressDNSConfig(logger, ingress)
 
 	// Track hostnames that need a Cloudflare Access application auto-created
 	if app_name, ok := ingress.Annotations[AnnotationAccessAppName]; ok && app_name != "" {
@@ -128,6 +139,134 @@ func (c *IngressController) harvestRules(ctx context.Context, logger logr.Logger
 	return nil
 }
 
+func ingressDNSConfig(logger logr.Logger, ingress *networkingv1.Ingress) *tunnel.IngressDNSConfig {
+	dnsConfig := tunnel.NewIngressDNSConfig(fmt.Sprintf("ingress/%s/%s", ingress.Namespace, ingress.Name))
+
+	for k, v := range ingress.Annotations {
+		switch k {
+		case AnnotationDNSDisabled:
+			t, err := strconv.ParseBool(v)
+			if err != nil {
+				logger.Error(err, "Failed to parse dns disabled", "annotation", k)
+			} else {
+				dnsConfig.Disabled = t
+			}
+		case AnnotationDNSTakeover:
+			t, err := strconv.ParseBool(v)
+			if err != nil {
+				logger.Error(err, "Failed to parse dns takeover", "annotation", k)
+			} else {
+				dnsConfig.AllowTakeover = t
+			}
+		case AnnotationDNSProxied:
+			t, err := strconv.ParseBool(v)
+			if err != nil {
+				logger.Error(err, "Failed to parse dns proxied", "annotation", k)
+			} else {
+				dnsConfig.Proxied = t
+			}
+		case AnnotationDNSTTL:
+			t, err := parseDNSTTL(v)
+			if err != nil {
+				logger.Error(err, "Failed to parse dns ttl", "annotation", k)
+			} else {
+				dnsConfig.TTL = t
+			}
+		case AnnotationDNSComment:
+			comment, err := renderDNSComment(v, ingress)
+			if err != nil {
+				logger.Error(err, "Failed to render dns comment", "annotation", k)
+			} else {
+				dnsConfig.Comment = comment
+			}
+		case AnnotationDNSTags:
+			dnsConfig.Tags = nil
+			for tag := range strings.SplitSeq(v, ",") {
+				if tag = strings.TrimSpace(tag); len(tag) > 0 {
+					dnsConfig.Tags = append(dnsConfig.Tags, tag)
+				}
+			}
+		}
+	}
+
+	if dnsConfig.Proxied && dnsConfig.TTL != dns.TTL1 {
+		// Cloudflare always uses automatic TTL for proxied records
+		logger.Info("Ignoring dns ttl of proxied records", "annotation", AnnotationDNSTTL)
+		dnsConfig.TTL = dns.TTL1
+	}
+
+	return dnsConfig
+}
+
+// parseDNSTTL parses the TTL in seconds, "auto" stands for the automatic TTL.
+func parseDNSTTL(v string) (dns.TTL, error) {
+	if strings.EqualFold(v, "auto") {
+		return dns.TTL1, nil
+	}
+	ttl, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	if ttl != 1 && (ttl < 30 || ttl > 86400) {
+		return 0, fmt.Errorf("ttl must be 1 (automatic) or between 30 and 86400 seconds, got %d", ttl)
+	}
+	return dns.TTL(ttl), nil
+}
+
+// renderDNSComment renders the comment template, the namespace and name of the Ingress are available
+// as {{ .Namespace }} and {{ .Name }}.
+func renderDNSComment(v string, ingress *networkingv1.Ingress) (string, error) {
+	tmpl, err := template.New("comment").Parse(v)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = tmpl.Execute(&b, struct {
+		Namespace string
+		Name      string
+	}{
+		Namespace: ingress.Namespace,
+		Name:      ingress.Name,
+	})
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// tunnelPath translates the Kubernetes path semantics to a cloudflared path, which is a regular expression.
+// Exact and Prefix paths are anchored and escaped, ImplementationSpecific paths are passed through as a raw regular expression.
+func tunnelPath(path networkingv1.HTTPIngressPath) (string, error) {
+	if path.PathType == nil {
+		return "", errors.New("pathType is not set")
+	}
+
+	switch *path.PathType {
+	case networkingv1.PathTypeExact:
+		if !strings.HasPrefix(path.Path, "/") {
+			return "", errors.New("path must be absolute")
+		}
+		return "^" + regexp.QuoteMeta(path.Path) + "$", nil
+	case networkingv1.PathTypePrefix:
+		if !strings.HasPrefix(path.Path, "/") {
+			return "", errors.New("path must be absolute")
+		}
+		// Prefix matching is done on path elements, "/foo" matches "/foo" and "/foo/bar" but not "/foobar"
+		prefix := strings.TrimRight(path.Path, "/")
+		if prefix == "" {
+			return "^/", nil
+		}
+		return "^" + regexp.QuoteMeta(prefix) + "(/|$)", nil
+	case networkingv1.PathTypeImplementationSpecific:
+		if _, err := regexp.Compile(path.Path); err != nil {
+			return "", fmt.Errorf("invalid regular expression: %w", err)
+		}
+		return path.Path, nil
+	default:
+		return "", fmt.Errorf("unsupported pathType %q", *path.PathType)
+	}
+}
+
 func applyOriginRequestAnnotations(logger logr.Logger, origin_config *zero_trust.TunnelCloudflaredConfigurationGetResponseConfigIngressOriginRequest, annotations map[string]string) {
 	for k, v := range annotations {
 		switch k {
@@ -215,19 +354,50 @@ func applyOriginRequestAnnotations(logger logr.Logger, origin_config *zero_trust
 	}
 }
 
-func (c *IngressController) ensureCloudflareTunnelConfiguration(ctx context.Context, logger logr.Logger, tunnelConfig *tunnel.Config, ingress *networkingv1.Ingress) error {
+func (c *IngressController) ensureCloudflareTunnelConfiguration(ctx context.Context, logger logr.Logger, tunnelConfig *tunnel.Config, ingress *networkingv1.Ingress) (*tunnel.SyncResult, error) {
 	err := c.harvestRules(ctx, logger, tunnelConfig, ingress)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = c.tunnelClient.EnsureTunnelConfiguration(ctx, logger, tunnelConfig)
+	result, err := c.tunnelClient.EnsureTunnelConfiguration(ctx, logger, tunnelConfig)
 	if err != nil {
 		logger.Error(err, "Failed to ensure Cloudflare Tunnel configuration")
-		return err
+		return nil, err
 	}
 
-	return nil
+	return result, nil
+}
+
+// reportDNSFailures emits a Warning event for every hostname of the Ingress whose DNS records could not be managed
+// and returns these hostnames, together with the transient errors of the records which failed to be written.
+func (c *IngressController) reportDNSFailures(tunnelConfig *tunnel.Config, ingress *networkingv1.Ingress, result *tunnel.SyncResult) (map[string]struct{}, error) {
+	failed := make(map[string]struct{})
+	var errs []error
+
+	ingressRecords, ok := tunnelConfig.Ingresses[ingress.UID]
+	if !ok {
+		return failed, nil
+	}
+
+	for _, record := range *ingressRecords {
+		if _, ok := failed[record.Hostname]; ok {
+			continue
+		}
+		if conflict, ok := result.DNSConflicts[record.Hostname]; ok {
+			failed[record.Hostname] = struct{}{}
+			c.recorder.Eventf(ingress, nil, corev1.EventTypeWarning, EventReasonDNSConflict, "Reconcile", "DNS record for %s not managed: %s, set the %s annotation to take it over", record.Hostname, conflict.Reason, AnnotationDNSTakeover)
+		}
+		if err, ok := result.DNSFailures[record.Hostname]; ok {
+			failed[record.Hostname] = struct{}{}
+			if !tunnel.IsPermanentError(err) {
+				errs = append(errs, fmt.Errorf("failed to write DNS records for %s: %w", record.Hostname, err))
+			}
+			c.recorder.Eventf(ingress, nil, corev1.EventTypeWarning, EventReasonDNSRecordFailed, "Reconcile", "Failed to write DNS records for %s: %s", record.Hostname, err)
+		}
+	}
+
+	return failed, errors.Join(errs...)
 }
 
 func (c *IngressController) deleteTunnelConfigurationForIngress(ctx context.Context, logger logr.Logger, tunnelConfig *tunnel.Config, ingressUid types.UID) error {
@@ -239,11 +409,13 @@ func (c *IngressController) deleteTunnelConfigurationForIngress(ctx context.Cont
 	if ing != nil {
 		for _, record := range *ing {
 			delete(tunnelConfig.AccessAppRequests, record.Hostname)
+			delete(tunnelConfig.RulePaths, record)
 		}
 	}
 
 	delete(tunnelConfig.Ingresses, ingressUid)
-	err := c.tunnelClient.DeleteFromTunnelConfiguration(ctx, logger, ing)
+	delete(tunnelConfig.IngressDNS, ingressUid)
+	err := c.tunnelClient.DeleteFromTunnelConfiguration(ctx, logger, tunnelConfig, ing)
 	if err != nil {
 		logger.Error(err, "Failed to delete from tunnel configuration")
 		return err
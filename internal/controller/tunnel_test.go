@@ -1,11 +1,14 @@
 package controller
 
 import (
+	"slices"
 	"testing"
 
 	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel"
+	"github.com/cloudflare/cloudflare-go/v6/dns"
 	"github.com/cloudflare/cloudflare-go/v6/zero_trust"
 	"github.com/go-logr/logr"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
 
@@ -357,3 +360,123 @@ func TestAccessAppRequests_NotPopulatedWithEmptyAnnotation(t *testing.T) {
 		t.Error("expected no AccessAppRequests with empty annotation value")
 	}
 }
+
+func TestTunnelPath(t *testing.T) {
+	exact := networkingv1.PathTypeExact
+	prefix := networkingv1.PathTypePrefix
+	implementationSpecific := networkingv1.PathTypeImplementationSpecific
+
+	tests := []struct {
+		name     string
+		pathType *networkingv1.PathType
+		path     string
+		expected string
+		wantErr  bool
+	}{
+		{"exact", &exact, "/foo", "^/foo$", false},
+		{"exact with metacharacters", &exact, "/foo.bar+baz", `^/foo\.bar\+baz$`, false},
+		{"exact relative", &exact, "foo", "", true},
+		{"prefix", &prefix, "/foo", "^/foo(/|$)", false},
+		{"prefix with trailing slash", &prefix, "/foo/", "^/foo(/|$)", false},
+		{"prefix root", &prefix, "/", "^/", false},
+		{"prefix with metacharacters", &prefix, "/v1.0", `^/v1\.0(/|$)`, false},
+		{"implementation specific", &implementationSpecific, "^/api/v[0-9]+", "^/api/v[0-9]+", false},
+		{"implementation specific invalid", &implementationSpecific, "/api/(", "", true},
+		{"missing path type", nil, "/foo", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := tunnelPath(networkingv1.HTTPIngressPath{Path: tt.path, PathType: tt.pathType})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("tunnelPath(%q) error = %v, wantErr %v", tt.path, err, tt.wantErr)
+			}
+			if result != tt.expected {
+				t.Errorf("tunnelPath(%q) = %q, want %q", tt.path, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestIngressDNSConfig(t *testing.T) {
+	ingress := &networkingv1.Ingress{}
+	ingress.Namespace = "default"
+	ingress.Name = "app"
+	ingress.Annotations = map[string]string{
+		AnnotationDNSTakeover: "true",
+	}
+
+	dnsConfig := ingressDNSConfig(logr.Discard(), ingress)
+
+	if dnsConfig.Resource != "ingress/default/app" {
+		t.Errorf("expected resource 'ingress/default/app', got %q", dnsConfig.Resource)
+	}
+	if !dnsConfig.AllowTakeover {
+		t.Error("expected AllowTakeover to be true")
+	}
+}
+
+func TestIngressDNSConfig_RecordSettings(t *testing.T) {
+	ingress := &networkingv1.Ingress{}
+	ingress.Namespace = "default"
+	ingress.Name = "app"
+	ingress.Annotations = map[string]string{
+		AnnotationDNSProxied: "false",
+		AnnotationDNSTTL:     "300",
+		AnnotationDNSComment: "Ingress {{ .Namespace }}/{{ .Name }}",
+		AnnotationDNSTags:    "team:web, env:prod",
+	}
+
+	dnsConfig := ingressDNSConfig(logr.Discard(), ingress)
+
+	if dnsConfig.Proxied {
+		t.Error("expected Proxied to be false")
+	}
+	if dnsConfig.TTL != 300 {
+		t.Errorf("expected TTL = 300, got %v", dnsConfig.TTL)
+	}
+	if dnsConfig.Comment != "Ingress default/app" {
+		t.Errorf("expected Comment = 'Ingress default/app', got %q", dnsConfig.Comment)
+	}
+	if !slices.Equal(dnsConfig.Tags, []string{"team:web", "env:prod"}) {
+		t.Errorf("expected Tags = [team:web env:prod], got %v", dnsConfig.Tags)
+	}
+}
+
+func TestIngressDNSConfig_ProxiedIgnoresTTL(t *testing.T) {
+	ingress := &networkingv1.Ingress{}
+	ingress.Annotations = map[string]string{
+		AnnotationDNSTTL: "300",
+	}
+
+	dnsConfig := ingressDNSConfig(logr.Discard(), ingress)
+
+	if !dnsConfig.Proxied || dnsConfig.TTL != dns.TTL1 {
+		t.Errorf("expected proxied record with automatic TTL, got proxied=%v ttl=%v", dnsConfig.Proxied, dnsConfig.TTL)
+	}
+}
+
+func TestParseDNSTTL(t *testing.T) {
+	tests := []struct {
+		value   string
+		ttl     dns.TTL
+		wantErr bool
+	}{
+		{value: "auto", ttl: dns.TTL1},
+		{value: "1", ttl: dns.TTL1},
+		{value: "3600", ttl: 3600},
+		{value: "10", wantErr: true},
+		{value: "1h", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		ttl, err := parseDNSTTL(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseDNSTTL(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if ttl != tt.ttl {
+			t.Errorf("parseDNSTTL(%q) = %v, want %v", tt.value, ttl, tt.ttl)
+		}
+	}
+}
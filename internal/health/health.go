@@ -2,6 +2,7 @@ package health
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
@@ -14,6 +15,7 @@ import (
 type Server struct {
 	logger logr.Logger
 	server *http.Server
+	mux    *http.ServeMux
 
 	ready bool
 	mu    sync.RWMutex
@@ -28,6 +30,7 @@ func NewServer(logger logr.Logger, port int) *Server {
 	mux.HandleFunc("/livez", s.livezHandler)
 	mux.HandleFunc("/readyz", s.readyzHandler)
 
+	s.mux = mux
 	s.server = &http.Server{
 		Addr:              fmt.Sprintf(":%d", port),
 		Handler:           mux,
@@ -56,6 +59,23 @@ func (s *Server) Start(ctx context.Context) error {
 	return nil
 }
 
+// AddCheck serves a health reported by another component on the path, with its details as JSON. It answers 503
+// while the check is unhealthy. Checks are added before the server is started.
+func (s *Server) AddCheck(path string, check func() (bool, any)) {
+	s.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		healthy, details := check()
+		w.Header().Set("Content-Type", "application/json")
+		if healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(details); err != nil {
+			s.logger.Error(err, "could not write health check details", "path", path)
+		}
+	})
+}
+
 func (s *Server) SetReady(ready bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"context"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/dns"
+	"github.com/cloudflare/cloudflare-go/v6/option"
+	"github.com/cloudflare/cloudflare-go/v6/packages/pagination"
+	"github.com/cloudflare/cloudflare-go/v6/shared"
+	"github.com/cloudflare/cloudflare-go/v6/zero_trust"
+	"github.com/cloudflare/cloudflare-go/v6/zones"
+)
+
+// The interfaces below cover the Cloudflare API calls made by the client. Their methods match the services of
+// cloudflare-go, so the services of *cloudflare.Client implement them directly.
+
+type TunnelsAPI interface {
+	List(ctx context.Context, params zero_trust.TunnelListParams, opts ...option.RequestOption) (*pagination.V4PagePaginationArray[zero_trust.TunnelListResponse], error)
+}
+
+type CloudflaredTunnelsAPI interface {
+	New(ctx context.Context, params zero_trust.TunnelCloudflaredNewParams, opts ...option.RequestOption) (*shared.CloudflareTunnel, error)
+	Get(ctx context.Context, tunnelID string, query zero_trust.TunnelCloudflaredGetParams, opts ...option.RequestOption) (*shared.CloudflareTunnel, error)
+	Edit(ctx context.Context, tunnelID string, params zero_trust.TunnelCloudflaredEditParams, opts ...option.RequestOption) (*shared.CloudflareTunnel, error)
+}
+
+type TunnelTokensAPI interface {
+	Get(ctx context.Context, tunnelID string, query zero_trust.TunnelCloudflaredTokenGetParams, opts ...option.RequestOption) (*string, error)
+}
+
+type TunnelConnectionsAPI interface {
+	Get(ctx context.Context, tunnelID string, query zero_trust.TunnelCloudflaredConnectionGetParams, opts ...option.RequestOption) (*pagination.SinglePage[zero_trust.Client], error)
+}
+
+type TunnelConfigurationsAPI interface {
+	Get(ctx context.Context, tunnelID string, query zero_trust.TunnelCloudflaredConfigurationGetParams, opts ...option.RequestOption) (*zero_trust.TunnelCloudflaredConfigurationGetResponse, error)
+	Update(ctx context.Context, tunnelID string, params zero_trust.TunnelCloudflaredConfigurationUpdateParams, opts ...option.RequestOption) (*zero_trust.TunnelCloudflaredConfigurationUpdateResponse, error)
+}
+
+type ZonesAPI interface {
+	List(ctx context.Context, query zones.ZoneListParams, opts ...option.RequestOption) (*pagination.V4PagePaginationArray[zones.Zone], error)
+}
+
+type DNSRecordsAPI interface {
+	List(ctx context.Context, params dns.RecordListParams, opts ...option.RequestOption) (*pagination.V4PagePaginationArray[dns.RecordResponse], error)
+	New(ctx context.Context, params dns.RecordNewParams, opts ...option.RequestOption) (*dns.RecordResponse, error)
+	Update(ctx context.Context, dnsRecordID string, params dns.RecordUpdateParams, opts ...option.RequestOption) (*dns.RecordResponse, error)
+	Delete(ctx context.Context, dnsRecordID string, body dns.RecordDeleteParams, opts ...option.RequestOption) (*dns.RecordDeleteResponse, error)
+	Batch(ctx context.Context, params dns.RecordBatchParams, opts ...option.RequestOption) (*dns.RecordBatchResponse, error)
+}
+
+type AccessApplicationsAPI interface {
+	List(ctx context.Context, params zero_trust.AccessApplicationListParams, opts ...option.RequestOption) (*pagination.V4PagePaginationArray[zero_trust.AccessApplicationListResponse], error)
+	New(ctx context.Context, params zero_trust.AccessApplicationNewParams, opts ...option.RequestOption) (*zero_trust.AccessApplicationNewResponse, error)
+}
+
+// CloudflareAPI groups the Cloudflare API services used by the client.
+type CloudflareAPI struct {
+	Tunnels              TunnelsAPI
+	CloudflaredTunnels   CloudflaredTunnelsAPI
+	TunnelTokens         TunnelTokensAPI
+	TunnelConnections    TunnelConnectionsAPI
+	TunnelConfigurations TunnelConfigurationsAPI
+	Zones                ZonesAPI
+	DNSRecords           DNSRecordsAPI
+	AccessApplications   AccessApplicationsAPI
+}
+
+// NewCloudflareAPI returns the services of the cloudflare-go client.
+func NewCloudflareAPI(client *cloudflare.Client) *CloudflareAPI {
+	return &CloudflareAPI{
+		Tunnels:              client.ZeroTrust.Tunnels,
+		CloudflaredTunnels:   client.ZeroTrust.Tunnels.Cloudflared,
+		TunnelTokens:         client.ZeroTrust.Tunnels.Cloudflared.Token,
+		TunnelConnections:    client.ZeroTrust.Tunnels.Cloudflared.Connections,
+		TunnelConfigurations: client.ZeroTrust.Tunnels.Cloudflared.Configurations,
+		Zones:                client.Zones,
+		DNSRecords:           client.DNS.Records,
+		AccessApplications:   client.ZeroTrust.Access.Applications,
+	}
+}
+
+// listPerPage is the page size requested by listAll, the maximum accepted by all the listed endpoints.
+const listPerPage = 50
+
+// listAll collects the results of all pages. It stops on the first empty page, or on the first incomplete page
+// when the response reports its page size.
+func listAll[T any](list func(page, perPage int64) (*pagination.V4PagePaginationArray[T], error)) ([]T, error) {
+	var result []T
+	for page := int64(1); ; page++ {
+		res, err := list(page, listPerPage)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, res.Result...)
+		if len(res.Result) == 0 || int64(len(res.Result)) < res.ResultInfo.PerPage {
+			return result, nil
+		}
+	}
+}
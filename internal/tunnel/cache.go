@@ -0,0 +1,75 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTL is the time Cloudflare API listings are reused for, unless changed by the client.
+const DefaultCacheTTL = 1 * time.Minute
+
+type cacheEntry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// ttlCache keeps values read from the Cloudflare API for a limited time. The client invalidates the entries
+// it writes to, changes made outside of the controller are picked up once the entries expire.
+type ttlCache[K comparable, V any] struct {
+	name string
+
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[K]cacheEntry[V]
+	now     func() time.Time
+}
+
+func newTTLCache[K comparable, V any](name string, ttl time.Duration) *ttlCache[K, V] {
+	return &ttlCache[K, V]{
+		name:    name,
+		ttl:     ttl,
+		entries: make(map[K]cacheEntry[V]),
+		now:     time.Now,
+	}
+}
+
+func (c *ttlCache[K, V]) get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if ok && c.now().Before(entry.expires) {
+		cacheRequestsTotal.WithLabelValues(c.name, "hit").Inc()
+		return entry.value, true
+	}
+	delete(c.entries, key)
+
+	cacheRequestsTotal.WithLabelValues(c.name, "miss").Inc()
+	var zero V
+	return zero, false
+}
+
+func (c *ttlCache[K, V]) set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl <= 0 {
+		return
+	}
+	c.entries[key] = cacheEntry[V]{value: value, expires: c.now().Add(c.ttl)}
+}
+
+func (c *ttlCache[K, V]) invalidate(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+func (c *ttlCache[K, V]) setTTL(ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ttl = ttl
+	clear(c.entries)
+}
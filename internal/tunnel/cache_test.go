@@ -0,0 +1,38 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLCache(t *testing.T) {
+	now := time.Now()
+	c := newTTLCache[string, int]("test", time.Minute)
+	c.now = func() time.Time { return now }
+
+	if _, ok := c.get("a"); ok {
+		t.Fatal("expected miss on empty cache")
+	}
+
+	c.set("a", 1)
+	if v, ok := c.get("a"); !ok || v != 1 {
+		t.Errorf("expected hit with 1, got %d, %v", v, ok)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if _, ok := c.get("a"); ok {
+		t.Error("expected miss after expiry")
+	}
+
+	c.set("a", 2)
+	c.invalidate("a")
+	if _, ok := c.get("a"); ok {
+		t.Error("expected miss after invalidation")
+	}
+
+	c.setTTL(0)
+	c.set("a", 3)
+	if _, ok := c.get("a"); ok {
+		t.Error("expected miss with caching disabled")
+	}
+}
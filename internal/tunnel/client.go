@@ -9,9 +9,12 @@ import (
 	"maps"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cloudflare/cloudflare-go/v6"
-	"github.com/cloudflare/cloudflare-go/v6/dns"
+	"github.com/cloudflare/cloudflare-go/v6/packages/pagination"
+	"github.com/cloudflare/cloudflare-go/v6/shared"
 	"github.com/cloudflare/cloudflare-go/v6/zero_trust"
 	"github.com/cloudflare/cloudflare-go/v6/zones"
 	"github.com/go-logr/logr"
@@ -22,12 +25,35 @@ const tunnelDomain = "cfargotunnel.com"
 type Client struct {
 	logger logr.Logger
 
-	cloudflareAPI *cloudflare.Client
+	cloudflareAPI *CloudflareAPI
 	accountID     string
 	tunnelName    string
+	dnsOwnerID    string
 
+	// tunnelLck serializes looking up and creating the tunnel, done by the bootstrap and the reconciles
+	tunnelLck   sync.Mutex
 	tunnelID    string
 	tunnelToken string
+
+	// lastAppliedRules are the ingress rules pushed to the tunnel configuration by the last synchronization
+	lastAppliedRules IngressRecords
+
+	ownershipStore RuleOwnershipStore
+	// managedRules are the keys of the tunnel ingress rules owned by the controller, nil until loaded
+	managedRules map[RuleKey]struct{}
+	// adoptRules is set until the first synchronization when no adoption was recorded, see adoptedRule
+	adoptRules bool
+
+	// domainFilter restricts the DNS records managed by the controller
+	domainFilter DomainFilter
+
+	zoneCache         *ttlCache[string, map[string]string]
+	recordCache       *ttlCache[string, *zoneRecords]
+	accessAppCache    *ttlCache[string, map[string]struct{}]
+	tunnelConfigCache *ttlCache[string, *zero_trust.TunnelCloudflaredConfigurationGetResponse]
+
+	// rateLimiter paces all Cloudflare API requests of the client
+	rateLimiter *rateLimiter
 }
 
 var (
@@ -35,41 +61,90 @@ var (
 	socksProxyType = "socks"
 )
 
-func NewClient(cloudflareAPI *cloudflare.Client, accountID, tunnelName string, logger logr.Logger) *Client {
+func NewClient(cloudflareAPI *CloudflareAPI, accountID, tunnelName, dnsOwnerID string, logger logr.Logger) *Client {
 	return &Client{
 		logger:        logger,
 		cloudflareAPI: cloudflareAPI,
 		accountID:     accountID,
 		tunnelName:    tunnelName,
+		dnsOwnerID:    dnsOwnerID,
+
+		zoneCache:         newTTLCache[string, map[string]string]("zones", DefaultCacheTTL),
+		recordCache:       newTTLCache[string, *zoneRecords]("dns_records", DefaultCacheTTL),
+		accessAppCache:    newTTLCache[string, map[string]struct{}]("access_applications", DefaultCacheTTL),
+		tunnelConfigCache: newTTLCache[string, *zero_trust.TunnelCloudflaredConfigurationGetResponse]("tunnel_configuration", DefaultCacheTTL),
+
+		rateLimiter: newRateLimiter(DefaultRateLimit, DefaultRateLimitPeriod),
 	}
 }
 
+// SetCacheTTL changes how long Cloudflare API listings are reused for, zero disables the caching.
+func (c *Client) SetCacheTTL(ttl time.Duration) {
+	c.zoneCache.setTTL(ttl)
+	c.recordCache.setTTL(ttl)
+	c.accessAppCache.setTTL(ttl)
+	c.tunnelConfigCache.setTTL(ttl)
+}
+
 func (c *Client) GetTunnelToken(ctx context.Context) (string, error) {
+	c.tunnelLck.Lock()
+	defer c.tunnelLck.Unlock()
+
 	if len(c.tunnelToken) == 0 {
-		tunnel_token, err := c.cloudflareAPI.ZeroTrust.Tunnels.Cloudflared.Token.Get(ctx, c.tunnelID, zero_trust.TunnelCloudflaredTokenGetParams{
-			AccountID: cloudflare.F(c.accountID),
-		})
-		if err != nil {
+		if err := c.fetchTunnelToken(ctx); err != nil {
 			return "", err
 		}
-		if tunnel_token == nil {
-			return "", errors.New("tunnel token not found")
-		}
-		c.tunnelToken = *tunnel_token
 	}
 
 	return c.tunnelToken, nil
 }
 
+// fetchTunnelToken caches the current token of the tunnel. It is called with tunnelLck held.
+func (c *Client) fetchTunnelToken(ctx context.Context) error {
+	token, err := c.requestTunnelToken(ctx, c.tunnelID)
+	if err != nil {
+		return err
+	}
+	c.tunnelToken = token
+	return nil
+}
+
+func (c *Client) requestTunnelToken(ctx context.Context, tunnelID string) (string, error) {
+	tunnel_token, err := call(ctx, c, "tunnels.token.get", func() (*string, error) {
+		return c.cloudflareAPI.TunnelTokens.Get(ctx, tunnelID, zero_trust.TunnelCloudflaredTokenGetParams{
+			AccountID: cloudflare.F(c.accountID),
+		})
+	})
+	if err != nil {
+		return "", err
+	}
+	if tunnel_token == nil {
+		return "", errors.New("tunnel token not found")
+	}
+	return *tunnel_token, nil
+}
+
 func (c *Client) EnsureTunnelExists(ctx context.Context, logger logr.Logger) error {
+	c.tunnelLck.Lock()
+	defer c.tunnelLck.Unlock()
+
 	if c.tunnelID == "" {
 		logger.Info("TunnelID not set, looking for an existing tunnel")
 
-		tunnels := c.cloudflareAPI.ZeroTrust.Tunnels.ListAutoPaging(ctx, zero_trust.TunnelListParams{
-			AccountID: cloudflare.F(c.accountID),
+		tunnels, err := listAll(func(page, perPage int64) (*pagination.V4PagePaginationArray[zero_trust.TunnelListResponse], error) {
+			return call(ctx, c, "tunnels.list", func() (*pagination.V4PagePaginationArray[zero_trust.TunnelListResponse], error) {
+				return c.cloudflareAPI.Tunnels.List(ctx, zero_trust.TunnelListParams{
+					AccountID: cloudflare.F(c.accountID),
+					Page:      cloudflare.F(float64(page)),
+					PerPage:   cloudflare.F(float64(perPage)),
+				})
+			})
 		})
-		for tunnels.Next() {
-			tunnel := tunnels.Current()
+		if err != nil {
+			logger.Error(err, "Failed to list tunnels")
+			return err
+		}
+		for _, tunnel := range tunnels {
 			if !tunnel.DeletedAt.IsZero() {
 				// This is some deleted tunnel, skip it
 				continue
@@ -80,18 +155,16 @@ func (c *Client) EnsureTunnelExists(ctx context.Context, logger logr.Logger) err
 				return nil
 			}
 		}
-		if err := tunnels.Err(); err != nil {
-			logger.Error(err, "Failed to list tunnels")
-			return err
-		}
 
 		logger.Info("Cloudflare Tunnel not found, creating a new one")
 
 		return c.createTunnel(ctx, logger)
 	}
 
-	tunnel, err := c.cloudflareAPI.ZeroTrust.Tunnels.Cloudflared.Get(ctx, c.tunnelID, zero_trust.TunnelCloudflaredGetParams{
-		AccountID: cloudflare.F(c.accountID),
+	tunnel, err := call(ctx, c, "tunnels.get", func() (*shared.CloudflareTunnel, error) {
+		return c.cloudflareAPI.CloudflaredTunnels.Get(ctx, c.tunnelID, zero_trust.TunnelCloudflaredGetParams{
+			AccountID: cloudflare.F(c.accountID),
+		})
 	})
 	if err != nil {
 		logger.Error(err, "Failed to get the tunnel")
@@ -108,18 +181,19 @@ func (c *Client) EnsureTunnelExists(ctx context.Context, logger logr.Logger) err
 }
 
 func (c *Client) createTunnel(ctx context.Context, logger logr.Logger) error {
-	secret := make([]byte, 64)
-	_, err := rand.Read(secret)
+	secret, err := newTunnelSecret()
 	if err != nil {
 		logger.Error(err, "Failed to generate a secret for the tunnel")
 		return err
 	}
 
-	tunnel, err := c.cloudflareAPI.ZeroTrust.Tunnels.Cloudflared.New(ctx, zero_trust.TunnelCloudflaredNewParams{
-		AccountID:    cloudflare.F(c.accountID),
-		Name:         cloudflare.F(c.tunnelName),
-		TunnelSecret: cloudflare.F(base64.StdEncoding.EncodeToString(secret)),
-		ConfigSrc:    cloudflare.F(zero_trust.TunnelCloudflaredNewParamsConfigSrcCloudflare),
+	tunnel, err := create(ctx, c, "tunnels.new", func() (*shared.CloudflareTunnel, error) {
+		return c.cloudflareAPI.CloudflaredTunnels.New(ctx, zero_trust.TunnelCloudflaredNewParams{
+			AccountID:    cloudflare.F(c.accountID),
+			Name:         cloudflare.F(c.tunnelName),
+			TunnelSecret: cloudflare.F(secret),
+			ConfigSrc:    cloudflare.F(zero_trust.TunnelCloudflaredNewParamsConfigSrcCloudflare),
+		})
 	})
 	if err != nil {
 		logger.Error(err, "Failed to create a tunnel")
@@ -131,512 +205,495 @@ func (c *Client) createTunnel(ctx context.Context, logger logr.Logger) error {
 	return nil
 }
 
-func (c *Client) DeleteFromTunnelConfiguration(ctx context.Context, logger logr.Logger, ingressRecords *IngressRecords) error {
-	if ingressRecords == nil {
-		return nil
+// RotateTunnelSecret replaces the secret of the tunnel and returns the new tunnel token. Connectors already
+// connected with the previous token stay connected, new connectors need the new token.
+func (c *Client) RotateTunnelSecret(ctx context.Context, logger logr.Logger) (string, error) {
+	// The lock is not held while calling the API, the retries would block the reconciles and the health monitor
+	c.tunnelLck.Lock()
+	tunnelID := c.tunnelID
+	c.tunnelLck.Unlock()
+
+	if tunnelID == "" {
+		return "", errors.New("tunnel does not exist yet")
 	}
 
-	logger.Info("Deleting from Cloudflare Tunnel configuration")
+	secret, err := newTunnelSecret()
+	if err != nil {
+		logger.Error(err, "Failed to generate a secret for the tunnel")
+		return "", err
+	}
 
-	err := c.deleteFromTunnelConfiguration(ctx, logger, ingressRecords)
+	_, err = call(ctx, c, "tunnels.edit", func() (*shared.CloudflareTunnel, error) {
+		return c.cloudflareAPI.CloudflaredTunnels.Edit(ctx, tunnelID, zero_trust.TunnelCloudflaredEditParams{
+			AccountID:    cloudflare.F(c.accountID),
+			TunnelSecret: cloudflare.F(secret),
+		})
+	})
 	if err != nil {
-		return err
+		logger.Error(err, "Failed to rotate the tunnel secret")
+		return "", err
 	}
+	logger.Info("Tunnel secret rotated", "tunnelID", tunnelID)
 
-	err = c.deleteFromDns(ctx, logger, ingressRecords)
-	return err
-}
+	// The cached token was derived from the previous secret
+	c.tunnelLck.Lock()
+	c.tunnelToken = ""
+	c.tunnelLck.Unlock()
 
-func (c *Client) deleteFromTunnelConfiguration(ctx context.Context, logger logr.Logger, ingressRecords *IngressRecords) error {
-	tc, err := c.cloudflareAPI.ZeroTrust.Tunnels.Cloudflared.Configurations.Get(ctx, c.tunnelID, zero_trust.TunnelCloudflaredConfigurationGetParams{
-		AccountID: cloudflare.F(c.accountID),
-	})
+	token, err := c.requestTunnelToken(ctx, tunnelID)
 	if err != nil {
-		logger.Error(err, "Failed to get tunnel configuration")
-		return err
+		logger.Error(err, "Failed to get the rotated tunnel token")
+		return "", err
 	}
 
-	config := make([]zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress, 0, len(tc.Config.Ingress))
-
-	tunnelConfig := &tc.Config
-	for _, ing := range *ingressRecords {
-		for _, ingRule := range tunnelConfig.Ingress {
-			// we are not checking the service, since it is not important when deleting
-			if ingRule.Hostname != ing.Hostname || ingRule.Path != ing.Path {
-				config = append(config, zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress{
-					Hostname: cloudflare.F(ingRule.Hostname),
-					Service:  cloudflare.F(ingRule.Service),
-					Path:     cloudflare.F(ingRule.Path),
-					OriginRequest: cloudflare.F(zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngressOriginRequest{
-						Access: cloudflare.F(zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngressOriginRequestAccess{
-							AUDTag:   cloudflare.F(ingRule.OriginRequest.Access.AUDTag),
-							TeamName: cloudflare.F(ingRule.OriginRequest.Access.TeamName),
-							Required: cloudflare.F(ingRule.OriginRequest.Access.Required),
-						}),
-						CAPool:                 cloudflare.F(ingRule.OriginRequest.CAPool),
-						ConnectTimeout:         cloudflare.F(ingRule.OriginRequest.ConnectTimeout),
-						DisableChunkedEncoding: cloudflare.F(ingRule.OriginRequest.DisableChunkedEncoding),
-						HTTP2Origin:            cloudflare.F(ingRule.OriginRequest.HTTP2Origin),
-						HTTPHostHeader:         cloudflare.F(ingRule.OriginRequest.HTTPHostHeader),
-						KeepAliveConnections:   cloudflare.F(ingRule.OriginRequest.KeepAliveConnections),
-						KeepAliveTimeout:       cloudflare.F(ingRule.OriginRequest.KeepAliveTimeout),
-						NoHappyEyeballs:        cloudflare.F(ingRule.OriginRequest.NoHappyEyeballs),
-						NoTLSVerify:            cloudflare.F(ingRule.OriginRequest.NoTLSVerify),
-						OriginServerName:       cloudflare.F(ingRule.OriginRequest.OriginServerName),
-						ProxyType:              cloudflare.F(ingRule.OriginRequest.ProxyType),
-						TCPKeepAlive:           cloudflare.F(ingRule.OriginRequest.TCPKeepAlive),
-						TLSTimeout:             cloudflare.F(ingRule.OriginRequest.TLSTimeout),
-					}),
-				})
-			}
-		}
+	c.tunnelLck.Lock()
+	defer c.tunnelLck.Unlock()
+	if c.tunnelID == tunnelID {
+		c.tunnelToken = token
 	}
+	return token, nil
+}
 
-	c.flush404IfLast(tunnelConfig)
+// newTunnelSecret returns a random tunnel secret, base64 encoded as expected by the API.
+func newTunnelSecret() (string, error) {
+	secret := make([]byte, 64)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
 
-	_, err = c.cloudflareAPI.ZeroTrust.Tunnels.Cloudflared.Configurations.Update(ctx, c.tunnelID, zero_trust.TunnelCloudflaredConfigurationUpdateParams{
-		AccountID: cloudflare.F(c.accountID),
-		Config: cloudflare.F(zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfig{
-			Ingress: cloudflare.F(config),
-		}),
-	})
-	if err != nil {
-		logger.Error(err, "Failed to update tunnel configuration", "tunnelConfig", tunnelConfig)
-		return err
+func (c *Client) DeleteFromTunnelConfiguration(ctx context.Context, logger logr.Logger, config *Config, ingressRecords *IngressRecords) error {
+	if ingressRecords == nil {
+		return nil
 	}
 
-	return nil
-}
+	logger.Info("Deleting from Cloudflare Tunnel configuration")
 
-func (c *Client) deleteFromDns(ctx context.Context, logger logr.Logger, ingressRecords *IngressRecords) error {
 	zone_map, err := c.getDnsZoneMap(ctx, logger)
 	if err != nil {
 		return err
 	}
 
-	zones_recods_cache := make(map[string][]*dns.RecordResponse)
+	// The records are already removed from the config, synchronizing drops them from the tunnel and DNS.
+	err = c.synchronizeTunnelConfiguration(ctx, logger, config)
+	if err != nil {
+		return err
+	}
 
+	hostnames := make([]string, 0, len(*ingressRecords))
 	for _, ingress := range *ingressRecords {
-		for zoneName, zoneID := range zone_map {
-			if !strings.HasSuffix(ingress.Hostname, zoneName) {
-				continue
-			}
-			zone_records, ok := zones_recods_cache[zoneID]
-			if !ok {
-				ch := c.cloudflareAPI.DNS.Records.ListAutoPaging(ctx, dns.RecordListParams{
-					ZoneID: cloudflare.F(zoneID),
-					Content: cloudflare.F(dns.RecordListParamsContent{
-						Exact: cloudflare.String(c.tunnelID + "." + tunnelDomain),
-					}),
-				})
-				zone_records = make([]*dns.RecordResponse, 0)
-				for ch.Next() {
-					r := ch.Current()
-					zone_records = append(zone_records, &r)
-				}
-				if err = ch.Err(); err != nil {
-					logger.Error(err, "Failed to list DNS records")
-					return err
-				}
-				zones_recods_cache[zoneID] = zone_records
-			}
-			for _, record := range zone_records {
-				if record.Name != ingress.Hostname {
-					continue
-				}
-				_, err := c.cloudflareAPI.DNS.Records.Delete(ctx, record.ID, dns.RecordDeleteParams{
-					ZoneID: cloudflare.F(zoneID),
-				})
-				if err != nil {
-					logger.Error(err, "Failed to delete DNS record")
-					return err
-				}
-				break
-			}
-		}
+		hostnames = append(hostnames, ingress.Hostname)
 	}
 
+	// Conflicts and failures of the remaining hostnames are reported when reconciling their Ingresses
+	_, failures, err := c.synchronizeDns(ctx, logger, config, zone_map, hostnames)
+	if err != nil {
+		return err
+	}
+	for _, hostname := range hostnames {
+		if err, ok := failures[hostname]; ok {
+			return err
+		}
+	}
 	return nil
 }
 
-func (c *Client) EnsureTunnelConfiguration(ctx context.Context, logger logr.Logger, config *Config) error {
+// SyncResult reports the hostnames which could not be fully configured by EnsureTunnelConfiguration.
+type SyncResult struct {
+	// DNSConflicts maps the hostname to the conflict preventing its DNS record from being managed
+	DNSConflicts map[string]*DNSConflictError
+	// DNSFailures maps the hostname to the error of writing its DNS records
+	DNSFailures map[string]error
+}
+
+func (c *Client) EnsureTunnelConfiguration(ctx context.Context, logger logr.Logger, config *Config) (*SyncResult, error) {
 	logger.Info("Ensuring Cloudflare Tunnel configuration")
 
 	zone_map, err := c.getDnsZoneMap(ctx, logger)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = c.synchronizeTunnelConfiguration(ctx, logger, config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = c.synchronizeDns(ctx, logger, config, zone_map)
+	conflicts, failures, err := c.synchronizeDns(ctx, logger, config, zone_map, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if config.KubernetesApiTunnelConfig.Enabled {
 		err := c.ensureAccessApplication(ctx, logger, config.KubernetesApiTunnelConfig.Domain, config.KubernetesApiTunnelConfig.CloudflareAccessAppName, zone_map)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
 	for hostname, app_name := range config.AccessAppRequests {
 		err := c.ensureAccessApplication(ctx, logger, hostname, app_name, zone_map)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
 
-	return nil
+	accessApps := len(config.AccessAppRequests)
+	if config.KubernetesApiTunnelConfig.Enabled {
+		accessApps++
+	}
+	managedAccessApplications.Set(float64(accessApps))
+
+	return &SyncResult{DNSConflicts: conflicts, DNSFailures: failures}, nil
 }
 
 func (c *Client) synchronizeTunnelConfiguration(ctx context.Context, logger logr.Logger, config *Config) error {
-	tc, err := c.cloudflareAPI.ZeroTrust.Tunnels.Cloudflared.Configurations.Get(ctx, c.tunnelID, zero_trust.TunnelCloudflaredConfigurationGetParams{
-		AccountID: cloudflare.F(c.accountID),
-	})
+	err := c.loadManagedRules(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	tc, err := c.getTunnelConfiguration(ctx, logger)
 	if err != nil {
-		logger.Error(err, "Failed to get tunnel configuration")
 		return err
 	}
 
-	active_ingress := tc.Config.Ingress
+	desired := c.desiredIngressRules(config)
 
-	want_kube_api_tunnel := config.KubernetesApiTunnelConfig.Enabled
-	has_kube_api_tunnel := false
-	if want_kube_api_tunnel {
-		for _, r := range active_ingress {
-			// Check if the active_ingress has the kube API tunnel
-			if r.Hostname == config.KubernetesApiTunnelConfig.Domain && r.Service == config.KubernetesApiTunnelConfig.GetService() {
-				has_kube_api_tunnel = true
-				break
-			}
-		}
+	// Rules created by the controller earlier or wanted now are owned, everything else is left as is
+	owned := maps.Clone(c.managedRules)
+	for _, r := range desired {
+		owned[keyOf(r)] = dummy
 	}
 
-	// Discover whether all ingresses have the same definition (in the same order)
-	tunnelConfigUpdated := false
-	for _, ingressRecords := range config.Ingresses {
-		// If the number of records is 0, they are the same
-		if len(*ingressRecords) == 0 {
+	var catchAll *IngressRecord
+	live := make(IngressRecords, 0, len(tc.Config.Ingress))
+	liveOwned := make(IngressRecords, 0, len(tc.Config.Ingress))
+	for i := range tc.Config.Ingress {
+		r := &tc.Config.Ingress[i]
+		if isCatchAll(r) {
+			catchAll = r
 			continue
 		}
-		// Otherwise, we need to find the first record in the active_ingress that matches the first record in ingressRecords
-		record_offset := -1
-		first_record := (*ingressRecords)[0]
-		for i, r := range active_ingress {
-			if r.Hostname == first_record.Hostname && r.Path == first_record.Path && r.Service == first_record.Service {
-				record_offset = i
-			}
+		live = append(live, r)
+		if c.adoptedRule(logger, r, desired, config.RulePaths) {
+			owned[keyOf(r)] = dummy
 		}
-		if record_offset == -1 {
-			// If we didn't find a match, we have a change
-			tunnelConfigUpdated = true
-			break
-		} else {
-			// Otherwise, we need to check if all records match
-			for i, ingressRecord := range *ingressRecords {
-				idx := record_offset + i
-				if idx >= len(active_ingress) || active_ingress[idx].Hostname != ingressRecord.Hostname || active_ingress[idx].Path != ingressRecord.Path || active_ingress[idx].Service != ingressRecord.Service {
-					tunnelConfigUpdated = true
-					break
-				}
-			}
-			if tunnelConfigUpdated {
-				break
-			}
+		if _, ok := owned[keyOf(r)]; ok {
+			liveOwned = append(liveOwned, r)
 		}
 	}
 
-	var proposed_ingress []zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress
-	if tunnelConfigUpdated {
-		proposed_ingress = make([]zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress, 0)
-		for _, ingressRecords := range config.Ingresses {
-			for _, ingressRecord := range *ingressRecords {
-				new_rule := c.createIngressToTunnelConfigurationStruct(logger, ingressRecord)
-				proposed_ingress = append(proposed_ingress, *new_rule)
-			}
-		}
+	changes := diffIngressRules(desired, c.lastAppliedRules, liveOwned)
+	if changes.IsEmpty() {
+		logger.V(1).Info("Tunnel configuration is up to date", "version", tc.Version)
+		c.lastAppliedRules = desired
+		observeManagedRules(desired)
+		return c.finishSynchronization(ctx, logger, desired)
 	}
 
-	tunnelConfigUpdated = tunnelConfigUpdated || (want_kube_api_tunnel != has_kube_api_tunnel)
+	logChangeSet(logger, changes)
 
-	if tunnelConfigUpdated && want_kube_api_tunnel {
-		new_rule := zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress{
-			Hostname: cloudflare.String(config.KubernetesApiTunnelConfig.Domain),
-			Service:  cloudflare.String(config.KubernetesApiTunnelConfig.GetService()),
-			OriginRequest: cloudflare.F(zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngressOriginRequest{
-				ProxyType: cloudflare.F(socksProxyType),
-			}),
-		}
-		proposed_ingress = append(proposed_ingress, new_rule)
+	// Record the ownership before touching the tunnel, so no rule created by the controller is ever orphaned
+	err = c.saveManagedRules(ctx, logger, owned)
+	if err != nil {
+		return err
 	}
 
-	if tunnelConfigUpdated {
-		if len(proposed_ingress) > 0 {
-			proposed_ingress = append(proposed_ingress, zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress{
-				Service: cloudflare.String("http_status:404"),
-			})
-		}
+	err = c.updateTunnelConfiguration(ctx, logger, mergeIngressRules(live, owned, desired), catchAll)
+	if err != nil {
+		return err
+	}
 
-		_, err = c.cloudflareAPI.ZeroTrust.Tunnels.Cloudflared.Configurations.Update(ctx, c.tunnelID, zero_trust.TunnelCloudflaredConfigurationUpdateParams{
-			AccountID: cloudflare.F(c.accountID),
-			Config: cloudflare.F(zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfig{
-				Ingress: cloudflare.F(proposed_ingress),
-			}),
-		})
-		if err != nil {
-			logger.Error(err, "Failed to update tunnel configuration")
-			return err
+	for _, u := range changes.Updated {
+		if u.Drift {
+			ObserveDriftCorrection(DriftResourceTunnelIngressRule)
 		}
 	}
 
-	return nil
+	c.lastAppliedRules = desired
+	observeManagedRules(desired)
+	return c.finishSynchronization(ctx, logger, desired)
 }
 
-func (c *Client) isInZone(hostname string, zoneName string) bool {
-	return (hostname == zoneName) || strings.HasSuffix(hostname, "."+zoneName)
+// finishSynchronization records the ownership of the rules applied to the tunnel.
+func (c *Client) finishSynchronization(ctx context.Context, logger logr.Logger, desired IngressRecords) error {
+	if err := c.saveManagedRules(ctx, logger, ruleKeys(desired)); err != nil {
+		return err
+	}
+	return c.rulesAdopted(ctx, logger)
 }
 
-func (c *Client) synchronizeDns(ctx context.Context, logger logr.Logger, config *Config, zone_map map[string]string) error {
-
-	// determine which hostnames are in which zone
-	zone_hostnames := make(map[string]map[string]struct{})
-	zone_records := make(map[string][]*dns.RecordResponse)
-	for _, ingressRecords := range config.Ingresses {
-		for _, ingress := range *ingressRecords {
-			zoneID := ""
-			for zone, zone_id := range zone_map {
-				if c.isInZone(ingress.Hostname, zone) {
-					zoneID = zone_id
-					break
-				}
-			}
+func (c *Client) getTunnelConfiguration(ctx context.Context, logger logr.Logger) (*zero_trust.TunnelCloudflaredConfigurationGetResponse, error) {
+	if tc, ok := c.tunnelConfigCache.get(c.tunnelID); ok {
+		return tc, nil
+	}
 
-			if len(zoneID) == 0 {
-				logger.Info("Failed to find zone ID", "hostname", ingress.Hostname)
-				continue
-			}
+	tc, err := call(ctx, c, "tunnels.configurations.get", func() (*zero_trust.TunnelCloudflaredConfigurationGetResponse, error) {
+		return c.cloudflareAPI.TunnelConfigurations.Get(ctx, c.tunnelID, zero_trust.TunnelCloudflaredConfigurationGetParams{
+			AccountID: cloudflare.F(c.accountID),
+		})
+	})
+	if err != nil {
+		logger.Error(err, "Failed to get tunnel configuration")
+		return nil, err
+	}
 
-			if _, ok := zone_hostnames[zoneID]; !ok {
-				zone_hostnames[zoneID] = make(map[string]struct{})
+	c.tunnelConfigCache.set(c.tunnelID, tc)
+	tunnelConfigurationVersion.Set(float64(tc.Version))
+	return tc, nil
+}
 
-				ch := c.cloudflareAPI.DNS.Records.ListAutoPaging(ctx, dns.RecordListParams{
-					ZoneID: cloudflare.F(zoneID),
-					Content: cloudflare.F(dns.RecordListParamsContent{
-						Exact: cloudflare.String(c.tunnelID + "." + tunnelDomain),
-					}),
-				})
-				dns_records := make([]*dns.RecordResponse, 0)
-				for ch.Next() {
-					r := ch.Current()
-					dns_records = append(dns_records, &r)
-				}
-				if err := ch.Err(); err != nil {
-					logger.Error(err, "Failed to list DNS records")
-					return err
-				}
-				zone_records[zoneID] = dns_records
-			}
-			zone_hostnames[zoneID][ingress.Hostname] = dummy
+// observeManagedRules sets the metrics of the managed rules and hostnames to the rules applied to the tunnel.
+func observeManagedRules(rules IngressRecords) {
+	hostnames := make(map[string]struct{}, len(rules))
+	for _, r := range rules {
+		if r.Hostname != "" {
+			hostnames[r.Hostname] = dummy
 		}
 	}
+	managedRules.Set(float64(len(rules)))
+	managedHostnames.Set(float64(len(hostnames)))
+}
+
+func ruleKeys(rules IngressRecords) map[RuleKey]struct{} {
+	keys := make(map[RuleKey]struct{}, len(rules))
+	for _, r := range rules {
+		keys[keyOf(r)] = dummy
+	}
+	return keys
+}
+
+// desiredIngressRules flattens the config into the list of tunnel ingress rules, without the catch-all rule.
+// The result is deterministic and ordered by specificity, see sortIngressRules. A rule defined by several Ingresses
+// is taken from the one with the lowest UID.
+func (c *Client) desiredIngressRules(config *Config) IngressRecords {
+	// Ingresses are visited by UID, so the same rule defined by two Ingresses always resolves the same way
+	uids := slices.Sorted(maps.Keys(config.Ingresses))
+
+	rules := make(IngressRecords, 0)
+	for _, uid := range uids {
+		rules = append(rules, *config.Ingresses[uid]...)
+	}
 
 	if config.KubernetesApiTunnelConfig.Enabled {
-		zoneID := ""
-		for zone, zone_id := range zone_map {
-			if c.isInZone(config.KubernetesApiTunnelConfig.Domain, zone) {
-				zoneID = zone_id
-				break
-			}
-		}
+		rules = append(rules, &IngressRecord{
+			Hostname: config.KubernetesApiTunnelConfig.Domain,
+			Service:  config.KubernetesApiTunnelConfig.GetService(),
+			OriginRequest: zero_trust.TunnelCloudflaredConfigurationGetResponseConfigIngressOriginRequest{
+				ProxyType: socksProxyType,
+			},
+		})
+	}
 
-		if len(zoneID) == 0 {
-			logger.Info("Failed to find zone ID", "hostname", config.KubernetesApiTunnelConfig.Domain)
-		} else {
-			if _, ok := zone_hostnames[zoneID]; !ok {
-				zone_hostnames[zoneID] = make(map[string]struct{})
-
-				ch := c.cloudflareAPI.DNS.Records.ListAutoPaging(ctx, dns.RecordListParams{
-					ZoneID: cloudflare.F(zoneID),
-					Content: cloudflare.F(dns.RecordListParamsContent{
-						Exact: cloudflare.String(c.tunnelID + "." + tunnelDomain),
-					}),
-				})
-				dns_records := make([]*dns.RecordResponse, 0)
-				for ch.Next() {
-					r := ch.Current()
-					dns_records = append(dns_records, &r)
-				}
-				if err := ch.Err(); err != nil {
-					logger.Error(err, "Failed to list DNS records")
-					return err
-				}
-				zone_records[zoneID] = dns_records
-			}
-			zone_hostnames[zoneID][config.KubernetesApiTunnelConfig.Domain] = dummy
+	sortIngressRules(rules, config.RulePaths)
+
+	return dedupeIngressRules(rules)
+}
+
+// dedupeIngressRules keeps the first rule of every key. A rule defined by several Ingresses would otherwise be
+// pushed once per Ingress, while cloudflared only ever matches the first copy.
+func dedupeIngressRules(rules IngressRecords) IngressRecords {
+	seen := make(map[RuleKey]struct{}, len(rules))
+	return slices.DeleteFunc(rules, func(r *IngressRecord) bool {
+		key := keyOf(r)
+		if _, ok := seen[key]; ok {
+			return true
 		}
+		seen[key] = dummy
+		return false
+	})
+}
+
+// updateTunnelConfiguration replaces the tunnel ingress rules. The catch-all rule is kept when present,
+// otherwise a 404 catch-all is added.
+func (c *Client) updateTunnelConfiguration(ctx context.Context, logger logr.Logger, rules IngressRecords, catchAll *IngressRecord) error {
+	ingress := make([]zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress, 0, len(rules)+1)
+	for _, rule := range rules {
+		ingress = append(ingress, ingressRecordToUpdateParams(rule))
 	}
 
-	// create DNS records (if needed)
-	for zoneID, hostnames := range zone_hostnames {
-		hostname_list := slices.Collect(maps.Keys(hostnames))
-		if err := c.createDNSRecords(ctx, logger, zoneID, hostname_list); err != nil {
-			return err
+	if len(ingress) > 0 {
+		if catchAll == nil {
+			catchAll = &IngressRecord{Service: "http_status:404"}
 		}
+		ingress = append(ingress, ingressRecordToUpdateParams(catchAll))
 	}
 
-	for zoneID, dns_records := range zone_records {
-		valid_hostnames := zone_hostnames[zoneID]
-		for _, record := range dns_records {
-			if _, ok := valid_hostnames[record.Name]; !ok {
-				_, err := c.cloudflareAPI.DNS.Records.Delete(ctx, record.ID, dns.RecordDeleteParams{
-					ZoneID: cloudflare.F(zoneID),
-				})
-				if err != nil {
-					logger.Error(err, "Failed to delete DNS record")
-					return err
-				}
-			}
-		}
+	c.tunnelConfigCache.invalidate(c.tunnelID)
+
+	tc, err := call(ctx, c, "tunnels.configurations.update", func() (*zero_trust.TunnelCloudflaredConfigurationUpdateResponse, error) {
+		return c.cloudflareAPI.TunnelConfigurations.Update(ctx, c.tunnelID, zero_trust.TunnelCloudflaredConfigurationUpdateParams{
+			AccountID: cloudflare.F(c.accountID),
+			Config: cloudflare.F(zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfig{
+				Ingress: cloudflare.F(ingress),
+			}),
+		})
+	})
+	if err != nil {
+		logger.Error(err, "Failed to update tunnel configuration")
+		return err
 	}
 
+	logger.Info("Tunnel configuration updated", "version", tc.Version)
+	tunnelConfigurationUpdatesTotal.Inc()
+	tunnelConfigurationVersion.Set(float64(tc.Version))
+
 	return nil
 }
 
-func (c *Client) createIngressToTunnelConfigurationStruct(logger logr.Logger, ingress *zero_trust.TunnelCloudflaredConfigurationGetResponseConfigIngress) *zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress {
-	logger.Info("Adding new ingress rule to tunnel configuration")
-
-	newIngressRule := &zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress{
-		Hostname: cloudflare.String(ingress.Hostname),
-		Service:  cloudflare.String(ingress.Service),
-		OriginRequest: cloudflare.F(zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngressOriginRequest{
-			Access: cloudflare.F(zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngressOriginRequestAccess{
-				AUDTag:   cloudflare.F(ingress.OriginRequest.Access.AUDTag),
-				TeamName: cloudflare.F(ingress.OriginRequest.Access.TeamName),
-				Required: cloudflare.F(ingress.OriginRequest.Access.Required),
-			}),
-			CAPool:                 cloudflare.F(ingress.OriginRequest.CAPool),
-			ConnectTimeout:         cloudflare.F(ingress.OriginRequest.ConnectTimeout),
-			DisableChunkedEncoding: cloudflare.F(ingress.OriginRequest.DisableChunkedEncoding),
-			HTTP2Origin:            cloudflare.F(ingress.OriginRequest.HTTP2Origin),
-			HTTPHostHeader:         cloudflare.F(ingress.OriginRequest.HTTPHostHeader),
-			KeepAliveConnections:   cloudflare.F(ingress.OriginRequest.KeepAliveConnections),
-			NoHappyEyeballs:        cloudflare.F(ingress.OriginRequest.NoHappyEyeballs),
-			NoTLSVerify:            cloudflare.F(ingress.OriginRequest.NoTLSVerify),
-			OriginServerName:       cloudflare.F(ingress.OriginRequest.OriginServerName),
-			ProxyType:              cloudflare.F(ingress.OriginRequest.ProxyType),
-			TCPKeepAlive:           cloudflare.F(ingress.OriginRequest.TCPKeepAlive),
-			TLSTimeout:             cloudflare.F(ingress.OriginRequest.TLSTimeout),
-		}),
-		Path: cloudflare.String(ingress.Path),
-	}
-
-	return newIngressRule
+func logChangeSet(logger logr.Logger, changes *ChangeSet) {
+	logger.Info("Tunnel configuration changed", "added", len(changes.Added), "updated", len(changes.Updated), "removed", len(changes.Removed), "reordered", changes.Reordered)
+
+	for _, r := range changes.Added {
+		logger.V(1).Info("Adding tunnel ingress rule", "hostname", r.Hostname, "path", r.Path, "service", r.Service)
+	}
+	for _, u := range changes.Updated {
+		if u.Drift {
+			logger.Info("Reverting tunnel ingress rule changed outside of the controller", "hostname", u.Desired.Hostname, "path", u.Desired.Path, "fields", u.Fields)
+			continue
+		}
+		logger.V(1).Info("Updating tunnel ingress rule", "hostname", u.Desired.Hostname, "path", u.Desired.Path, "fields", u.Fields)
+	}
+	for _, r := range changes.Removed {
+		logger.V(1).Info("Removing tunnel ingress rule", "hostname", r.Hostname, "path", r.Path, "service", r.Service)
+	}
+}
+
+func (c *Client) isInZone(hostname string, zoneName string) bool {
+	return (hostname == zoneName) || strings.HasSuffix(hostname, "."+zoneName)
+}
+
+func ingressRecordToUpdateParams(ingress *IngressRecord) zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress {
+	origin := &ingress.OriginRequest
+
+	originRequest := zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngressOriginRequest{
+		CAPool:                 cloudflare.F(origin.CAPool),
+		ConnectTimeout:         cloudflare.F(origin.ConnectTimeout),
+		DisableChunkedEncoding: cloudflare.F(origin.DisableChunkedEncoding),
+		HTTP2Origin:            cloudflare.F(origin.HTTP2Origin),
+		HTTPHostHeader:         cloudflare.F(origin.HTTPHostHeader),
+		KeepAliveConnections:   cloudflare.F(origin.KeepAliveConnections),
+		KeepAliveTimeout:       cloudflare.F(origin.KeepAliveTimeout),
+		MatchSnItoHost:         cloudflare.F(origin.MatchSnItoHost),
+		NoHappyEyeballs:        cloudflare.F(origin.NoHappyEyeballs),
+		NoTLSVerify:            cloudflare.F(origin.NoTLSVerify),
+		OriginServerName:       cloudflare.F(origin.OriginServerName),
+		ProxyType:              cloudflare.F(origin.ProxyType),
+		TCPKeepAlive:           cloudflare.F(origin.TCPKeepAlive),
+		TLSTimeout:             cloudflare.F(origin.TLSTimeout),
+	}
+
+	// Only send the Access section when configured, teamName and audTag are required by the API
+	if origin.Access.Required || origin.Access.TeamName != "" || len(origin.Access.AUDTag) > 0 {
+		originRequest.Access = cloudflare.F(zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngressOriginRequestAccess{
+			AUDTag:   cloudflare.F(origin.Access.AUDTag),
+			TeamName: cloudflare.F(origin.Access.TeamName),
+			Required: cloudflare.F(origin.Access.Required),
+		})
+	}
+
+	return zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress{
+		Hostname:      cloudflare.String(ingress.Hostname),
+		Service:       cloudflare.String(ingress.Service),
+		OriginRequest: cloudflare.F(originRequest),
+		Path:          cloudflare.String(ingress.Path),
+	}
 }
 
 func (c *Client) getDnsZoneMap(ctx context.Context, logger logr.Logger) (map[string]string, error) {
+	if result, ok := c.zoneCache.get(c.accountID); ok {
+		return result, nil
+	}
+
 	// get the zone id
 	result := make(map[string]string)
 
-	zones := c.cloudflareAPI.Zones.ListAutoPaging(ctx, zones.ZoneListParams{
-		Account: cloudflare.F(zones.ZoneListParamsAccount{
-			ID: cloudflare.String(c.accountID),
-		}),
+	zoneList, err := listAll(func(page, perPage int64) (*pagination.V4PagePaginationArray[zones.Zone], error) {
+		return call(ctx, c, "zones.list", func() (*pagination.V4PagePaginationArray[zones.Zone], error) {
+			return c.cloudflareAPI.Zones.List(ctx, zones.ZoneListParams{
+				Account: cloudflare.F(zones.ZoneListParamsAccount{
+					ID: cloudflare.String(c.accountID),
+				}),
+				Page:    cloudflare.F(float64(page)),
+				PerPage: cloudflare.F(float64(perPage)),
+			})
+		})
 	})
-	for zones.Next() {
-		zone := zones.Current()
-		result[zone.Name] = zone.ID
-	}
-	if err := zones.Err(); err != nil {
+	if err != nil {
 		logger.Error(err, "Failed to list zones")
 		return nil, err
 	}
+	for _, zone := range zoneList {
+		result[zone.Name] = zone.ID
+	}
 
+	c.zoneCache.set(c.accountID, result)
 	return result, nil
 }
 
-func (c *Client) createDNSRecords(ctx context.Context, logger logr.Logger, zoneID string, hostnames []string) error {
-	logger.Info("Creating new DNS record")
-
-	truth := true
+// getAccessApplicationDomains returns the domains of the Access applications of the account.
+func (c *Client) getAccessApplicationDomains(ctx context.Context, logger logr.Logger) (map[string]struct{}, error) {
+	if domains, ok := c.accessAppCache.get(c.accountID); ok {
+		return domains, nil
+	}
 
-	// create the DNS records
-	for _, hostname := range hostnames {
-		_, err := c.cloudflareAPI.DNS.Records.New(ctx, dns.RecordNewParams{
-			ZoneID: cloudflare.String(zoneID),
-			Body: dns.CNAMERecordParam{
-				Proxied: cloudflare.Bool(truth),
-				Type:    cloudflare.F(dns.CNAMERecordTypeCNAME),
-				Name:    cloudflare.String(hostname),
-				Content: cloudflare.String(c.tunnelID + "." + tunnelDomain),
-				Comment: cloudflare.String("Automatically created by Cloudflare Tunnel Ingress Controller"),
-			},
+	apps, err := listAll(func(page, perPage int64) (*pagination.V4PagePaginationArray[zero_trust.AccessApplicationListResponse], error) {
+		return call(ctx, c, "access.applications.list", func() (*pagination.V4PagePaginationArray[zero_trust.AccessApplicationListResponse], error) {
+			return c.cloudflareAPI.AccessApplications.List(ctx, zero_trust.AccessApplicationListParams{
+				AccountID: cloudflare.F(c.accountID),
+				Page:      cloudflare.F(page),
+				PerPage:   cloudflare.F(perPage),
+			})
 		})
-		if err != nil {
-			cfErr := &cloudflare.Error{}
-			if errors.As(err, &cfErr) {
-				for _, e := range cfErr.Errors {
-					if e.Code != 81053 {
-						logger.Error(err, "Failed to create DNS record")
-						return err
-					}
-				}
-				// 81053: "Record already exists"
-				continue
-			}
-
-			logger.Error(err, "Failed to create DNS record")
-			return err
-		}
+	})
+	if err != nil {
+		logger.Error(err, "Failed to list Access Applications")
+		return nil, err
 	}
-
-	return nil
-}
-
-func (c *Client) flush404IfLast(tunnelConfig *zero_trust.TunnelCloudflaredConfigurationGetResponseConfig) {
-	if len(tunnelConfig.Ingress) == 1 && tunnelConfig.Ingress[0].Service == "http_status:404" {
-		tunnelConfig.Ingress = make([]zero_trust.TunnelCloudflaredConfigurationGetResponseConfigIngress, 0)
+	domains := make(map[string]struct{}, len(apps))
+	for _, app := range apps {
+		domains[app.Domain] = dummy
 	}
+
+	c.accessAppCache.set(c.accountID, domains)
+	return domains, nil
 }
 
 func (c *Client) ensureAccessApplication(ctx context.Context, logger logr.Logger, domain, app_name string, zone_map map[string]string) error {
-	ch := c.cloudflareAPI.ZeroTrust.Access.Applications.ListAutoPaging(ctx, zero_trust.AccessApplicationListParams{
-		AccountID: cloudflare.F(c.accountID),
-	})
-	for ch.Next() {
-		app := ch.Current()
-		if app.Domain == domain {
-			return nil
-		}
-	}
-	if err := ch.Err(); err != nil {
-		logger.Error(err, "Failed to list Access Applications")
+	domains, err := c.getAccessApplicationDomains(ctx, logger)
+	if err != nil {
 		return err
 	}
+	if _, ok := domains[domain]; ok {
+		return nil
+	}
 
-	var zone_id string
-	for zoneName, zoneID := range zone_map {
+	// The application is created on the account, which is where it is listed from, but its domain has to belong
+	// to one of the account's zones
+	inZone := false
+	for zoneName := range zone_map {
 		if c.isInZone(domain, zoneName) {
-			zone_id = zoneID
+			inZone = true
 		}
 	}
 
-	if len(zone_id) == 0 {
+	if !inZone {
 		return fmt.Errorf("failed to find zone ID for Access application: %s", domain)
 	}
 
-	_, err := c.cloudflareAPI.ZeroTrust.Access.Applications.New(ctx, zero_trust.AccessApplicationNewParams{
-		AccountID: cloudflare.F(c.accountID),
-		Body: zero_trust.AccessApplicationNewParamsBodySelfHostedApplication{
-			Name:   cloudflare.String(app_name),
-			Domain: cloudflare.String(domain),
-			Type:   cloudflare.F(zero_trust.ApplicationTypeSelfHosted),
-		},
-		ZoneID: cloudflare.F(zone_id),
+	c.accessAppCache.invalidate(c.accountID)
+
+	_, err = create(ctx, c, "access.applications.new", func() (*zero_trust.AccessApplicationNewResponse, error) {
+		return c.cloudflareAPI.AccessApplications.New(ctx, zero_trust.AccessApplicationNewParams{
+			AccountID: cloudflare.F(c.accountID),
+			Body: zero_trust.AccessApplicationNewParamsBodySelfHostedApplication{
+				Name:   cloudflare.String(app_name),
+				Domain: cloudflare.String(domain),
+				Type:   cloudflare.F(zero_trust.ApplicationTypeSelfHosted),
+			},
+		})
 	})
 	return err
 }
@@ -0,0 +1,528 @@
+package tunnel_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel"
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel/fake"
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/dns"
+	"github.com/cloudflare/cloudflare-go/v6/zero_trust"
+	"github.com/go-logr/logr"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const testAccountID = "account"
+const testTunnelName = "test-tunnel"
+
+func newFakeClient(t *testing.T, f *fake.Cloudflare) *tunnel.Client {
+	t.Helper()
+
+	c := tunnel.NewClient(&tunnel.CloudflareAPI{
+		Tunnels:              f.Tunnels,
+		CloudflaredTunnels:   f.CloudflaredTunnels,
+		TunnelTokens:         f.TunnelTokens,
+		TunnelConnections:    f.TunnelConnections,
+		TunnelConfigurations: f.TunnelConfigurations,
+		Zones:                f.Zones,
+		DNSRecords:           f.DNSRecords,
+		AccessApplications:   f.AccessApplications,
+	}, testAccountID, testTunnelName, "owner", logr.Discard())
+	c.SetCacheTTL(0)
+
+	if err := c.EnsureTunnelExists(context.Background(), logr.Discard()); err != nil {
+		t.Fatalf("failed to ensure tunnel exists: %v", err)
+	}
+	return c
+}
+
+func newConfig(hostnames ...string) *tunnel.Config {
+	records := make(tunnel.IngressRecords, 0, len(hostnames))
+	paths := make(map[*tunnel.IngressRecord]tunnel.RulePath, len(hostnames))
+	for _, hostname := range hostnames {
+		record := &tunnel.IngressRecord{Hostname: hostname, Path: "^/", Service: "http://app.default:80"}
+		records = append(records, record)
+		paths[record] = tunnel.RulePath{Path: "/", PathType: networkingv1.PathTypePrefix}
+	}
+	return &tunnel.Config{
+		Ingresses: map[types.UID]*tunnel.IngressRecords{
+			"uid-app": &records,
+		},
+		IngressDNS: map[types.UID]*tunnel.IngressDNSConfig{
+			"uid-app": tunnel.NewIngressDNSConfig("ingress/default/app"),
+		},
+		RulePaths:         paths,
+		AccessAppRequests: map[string]string{},
+	}
+}
+
+// memoryOwnershipStore keeps the rule ownership like the ConfigMap of the controller.
+type memoryOwnershipStore struct {
+	keys    []tunnel.RuleKey
+	adopted bool
+}
+
+func (s *memoryOwnershipStore) LoadManagedRules(context.Context) ([]tunnel.RuleKey, error) {
+	return s.keys, nil
+}
+
+func (s *memoryOwnershipStore) SaveManagedRules(_ context.Context, keys []tunnel.RuleKey) error {
+	s.keys = keys
+	return nil
+}
+
+func (s *memoryOwnershipStore) LoadRulesAdopted(context.Context) (bool, error) {
+	return s.adopted, nil
+}
+
+func (s *memoryOwnershipStore) SaveRulesAdopted(context.Context) error {
+	s.adopted = true
+	return nil
+}
+
+func TestEnsureTunnelExists_FindsTunnelAcrossPages(t *testing.T) {
+	f := fake.New()
+	f.MaxPerPage = 2
+	for range 4 {
+		f.AddTunnel("other", false)
+	}
+	f.AddTunnel(testTunnelName, true)
+	id := f.AddTunnel(testTunnelName, false)
+
+	newFakeClient(t, f)
+
+	if f.Calls(fake.OpTunnelsNew) != 0 {
+		t.Error("expected the existing tunnel to be used")
+	}
+	// 3 full pages and the empty one ending the listing
+	if f.Calls(fake.OpTunnelsList) != 4 {
+		t.Errorf("expected 4 pages to be listed, got %d", f.Calls(fake.OpTunnelsList))
+	}
+	if f.TunnelIngress(id) != nil {
+		t.Error("expected no configuration yet")
+	}
+}
+
+func TestEnsureTunnelExists_CreatesTunnel(t *testing.T) {
+	f := fake.New()
+	f.AddTunnel(testTunnelName, true)
+
+	c := newFakeClient(t, f)
+
+	if f.Calls(fake.OpTunnelsNew) != 1 {
+		t.Errorf("expected a tunnel to be created, got %d calls", f.Calls(fake.OpTunnelsNew))
+	}
+	token, err := c.GetTunnelToken(context.Background())
+	if err != nil || token == "" {
+		t.Errorf("expected tunnel token, got %q, %v", token, err)
+	}
+}
+
+func TestEnsureTunnelExists_LostResponse(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	unavailable := fake.APIError(http.MethodPost, http.StatusServiceUnavailable, 10000, "Service unavailable")
+	f.InjectLostResponse(fake.OpTunnelsNew, unavailable)
+
+	c := tunnel.NewClient(&tunnel.CloudflareAPI{
+		Tunnels:            f.Tunnels,
+		CloudflaredTunnels: f.CloudflaredTunnels,
+	}, testAccountID, testTunnelName, "owner", logr.Discard())
+
+	if err := c.EnsureTunnelExists(ctx, logr.Discard()); err == nil {
+		t.Fatal("expected the lost response to fail")
+	}
+	if err := c.EnsureTunnelExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if f.Calls(fake.OpTunnelsNew) != 1 {
+		t.Errorf("expected the tunnel created by the lost request to be found, got %d creations", f.Calls(fake.OpTunnelsNew))
+	}
+}
+
+func TestRotateTunnelSecret(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	f.AddTunnel(testTunnelName, false)
+
+	c := newFakeClient(t, f)
+
+	previous, err := c.GetTunnelToken(ctx)
+	if err != nil {
+		t.Fatalf("failed to get tunnel token: %v", err)
+	}
+
+	f.InjectError(fake.OpTunnelsEdit, fake.APIError(http.MethodPatch, http.StatusForbidden, 10000, "Authentication error"))
+	if _, err := c.RotateTunnelSecret(ctx, logr.Discard()); err == nil {
+		t.Fatal("expected the rotation to fail")
+	}
+	if token, _ := c.GetTunnelToken(ctx); token != previous {
+		t.Errorf("expected the token to be kept after a failed rotation, got %q", token)
+	}
+
+	rotated, err := c.RotateTunnelSecret(ctx, logr.Discard())
+	if err != nil {
+		t.Fatalf("failed to rotate the tunnel secret: %v", err)
+	}
+	if rotated == previous {
+		t.Error("expected a new token")
+	}
+	if token, _ := c.GetTunnelToken(ctx); token != rotated {
+		t.Errorf("expected the rotated token to be cached, got %q", token)
+	}
+}
+
+func TestRotateTunnelSecret_RetriesWithoutLock(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	f.AddTunnel(testTunnelName, false)
+	c := newFakeClient(t, f)
+
+	previous, err := c.GetTunnelToken(ctx)
+	if err != nil {
+		t.Fatalf("failed to get tunnel token: %v", err)
+	}
+
+	// retried after the backoff delay of a second
+	f.InjectError(fake.OpTunnelsEdit, fake.APIError(http.MethodPatch, http.StatusServiceUnavailable, 10000, "Service unavailable"))
+	rotated := make(chan error, 1)
+	go func() {
+		_, err := c.RotateTunnelSecret(ctx, logr.Discard())
+		rotated <- err
+	}()
+	for f.Calls(fake.OpTunnelsEdit) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	tokens := make(chan string, 1)
+	go func() {
+		token, _ := c.GetTunnelToken(ctx)
+		tokens <- token
+	}()
+	select {
+	case token := <-tokens:
+		if token != previous {
+			t.Errorf("expected the previous token while the rotation is retried, got %q", token)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Error("expected the token to be read while the rotation is retried")
+	}
+	if err := <-rotated; err != nil {
+		t.Fatalf("failed to rotate the tunnel secret: %v", err)
+	}
+}
+
+func TestListConnectors(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	tunnelID := f.AddTunnel(testTunnelName, false)
+	active := f.AddConnector(tunnelID, "2026.6.0")
+	disconnected := f.AddConnector(tunnelID, "2026.5.0")
+	f.DisconnectConnector(tunnelID, disconnected)
+
+	c := newFakeClient(t, f)
+
+	connectors, err := c.ListConnectors(ctx)
+	if err != nil {
+		t.Fatalf("failed to list connectors: %v", err)
+	}
+	if len(connectors) != 2 {
+		t.Fatalf("expected 2 connectors, got %d", len(connectors))
+	}
+	for _, connector := range connectors {
+		switch connector.ID {
+		case active:
+			if !connector.Active() || connector.Version != "2026.6.0" || connector.Connections[0].ColoName == "" {
+				t.Errorf("unexpected active connector %+v", connector)
+			}
+		case disconnected:
+			if connector.Active() {
+				t.Errorf("expected the disconnected connector to be inactive, got %+v", connector)
+			}
+		default:
+			t.Errorf("unexpected connector %q", connector.ID)
+		}
+	}
+}
+
+func TestEnsureTunnelConfiguration_CreateUpdateDelete(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	tunnelID := f.AddTunnel(testTunnelName, false)
+	zoneID := f.AddZone("example.com")
+	f.AddRecord(zoneID, "A", "unrelated.example.com", "192.0.2.1")
+	c := newFakeClient(t, f)
+
+	// create
+	config := newConfig("app.example.com", "api.example.com")
+	result, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.DNSConflicts) != 0 || len(result.DNSFailures) != 0 {
+		t.Errorf("expected no conflicts or failures, got %+v", result)
+	}
+
+	rules := f.TunnelIngress(tunnelID)
+	if len(rules) != 3 || rules[0].Hostname != "api.example.com" || rules[1].Hostname != "app.example.com" || rules[2].Service != "http_status:404" {
+		t.Fatalf("unexpected tunnel ingress rules %+v", rules)
+	}
+	for _, hostname := range []string{"app.example.com", "api.example.com"} {
+		cname, ok := f.Record(zoneID, dns.RecordResponseTypeCNAME, hostname)
+		if !ok || cname.Content != tunnelID+".cfargotunnel.com" || !cname.Proxied {
+			t.Errorf("expected proxied CNAME to the tunnel for %s, got %+v", hostname, cname)
+		}
+		if _, ok := f.Record(zoneID, dns.RecordResponseTypeTXT, "_tunnel-owner."+hostname); !ok {
+			t.Errorf("expected ownership record for %s", hostname)
+		}
+	}
+	if f.Calls(fake.OpDNSRecordsBatch) != 1 {
+		t.Errorf("expected a single DNS batch, got %d", f.Calls(fake.OpDNSRecordsBatch))
+	}
+
+	// no changes
+	_, err = c.EnsureTunnelConfiguration(ctx, logr.Discard(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.Calls(fake.OpTunnelConfigurationsUpdate) != 1 || f.Calls(fake.OpDNSRecordsBatch) != 1 {
+		t.Error("expected nothing to be written without changes")
+	}
+
+	// update
+	(*config.Ingresses["uid-app"])[0].Service = "http://app.default:8080"
+	config.IngressDNS["uid-app"].Proxied = false
+	config.IngressDNS["uid-app"].TTL = 300
+	_, err = c.EnsureTunnelConfiguration(ctx, logr.Discard(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rules = f.TunnelIngress(tunnelID)
+	if rules[1].Service != "http://app.default:8080" {
+		t.Errorf("expected service to be updated, got %q", rules[1].Service)
+	}
+	if cname, _ := f.Record(zoneID, dns.RecordResponseTypeCNAME, "app.example.com"); cname.Proxied || cname.TTL != 300 {
+		t.Errorf("expected record settings to be updated, got proxied=%v ttl=%v", cname.Proxied, cname.TTL)
+	}
+
+	// delete
+	removed := config.Ingresses["uid-app"]
+	delete(config.Ingresses, "uid-app")
+	delete(config.IngressDNS, "uid-app")
+	err = c.DeleteFromTunnelConfiguration(ctx, logr.Discard(), config, removed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rules := f.TunnelIngress(tunnelID); len(rules) != 0 {
+		t.Errorf("expected tunnel ingress rules to be removed, got %+v", rules)
+	}
+	records := f.Records(zoneID)
+	if len(records) != 1 || records[0].Name != "unrelated.example.com" {
+		t.Errorf("expected only the unrelated record to remain, got %+v", records)
+	}
+}
+
+func TestEnsureTunnelConfiguration_SharedRule(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	tunnelID := f.AddTunnel(testTunnelName, false)
+	f.AddZone("example.com")
+	c := newFakeClient(t, f)
+
+	config := newConfig("app.example.com")
+	other := tunnel.IngressRecords{{Hostname: "app.example.com", Path: "^/", Service: "http://other.default:80"}}
+	config.Ingresses["uid-other"] = &other
+
+	for range 2 {
+		if _, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), config); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	rules := f.TunnelIngress(tunnelID)
+	if len(rules) != 2 || rules[0].Service != "http://app.default:80" {
+		t.Errorf("expected the rule of the lowest UID only, got %+v", rules)
+	}
+	if f.Calls(fake.OpTunnelConfigurationsUpdate) != 1 {
+		t.Errorf("expected a single configuration update, got %d", f.Calls(fake.OpTunnelConfigurationsUpdate))
+	}
+}
+
+func TestEnsureTunnelConfiguration_AdoptsRulesOfPreviousVersion(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	tunnelID := f.AddTunnel(testTunnelName, false)
+	f.AddZone("example.com")
+
+	// as written by the versions without ownership tracking, with the raw Ingress path, next to rules made by hand
+	_, err := f.TunnelConfigurations.Update(ctx, tunnelID, zero_trust.TunnelCloudflaredConfigurationUpdateParams{
+		Config: cloudflare.F(zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfig{
+			Ingress: cloudflare.F([]zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress{
+				{Hostname: cloudflare.F("app.example.com"), Path: cloudflare.F("/admin"), Service: cloudflare.F("http://10.0.0.2:80")},
+				{Hostname: cloudflare.F("app.example.com"), Path: cloudflare.F("/"), Service: cloudflare.F("http://app.default:80")},
+				{Hostname: cloudflare.F("dashboard.example.com"), Service: cloudflare.F("http://10.0.0.1:80")},
+				{Service: cloudflare.F("http_status:404")},
+			}),
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to write the tunnel configuration: %v", err)
+	}
+	c := newFakeClient(t, f)
+	store := &memoryOwnershipStore{}
+	c.SetRuleOwnershipStore(store)
+
+	config := newConfig("app.example.com")
+	for range 2 {
+		if _, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), config); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	rules := f.TunnelIngress(tunnelID)
+	if len(rules) != 4 || rules[0].Path != "/admin" || rules[1].Hostname != "app.example.com" || rules[1].Path != "^/" || rules[2].Hostname != "dashboard.example.com" {
+		t.Errorf("expected the previous rule to be replaced and the rules made by hand kept, got %+v", rules)
+	}
+	if f.Calls(fake.OpTunnelConfigurationsUpdate) != 2 {
+		t.Errorf("expected a single configuration update, got %d", f.Calls(fake.OpTunnelConfigurationsUpdate)-1)
+	}
+	if !store.adopted {
+		t.Error("expected the adoption to be recorded")
+	}
+
+	// a rule looking like one of a previous version is made by hand once the rules were adopted
+	_, err = f.TunnelConfigurations.Update(ctx, tunnelID, zero_trust.TunnelCloudflaredConfigurationUpdateParams{
+		Config: cloudflare.F(zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfig{
+			Ingress: cloudflare.F([]zero_trust.TunnelCloudflaredConfigurationUpdateParamsConfigIngress{
+				{Hostname: cloudflare.F("app.example.com"), Path: cloudflare.F("^/"), Service: cloudflare.F("http://app.default:80")},
+				{Hostname: cloudflare.F("other.example.com"), Path: cloudflare.F("/"), Service: cloudflare.F("http://app.default:80")},
+				{Service: cloudflare.F("http_status:404")},
+			}),
+		}),
+	})
+	if err != nil {
+		t.Fatalf("failed to write the tunnel configuration: %v", err)
+	}
+	c = newFakeClient(t, f)
+	c.SetRuleOwnershipStore(store)
+
+	if _, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), newConfig("app.example.com", "other.example.com")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rules = f.TunnelIngress(tunnelID)
+	if len(rules) != 4 || rules[2].Hostname != "other.example.com" || rules[2].Path != "/" {
+		t.Errorf("expected the rule made by hand kept, got %+v", rules)
+	}
+}
+
+func TestEnsureTunnelConfiguration_DNSConflict(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	f.AddTunnel(testTunnelName, false)
+	zoneID := f.AddZone("example.com")
+	f.AddRecord(zoneID, "A", "app.example.com", "192.0.2.1")
+	c := newFakeClient(t, f)
+
+	result, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), newConfig("app.example.com", "api.example.com"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := result.DNSConflicts["app.example.com"]; !ok || len(result.DNSConflicts) != 1 {
+		t.Errorf("expected a conflict for app.example.com, got %+v", result.DNSConflicts)
+	}
+	if r, ok := f.Record(zoneID, dns.RecordResponseTypeA, "app.example.com"); !ok || r.Content != "192.0.2.1" {
+		t.Error("expected the conflicting record to be left untouched")
+	}
+	if _, ok := f.Record(zoneID, dns.RecordResponseTypeCNAME, "api.example.com"); !ok {
+		t.Error("expected the other hostname to get its record")
+	}
+}
+
+func TestEnsureTunnelConfiguration_BatchFallback(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	tunnelID := f.AddTunnel(testTunnelName, false)
+	zoneID := f.AddZone("example.com")
+	c := newFakeClient(t, f)
+
+	f.InjectError(fake.OpDNSRecordsBatch, fake.APIError(http.MethodPost, http.StatusBadRequest, 1004, "DNS Validation Error"))
+	f.InjectError(fake.OpDNSRecordsNew, fake.APIError(http.MethodPost, http.StatusBadRequest, 9005, "Content for CNAME record is invalid."))
+
+	result, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), newConfig("app.example.com", "api.example.com"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// api.example.com is the first hostname, its CNAME fails and its ownership record is skipped
+	if _, ok := result.DNSFailures["api.example.com"]; !ok || len(result.DNSFailures) != 1 {
+		t.Errorf("expected a failure for api.example.com, got %+v", result.DNSFailures)
+	}
+	if _, ok := f.Record(zoneID, dns.RecordResponseTypeTXT, "_tunnel-owner.api.example.com"); ok {
+		t.Error("expected no ownership record for the failed hostname")
+	}
+	if cname, ok := f.Record(zoneID, dns.RecordResponseTypeCNAME, "app.example.com"); !ok || cname.Content != tunnelID+".cfargotunnel.com" {
+		t.Error("expected the other hostname to be created one record at a time")
+	}
+}
+
+func TestEnsureTunnelConfiguration_LostBatchResponse(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	f.AddTunnel(testTunnelName, false)
+	zoneID := f.AddZone("example.com")
+	c := newFakeClient(t, f)
+
+	unavailable := fake.APIError(http.MethodPost, http.StatusServiceUnavailable, 10000, "Service unavailable")
+	f.InjectLostResponse(fake.OpDNSRecordsBatch, unavailable)
+
+	config := newConfig("app.example.com")
+	result, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := result.DNSFailures["app.example.com"]; !ok {
+		t.Errorf("expected a failure for app.example.com, got %+v", result.DNSFailures)
+	}
+	if f.Calls(fake.OpDNSRecordsBatch) != 1 || f.Calls(fake.OpDNSRecordsNew) != 0 {
+		t.Errorf("expected the batch not to be retried, got %d batches and %d creations", f.Calls(fake.OpDNSRecordsBatch), f.Calls(fake.OpDNSRecordsNew))
+	}
+
+	result, err = c.EnsureTunnelConfiguration(ctx, logr.Discard(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.DNSFailures) != 0 {
+		t.Errorf("expected no failure, got %+v", result.DNSFailures)
+	}
+	if f.Calls(fake.OpDNSRecordsBatch) != 1 || len(f.Records(zoneID)) != 2 {
+		t.Errorf("expected the records written by the lost batch to be found, got %d batches and records %+v", f.Calls(fake.OpDNSRecordsBatch), f.Records(zoneID))
+	}
+}
+
+func TestEnsureTunnelConfiguration_AccessApplication(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	f.AddTunnel(testTunnelName, false)
+	f.AddZone("example.com")
+	c := newFakeClient(t, f)
+
+	config := newConfig("app.example.com")
+	config.AccessAppRequests["app.example.com"] = "App"
+
+	for range 2 {
+		if _, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), config); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	domains := f.AccessApplicationDomains()
+	if len(domains) != 1 || domains[0] != "app.example.com" {
+		t.Errorf("expected a single Access application, got %v", domains)
+	}
+}
@@ -0,0 +1,167 @@
+package tunnel_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel"
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel/fake"
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/dns"
+	"github.com/cloudflare/cloudflare-go/v6/option"
+	"github.com/go-logr/logr"
+)
+
+// newServerClient returns a client using cloudflare-go against the fake served over HTTP, so requests and
+// responses go through the real serialization of the SDK. Like in the controller, the client retries instead of
+// the SDK.
+func newServerClient(t *testing.T, f *fake.Cloudflare) *tunnel.Client {
+	t.Helper()
+
+	server := fake.NewServer(f)
+	t.Cleanup(server.Close)
+
+	cloudflareAPI := cloudflare.NewClient(
+		option.WithBaseURL(fake.BaseURL(server)),
+		option.WithAPIToken("token"),
+		option.WithMaxRetries(0),
+	)
+	c := tunnel.NewClient(tunnel.NewCloudflareAPI(cloudflareAPI), testAccountID, testTunnelName, "owner", logr.Discard())
+	c.SetCacheTTL(0)
+
+	if err := c.EnsureTunnelExists(context.Background(), logr.Discard()); err != nil {
+		t.Fatalf("failed to ensure tunnel exists: %v", err)
+	}
+	return c
+}
+
+// serverError returns a server error to be retried right away.
+func serverError(method string, statusCode int) *cloudflare.Error {
+	err := fake.APIError(method, statusCode, 10000, http.StatusText(statusCode))
+	err.Response.Header.Set("Retry-After", "0")
+	return err
+}
+
+func TestServer_EnsureTunnelConfiguration(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	f.MaxPerPage = 2
+	for range 3 {
+		f.AddTunnel("other", false)
+	}
+	tunnelID := f.AddTunnel(testTunnelName, false)
+	f.AddZone("example.org")
+	f.AddZone("example.net")
+	zoneID := f.AddZone("example.com")
+	f.AddRecord(zoneID, "A", "unrelated.example.com", "192.0.2.1")
+	c := newServerClient(t, f)
+
+	if f.Calls(fake.OpTunnelsNew) != 0 {
+		t.Error("expected the existing tunnel to be used")
+	}
+	token, err := c.GetTunnelToken(ctx)
+	if err != nil || token != "token-"+tunnelID {
+		t.Errorf("expected tunnel token, got %q, %v", token, err)
+	}
+
+	config := newConfig("app.example.com", "api.example.com")
+	config.AccessAppRequests["app.example.com"] = "App"
+	result, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.DNSConflicts) != 0 || len(result.DNSFailures) != 0 {
+		t.Errorf("expected no conflicts or failures, got %+v", result)
+	}
+
+	rules := f.TunnelIngress(tunnelID)
+	if len(rules) != 3 || rules[0].Hostname != "api.example.com" || rules[1].Hostname != "app.example.com" || rules[2].Service != "http_status:404" {
+		t.Fatalf("unexpected tunnel ingress rules %+v", rules)
+	}
+	for _, hostname := range []string{"app.example.com", "api.example.com"} {
+		cname, ok := f.Record(zoneID, dns.RecordResponseTypeCNAME, hostname)
+		if !ok || cname.Content != tunnelID+".cfargotunnel.com" || !cname.Proxied || cname.Comment != tunnel.DefaultDNSRecordComment {
+			t.Errorf("expected proxied CNAME to the tunnel for %s, got %+v", hostname, cname)
+		}
+		if _, ok := f.Record(zoneID, dns.RecordResponseTypeTXT, "_tunnel-owner."+hostname); !ok {
+			t.Errorf("expected ownership record for %s", hostname)
+		}
+	}
+	if domains := f.AccessApplicationDomains(); len(domains) != 1 || domains[0] != "app.example.com" {
+		t.Errorf("expected a single Access application, got %v", domains)
+	}
+
+	// Everything read back from the API matches
+	_, err = c.EnsureTunnelConfiguration(ctx, logr.Discard(), config)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.Calls(fake.OpTunnelConfigurationsUpdate) != 1 || f.Calls(fake.OpDNSRecordsBatch) != 1 || f.Calls(fake.OpAccessApplicationsNew) != 1 {
+		t.Error("expected nothing to be written without changes")
+	}
+
+	removed := config.Ingresses["uid-app"]
+	delete(config.Ingresses, "uid-app")
+	delete(config.IngressDNS, "uid-app")
+	err = c.DeleteFromTunnelConfiguration(ctx, logr.Discard(), config, removed)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	records := f.Records(zoneID)
+	if len(records) != 1 || records[0].Name != "unrelated.example.com" {
+		t.Errorf("expected only the unrelated record to remain, got %+v", records)
+	}
+}
+
+func TestServer_RetriesRateLimitedRequests(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	tunnelID := f.AddTunnel(testTunnelName, false)
+	f.AddZone("example.com")
+	c := newServerClient(t, f)
+
+	f.InjectError(fake.OpTunnelConfigurationsGet, fake.RateLimitError(http.MethodGet, 0))
+	f.InjectError(fake.OpTunnelConfigurationsUpdate, serverError(http.MethodPut, http.StatusInternalServerError))
+	f.InjectError(fake.OpTunnelConfigurationsUpdate, serverError(http.MethodPut, http.StatusBadGateway))
+
+	if _, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), newConfig("app.example.com")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if f.Calls(fake.OpTunnelConfigurationsGet) != 2 || f.Calls(fake.OpTunnelConfigurationsUpdate) != 3 {
+		t.Errorf("expected the failed requests to be retried, got %d gets and %d updates", f.Calls(fake.OpTunnelConfigurationsGet), f.Calls(fake.OpTunnelConfigurationsUpdate))
+	}
+	if rules := f.TunnelIngress(tunnelID); len(rules) != 2 {
+		t.Errorf("expected the configuration to be updated, got %+v", rules)
+	}
+}
+
+func TestServer_ReturnsPersistentErrors(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	f.AddTunnel(testTunnelName, false)
+	f.AddZone("example.com")
+	c := newServerClient(t, f)
+
+	f.InjectError(fake.OpTunnelConfigurationsUpdate, fake.APIError(http.MethodPut, http.StatusForbidden, 10000, "Authentication error"))
+	_, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), newConfig("app.example.com"))
+	var apiErr *cloudflare.Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden || !tunnel.IsPermanentError(err) {
+		t.Fatalf("expected permanent authentication error, got %v", err)
+	}
+	if f.Calls(fake.OpTunnelConfigurationsUpdate) != 1 {
+		t.Errorf("expected no retries, got %d updates", f.Calls(fake.OpTunnelConfigurationsUpdate))
+	}
+
+	for range 5 {
+		f.InjectError(fake.OpTunnelConfigurationsUpdate, fake.RateLimitError(http.MethodPut, 0))
+	}
+	_, err = c.EnsureTunnelConfiguration(ctx, logr.Discard(), newConfig("app.example.com"))
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || tunnel.IsPermanentError(err) {
+		t.Fatalf("expected rate limit error, got %v", err)
+	}
+	if f.Calls(fake.OpTunnelConfigurationsUpdate) != 6 {
+		t.Errorf("expected the request to be attempted 5 times, got %d updates", f.Calls(fake.OpTunnelConfigurationsUpdate)-1)
+	}
+}
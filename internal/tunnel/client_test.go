@@ -2,6 +2,8 @@ package tunnel
 
 import (
 	"testing"
+
+	"k8s.io/apimachinery/pkg/types"
 )
 
 func TestIsInZone(t *testing.T) {
@@ -63,3 +65,28 @@ func TestKubernetesApiTunnelConfig_GetService(t *testing.T) {
 		t.Errorf("expected %q, got %q", expected, config.GetService())
 	}
 }
+
+func TestDesiredIngressRules_SharedRule(t *testing.T) {
+	c := &Client{}
+	config := &Config{
+		Ingresses: map[types.UID]*IngressRecords{
+			"uid-b": {{Hostname: "app.example.com", Path: "/", Service: "http://other.default:80"}},
+			"uid-a": {
+				{Hostname: "app.example.com", Path: "/", Service: "http://app.default:80"},
+				{Hostname: "api.example.com", Service: "http://api.default:80"},
+			},
+		},
+	}
+
+	for range 10 {
+		rules := c.desiredIngressRules(config)
+		if len(rules) != 2 {
+			t.Fatalf("expected the shared rule once, got %d rules", len(rules))
+		}
+		for _, r := range rules {
+			if r.Hostname == "app.example.com" && r.Service != "http://app.default:80" {
+				t.Errorf("expected the rule of the lowest UID, got %q", r.Service)
+			}
+		}
+	}
+}
@@ -3,7 +3,9 @@ package tunnel
 import (
 	"fmt"
 
+	"github.com/cloudflare/cloudflare-go/v6/dns"
 	"github.com/cloudflare/cloudflare-go/v6/zero_trust"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/types"
 )
 
@@ -12,6 +14,11 @@ type Config struct {
 	// Ingresses is a list of Ingress resources to configure the Cloudflare Tunnel with.
 	// The key is the UID of the Ingress resource.
 	Ingresses map[types.UID]*IngressRecords
+	// IngressDNS holds the DNS settings of each Ingress resource.
+	// The key is the UID of the Ingress resource.
+	IngressDNS map[types.UID]*IngressDNSConfig
+	// RulePaths holds the Kubernetes path each rule of the Ingresses was generated from, the rules are ordered by it.
+	RulePaths map[*IngressRecord]RulePath
 	// AccessAppRequests tracks hostnames that should have a Cloudflare Access
 	// application auto-created. Key is hostname, value is the desired app name.
 	AccessAppRequests map[string]string
@@ -19,8 +26,45 @@ type Config struct {
 	KubernetesApiTunnelConfig KubernetesApiTunnelConfig
 }
 
+// Single tunnel ingress rule.
+type IngressRecord = zero_trust.TunnelCloudflaredConfigurationGetResponseConfigIngress
+
 // List of records for single ingress resource.
-type IngressRecords = []*zero_trust.TunnelCloudflaredConfigurationGetResponseConfigIngress
+type IngressRecords = []*IngressRecord
+
+// RulePath is the Kubernetes path of an Ingress, which the path of its tunnel ingress rule is a regular expression of.
+type RulePath struct {
+	Path     string
+	PathType networkingv1.PathType
+}
+
+// DNS settings for records of single ingress resource.
+type IngressDNSConfig struct {
+	// Resource the DNS records belong to, recorded in the ownership record, e.g. "ingress/default/app"
+	Resource string
+	// Do not manage DNS records of the resource
+	Disabled bool
+	// Take over existing DNS records not owned by the controller
+	AllowTakeover bool
+	// Proxy the traffic through Cloudflare
+	Proxied bool
+	// Time to live of the records in seconds, 1 means automatic
+	TTL dns.TTL
+	// Comment of the records
+	Comment string
+	// Tags of the records in the "name:value" form
+	Tags []string
+}
+
+// NewIngressDNSConfig returns the default DNS settings for records of the resource.
+func NewIngressDNSConfig(resource string) *IngressDNSConfig {
+	return &IngressDNSConfig{
+		Resource: resource,
+		Proxied:  true,
+		TTL:      dns.TTL1,
+		Comment:  DefaultDNSRecordComment,
+	}
+}
 
 type KubernetesApiTunnelConfig struct {
 	// Enable Kubernetes API Tunnel
@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/packages/pagination"
+	"github.com/cloudflare/cloudflare-go/v6/zero_trust"
+)
+
+// errNoTunnel is returned until the tunnel is looked up or created by EnsureTunnelExists
+var errNoTunnel = errors.New("tunnel does not exist yet")
+
+// Connector is a cloudflared instance connected to the tunnel.
+type Connector struct {
+	ID string `json:"id"`
+	// Version of cloudflared, as in the tag of its image
+	Version     string       `json:"version"`
+	RunAt       time.Time    `json:"runAt"`
+	Connections []Connection `json:"connections"`
+}
+
+// Connection is a connection of a connector to a Cloudflare data center.
+type Connection struct {
+	ID            string    `json:"id"`
+	ColoName      string    `json:"coloName"`
+	ClientVersion string    `json:"clientVersion"`
+	OriginIP      string    `json:"originIP"`
+	OpenedAt      time.Time `json:"openedAt"`
+	// PendingReconnect connections are disconnected, the API reports them for a few minutes afterwards
+	PendingReconnect bool `json:"pendingReconnect"`
+}
+
+// Active tells whether the connector serves traffic through at least one connection.
+func (c Connector) Active() bool {
+	for _, conn := range c.Connections {
+		if !conn.PendingReconnect {
+			return true
+		}
+	}
+	return false
+}
+
+// ListConnectors returns the connectors of the tunnel reported by the Cloudflare API, including the recently
+// disconnected ones.
+func (c *Client) ListConnectors(ctx context.Context) ([]Connector, error) {
+	c.tunnelLck.Lock()
+	tunnelID := c.tunnelID
+	c.tunnelLck.Unlock()
+
+	if tunnelID == "" {
+		return nil, errNoTunnel
+	}
+
+	res, err := call(ctx, c, "tunnels.connections.get", func() (*pagination.SinglePage[zero_trust.Client], error) {
+		return c.cloudflareAPI.TunnelConnections.Get(ctx, tunnelID, zero_trust.TunnelCloudflaredConnectionGetParams{
+			AccountID: cloudflare.F(c.accountID),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	connectors := make([]Connector, 0, len(res.Result))
+	for _, client := range res.Result {
+		connector := Connector{
+			ID:          client.ID,
+			Version:     client.Version,
+			RunAt:       client.RunAt,
+			Connections: make([]Connection, 0, len(client.Conns)),
+		}
+		for _, conn := range client.Conns {
+			connector.Connections = append(connector.Connections, Connection{
+				ID:               conn.ID,
+				ColoName:         conn.ColoName,
+				ClientVersion:    conn.ClientVersion,
+				OriginIP:         conn.OriginIP,
+				OpenedAt:         conn.OpenedAt,
+				PendingReconnect: conn.IsPendingReconnect,
+			})
+		}
+		connectors = append(connectors, connector)
+	}
+	return connectors, nil
+}
@@ -0,0 +1,214 @@
+package tunnel
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+// RuleKey identifies a tunnel ingress rule. cloudflared matches requests on
+// hostname and path, so there is at most one effective rule per key.
+type RuleKey struct {
+	Hostname string `json:"hostname"`
+	Path     string `json:"path,omitempty"`
+}
+
+func keyOf(r *IngressRecord) RuleKey {
+	return RuleKey{Hostname: r.Hostname, Path: r.Path}
+}
+
+// isCatchAll reports whether the rule is the trailing catch-all rule that
+// cloudflared requires at the end of the ingress list.
+func isCatchAll(r *IngressRecord) bool {
+	return r.Hostname == "" && r.Path == ""
+}
+
+// RuleUpdate describes a rule present both in the desired and in the live
+// tunnel configuration, but with different settings.
+type RuleUpdate struct {
+	Current *IngressRecord
+	Desired *IngressRecord
+	// Fields lists the names of the settings that differ.
+	Fields []string
+	// Drift is set when the desired rule did not change since it was last
+	// applied, i.e. the live rule was modified outside of the controller.
+	Drift bool
+}
+
+// ChangeSet is the structured result of comparing the desired tunnel ingress
+// rules with the live tunnel configuration.
+type ChangeSet struct {
+	Added   IngressRecords
+	Updated []RuleUpdate
+	Removed IngressRecords
+	// Reordered is set when the rules present on both sides are in a different order,
+	// which matters since cloudflared uses the first matching rule.
+	Reordered bool
+}
+
+func (cs *ChangeSet) IsEmpty() bool {
+	return len(cs.Added) == 0 && len(cs.Updated) == 0 && len(cs.Removed) == 0 && !cs.Reordered
+}
+
+// diffIngressRules computes the changes required to turn live into desired.
+// lastApplied is the set of rules the controller pushed the last time, it is
+// used to tell apart changes made by the user from drift on the Cloudflare side
+// and may be nil.
+func diffIngressRules(desired, lastApplied, live IngressRecords) *ChangeSet {
+	cs := &ChangeSet{}
+
+	liveIndex := indexRules(live)
+	lastIndex := indexRules(lastApplied)
+	desiredIndex := indexRules(desired)
+
+	for _, d := range desired {
+		key := keyOf(d)
+		if desiredIndex[key] != d {
+			// duplicate key, the first rule wins in cloudflared
+			continue
+		}
+		l, ok := liveIndex[key]
+		if !ok {
+			cs.Added = append(cs.Added, d)
+			continue
+		}
+		fields := ruleFieldDiff(l, d)
+		if len(fields) == 0 {
+			continue
+		}
+		last, ok := lastIndex[key]
+		cs.Updated = append(cs.Updated, RuleUpdate{
+			Current: l,
+			Desired: d,
+			Fields:  fields,
+			Drift:   ok && len(ruleFieldDiff(last, d)) == 0,
+		})
+	}
+
+	desiredOrder := make([]RuleKey, 0, len(desired))
+	for _, d := range desired {
+		key := keyOf(d)
+		if _, ok := liveIndex[key]; ok && desiredIndex[key] == d {
+			desiredOrder = append(desiredOrder, key)
+		}
+	}
+
+	liveOrder := make([]RuleKey, 0, len(live))
+	for _, l := range live {
+		key := keyOf(l)
+		if liveIndex[key] != l {
+			// shadowed duplicate, never matched by cloudflared
+			cs.Removed = append(cs.Removed, l)
+			continue
+		}
+		if _, ok := desiredIndex[key]; !ok {
+			cs.Removed = append(cs.Removed, l)
+			continue
+		}
+		liveOrder = append(liveOrder, key)
+	}
+
+	cs.Reordered = !slices.Equal(desiredOrder, liveOrder)
+
+	return cs
+}
+
+// sortIngressRules orders the rules from the most to the least specific: exact hostnames first, then
+// wildcard hostnames and the rules without a hostname last. Rules of the same hostname are ordered by their
+// Kubernetes paths, see pathOrder, so a path is never shadowed by a shorter prefix of it. The regular
+// expression of the rules only breaks ties.
+func sortIngressRules(rules IngressRecords, paths map[*IngressRecord]RulePath) {
+	slices.SortStableFunc(rules, func(a, b *IngressRecord) int {
+		aRank, aLiteral, aType := pathOrder(a, paths)
+		bRank, bLiteral, bType := pathOrder(b, paths)
+		return cmp.Or(
+			cmp.Compare(hostnameRank(a.Hostname), hostnameRank(b.Hostname)),
+			strings.Compare(a.Hostname, b.Hostname),
+			cmp.Compare(aRank, bRank),
+			cmp.Compare(len(bLiteral), len(aLiteral)),
+			cmp.Compare(aType, bType),
+			strings.Compare(a.Path, b.Path),
+		)
+	})
+}
+
+// pathOrder returns the sort keys of the path of the rule. Exact and Prefix paths come first, then the
+// ImplementationSpecific paths and the rules without a path last. Within a rank the longest literal path
+// goes first and at equal length Exact goes before Prefix, which would match the same path. Rules without
+// a Kubernetes path are ordered like ImplementationSpecific ones, by their regular expression.
+func pathOrder(r *IngressRecord, paths map[*IngressRecord]RulePath) (rank int, literal string, pathType int) {
+	if r.Path == "" {
+		return 2, "", 0
+	}
+	p, ok := paths[r]
+	if !ok {
+		return 1, r.Path, 0
+	}
+	switch p.PathType {
+	case networkingv1.PathTypeExact:
+		return 0, p.Path, 0
+	case networkingv1.PathTypePrefix:
+		// "/foo/" matches the same paths as "/foo"
+		return 0, strings.TrimRight(p.Path, "/"), 1
+	default:
+		return 1, r.Path, 0
+	}
+}
+
+func hostnameRank(hostname string) int {
+	switch {
+	case hostname == "":
+		return 2
+	case strings.HasPrefix(hostname, "*"):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// indexRules maps rules by key, keeping the first rule for duplicate keys.
+func indexRules(rules IngressRecords) map[RuleKey]*IngressRecord {
+	index := make(map[RuleKey]*IngressRecord, len(rules))
+	for _, r := range rules {
+		if _, ok := index[keyOf(r)]; !ok {
+			index[keyOf(r)] = r
+		}
+	}
+	return index
+}
+
+// ruleFieldDiff returns the names of the fields that differ between two rules
+// with the same key. Every origin request setting is compared.
+func ruleFieldDiff(a, b *IngressRecord) []string {
+	var fields []string
+	diff := func(name string, equal bool) {
+		if !equal {
+			fields = append(fields, name)
+		}
+	}
+
+	ao, bo := &a.OriginRequest, &b.OriginRequest
+
+	diff("service", a.Service == b.Service)
+	diff("originRequest.access.required", ao.Access.Required == bo.Access.Required)
+	diff("originRequest.access.teamName", ao.Access.TeamName == bo.Access.TeamName)
+	diff("originRequest.access.audTag", slices.Equal(ao.Access.AUDTag, bo.Access.AUDTag))
+	diff("originRequest.caPool", ao.CAPool == bo.CAPool)
+	diff("originRequest.connectTimeout", ao.ConnectTimeout == bo.ConnectTimeout)
+	diff("originRequest.disableChunkedEncoding", ao.DisableChunkedEncoding == bo.DisableChunkedEncoding)
+	diff("originRequest.http2Origin", ao.HTTP2Origin == bo.HTTP2Origin)
+	diff("originRequest.httpHostHeader", ao.HTTPHostHeader == bo.HTTPHostHeader)
+	diff("originRequest.keepAliveConnections", ao.KeepAliveConnections == bo.KeepAliveConnections)
+	diff("originRequest.keepAliveTimeout", ao.KeepAliveTimeout == bo.KeepAliveTimeout)
+	diff("originRequest.matchSNItoHost", ao.MatchSnItoHost == bo.MatchSnItoHost)
+	diff("originRequest.noHappyEyeballs", ao.NoHappyEyeballs == bo.NoHappyEyeballs)
+	diff("originRequest.noTLSVerify", ao.NoTLSVerify == bo.NoTLSVerify)
+	diff("originRequest.originServerName", ao.OriginServerName == bo.OriginServerName)
+	diff("originRequest.proxyType", ao.ProxyType == bo.ProxyType)
+	diff("originRequest.tcpKeepAlive", ao.TCPKeepAlive == bo.TCPKeepAlive)
+	diff("originRequest.tlsTimeout", ao.TLSTimeout == bo.TLSTimeout)
+
+	return fields
+}
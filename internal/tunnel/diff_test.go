@@ -0,0 +1,237 @@
+package tunnel
+
+import (
+	"slices"
+	"testing"
+
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+func TestDiffIngressRules_NoChanges(t *testing.T) {
+	desired := IngressRecords{
+		{Hostname: "app.example.com", Path: "/", Service: "http://app.default:80"},
+		{Hostname: "api.example.com", Service: "http://api.default:8080"},
+	}
+	live := IngressRecords{
+		{Hostname: "app.example.com", Path: "/", Service: "http://app.default:80"},
+		{Hostname: "api.example.com", Service: "http://api.default:8080"},
+	}
+
+	cs := diffIngressRules(desired, nil, live)
+	if !cs.IsEmpty() {
+		t.Errorf("expected empty change set, got %+v", cs)
+	}
+}
+
+func TestDiffIngressRules_AddUpdateRemove(t *testing.T) {
+	desired := IngressRecords{
+		{Hostname: "new.example.com", Service: "http://new.default:80"},
+		{Hostname: "app.example.com", Service: "http://app.default:81"},
+	}
+	live := IngressRecords{
+		{Hostname: "app.example.com", Service: "http://app.default:80"},
+		{Hostname: "old.example.com", Service: "http://old.default:80"},
+	}
+
+	cs := diffIngressRules(desired, nil, live)
+
+	if len(cs.Added) != 1 || cs.Added[0].Hostname != "new.example.com" {
+		t.Errorf("expected new.example.com to be added, got %+v", cs.Added)
+	}
+	if len(cs.Updated) != 1 || cs.Updated[0].Desired.Hostname != "app.example.com" {
+		t.Fatalf("expected app.example.com to be updated, got %+v", cs.Updated)
+	}
+	if !slices.Equal(cs.Updated[0].Fields, []string{"service"}) {
+		t.Errorf("expected only service to differ, got %v", cs.Updated[0].Fields)
+	}
+	if len(cs.Removed) != 1 || cs.Removed[0].Hostname != "old.example.com" {
+		t.Errorf("expected old.example.com to be removed, got %+v", cs.Removed)
+	}
+}
+
+func TestDiffIngressRules_OriginRequestChange(t *testing.T) {
+	desired := IngressRecords{
+		{Hostname: "app.example.com", Service: "http://app.default:80"},
+	}
+	desired[0].OriginRequest.ConnectTimeout = 30
+	desired[0].OriginRequest.Access.Required = true
+	desired[0].OriginRequest.Access.AUDTag = []string{"tag1"}
+	live := IngressRecords{
+		{Hostname: "app.example.com", Service: "http://app.default:80"},
+	}
+	live[0].OriginRequest.ConnectTimeout = 10
+
+	cs := diffIngressRules(desired, nil, live)
+	if len(cs.Updated) != 1 {
+		t.Fatalf("expected 1 update, got %d", len(cs.Updated))
+	}
+	expected := []string{"originRequest.access.required", "originRequest.access.audTag", "originRequest.connectTimeout"}
+	if !slices.Equal(cs.Updated[0].Fields, expected) {
+		t.Errorf("expected fields %v, got %v", expected, cs.Updated[0].Fields)
+	}
+	if cs.Updated[0].Drift {
+		t.Error("expected update not to be marked as drift without last applied state")
+	}
+}
+
+func TestDiffIngressRules_Drift(t *testing.T) {
+	desired := IngressRecords{
+		{Hostname: "app.example.com", Service: "http://app.default:80"},
+	}
+	lastApplied := IngressRecords{
+		{Hostname: "app.example.com", Service: "http://app.default:80"},
+	}
+	live := IngressRecords{
+		{Hostname: "app.example.com", Service: "http://elsewhere.default:80"},
+	}
+
+	cs := diffIngressRules(desired, lastApplied, live)
+	if len(cs.Updated) != 1 || !cs.Updated[0].Drift {
+		t.Errorf("expected a single drift update, got %+v", cs.Updated)
+	}
+}
+
+func TestDiffIngressRules_DuplicateLiveRule(t *testing.T) {
+	desired := IngressRecords{
+		{Hostname: "app.example.com", Service: "http://app.default:80"},
+	}
+	live := IngressRecords{
+		{Hostname: "app.example.com", Service: "http://app.default:80"},
+		{Hostname: "app.example.com", Service: "http://other.default:80"},
+	}
+
+	cs := diffIngressRules(desired, nil, live)
+	if len(cs.Added) != 0 || len(cs.Updated) != 0 {
+		t.Errorf("expected no additions or updates, got %+v", cs)
+	}
+	if len(cs.Removed) != 1 || cs.Removed[0].Service != "http://other.default:80" {
+		t.Errorf("expected shadowed duplicate to be removed, got %+v", cs.Removed)
+	}
+}
+
+func TestDiffIngressRules_Reordered(t *testing.T) {
+	desired := IngressRecords{
+		{Hostname: "app.example.com", Path: "/api", Service: "http://api.default:80"},
+		{Hostname: "app.example.com", Path: "/", Service: "http://app.default:80"},
+	}
+	live := IngressRecords{
+		{Hostname: "app.example.com", Path: "/", Service: "http://app.default:80"},
+		{Hostname: "app.example.com", Path: "/api", Service: "http://api.default:80"},
+	}
+
+	cs := diffIngressRules(desired, nil, live)
+	if !cs.Reordered || cs.IsEmpty() {
+		t.Errorf("expected change set to be reordered, got %+v", cs)
+	}
+
+	cs = diffIngressRules(desired, nil, desired)
+	if !cs.IsEmpty() {
+		t.Errorf("expected empty change set, got %+v", cs)
+	}
+}
+
+func TestSortIngressRules(t *testing.T) {
+	rules := IngressRecords{
+		{Hostname: "", Path: "/"},
+		{Hostname: "*.example.com", Path: "/"},
+		{Hostname: "b.example.com", Path: "/"},
+		{Hostname: "a.example.com", Path: "/"},
+		{Hostname: "a.example.com", Path: "/api"},
+		{Hostname: "a.example.com", Path: "/api/v1"},
+		{Hostname: "*.example.com", Path: "/static"},
+	}
+
+	sortIngressRules(rules, nil)
+
+	expected := []RuleKey{
+		{Hostname: "a.example.com", Path: "/api/v1"},
+		{Hostname: "a.example.com", Path: "/api"},
+		{Hostname: "a.example.com", Path: "/"},
+		{Hostname: "b.example.com", Path: "/"},
+		{Hostname: "*.example.com", Path: "/static"},
+		{Hostname: "*.example.com", Path: "/"},
+		{Hostname: "", Path: "/"},
+	}
+	for i, key := range expected {
+		if keyOf(rules[i]) != key {
+			t.Errorf("expected rules[%d] = %+v, got %+v", i, key, keyOf(rules[i]))
+		}
+	}
+}
+
+func TestSortIngressRules_PathTypes(t *testing.T) {
+	exact := func(path, regex string) rulePathCase {
+		return rulePathCase{RulePath{Path: path, PathType: networkingv1.PathTypeExact}, regex}
+	}
+	prefix := func(path, regex string) rulePathCase {
+		return rulePathCase{RulePath{Path: path, PathType: networkingv1.PathTypePrefix}, regex}
+	}
+	specific := func(path string) rulePathCase {
+		return rulePathCase{RulePath{Path: path, PathType: networkingv1.PathTypeImplementationSpecific}, path}
+	}
+
+	tests := []struct {
+		name  string
+		paths []rulePathCase
+		// expected order of the regular expressions
+		expected []string
+	}{
+		{
+			name:     "exact and prefix on the same path",
+			paths:    []rulePathCase{prefix("/foo", "^/foo(/|$)"), exact("/foo", "^/foo$")},
+			expected: []string{"^/foo$", "^/foo(/|$)"},
+		},
+		{
+			name:     "exact and prefix with a trailing slash on the same path",
+			paths:    []rulePathCase{prefix("/foo/", "^/foo(/|$)"), exact("/foo", "^/foo$")},
+			expected: []string{"^/foo$", "^/foo(/|$)"},
+		},
+		{
+			name:     "exact nested in a prefix",
+			paths:    []rulePathCase{prefix("/foo", "^/foo(/|$)"), exact("/foo/bar", "^/foo/bar$")},
+			expected: []string{"^/foo/bar$", "^/foo(/|$)"},
+		},
+		{
+			name:     "prefix nested in a prefix",
+			paths:    []rulePathCase{prefix("/foo", "^/foo(/|$)"), prefix("/foo/bar", "^/foo/bar(/|$)")},
+			expected: []string{"^/foo/bar(/|$)", "^/foo(/|$)"},
+		},
+		{
+			name:     "exact and prefix on the root",
+			paths:    []rulePathCase{prefix("/", "^/"), exact("/", "^/$")},
+			expected: []string{"^/$", "^/"},
+		},
+		{
+			name:     "implementation specific last",
+			paths:    []rulePathCase{specific("^/foo/.*\\.png$"), prefix("/foo", "^/foo(/|$)"), exact("/", "^/$")},
+			expected: []string{"^/foo(/|$)", "^/$", "^/foo/.*\\.png$"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := make(IngressRecords, 0, len(tt.paths))
+			paths := make(map[*IngressRecord]RulePath, len(tt.paths))
+			for _, p := range tt.paths {
+				r := &IngressRecord{Hostname: "app.example.com", Path: p.regex}
+				rules = append(rules, r)
+				paths[r] = p.path
+			}
+
+			sortIngressRules(rules, paths)
+
+			got := make([]string, 0, len(rules))
+			for _, r := range rules {
+				got = append(got, r.Path)
+			}
+			if !slices.Equal(got, tt.expected) {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+type rulePathCase struct {
+	path  RulePath
+	regex string
+}
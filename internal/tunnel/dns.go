@@ -0,0 +1,380 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/dns"
+	"github.com/cloudflare/cloudflare-go/v6/packages/pagination"
+	"github.com/go-logr/logr"
+)
+
+const kubernetesApiTunnelResource = "kubernetes-api-tunnel"
+
+const DefaultDNSRecordComment = "Automatically created by Cloudflare Tunnel Ingress Controller"
+
+// DNSConflictError is returned when the DNS record of a hostname exists, but is not owned by the controller.
+// The record is left untouched.
+type DNSConflictError struct {
+	Hostname string
+	Reason   string
+}
+
+func (e *DNSConflictError) Error() string {
+	return fmt.Sprintf("DNS record conflict for %s: %s", e.Hostname, e.Reason)
+}
+
+// zoneRecords indexes the DNS records of a single zone.
+type zoneRecords struct {
+	zoneID string
+	// records maps the record name to the A, AAAA and CNAME records
+	records map[string][]*dns.RecordResponse
+	// owners maps the hostname to its ownership TXT record
+	owners map[string]*ownerTXTRecord
+}
+
+type ownerTXTRecord struct {
+	record *dns.RecordResponse
+	owner  ownerRecord
+}
+
+func (c *Client) tunnelTarget() string {
+	return c.tunnelID + "." + tunnelDomain
+}
+
+// zoneForHostname returns the ID of the most specific zone the hostname belongs to.
+func (c *Client) zoneForHostname(hostname string, zone_map map[string]string) string {
+	zoneName, zoneID := "", ""
+	for name, id := range zone_map {
+		if c.isInZone(hostname, name) && len(name) > len(zoneName) {
+			zoneName, zoneID = name, id
+		}
+	}
+	return zoneID
+}
+
+// desiredHostnames maps every hostname that needs a DNS record to the DNS settings of the Ingress it belongs to.
+// A hostname used by several Ingresses takes the settings of the Ingress with the lowest UID. Hostnames used only
+// by Ingresses with DNS management disabled are returned as released.
+func (c *Client) desiredHostnames(config *Config) (map[string]*IngressDNSConfig, map[string]struct{}) {
+	hostnames := make(map[string]*IngressDNSConfig)
+	released := make(map[string]struct{})
+
+	for _, uid := range slices.Sorted(maps.Keys(config.Ingresses)) {
+		dnsConfig, ok := config.IngressDNS[uid]
+		if !ok {
+			dnsConfig = NewIngressDNSConfig("")
+		}
+		for _, ingress := range *config.Ingresses[uid] {
+			if _, ok := hostnames[ingress.Hostname]; ok || len(ingress.Hostname) == 0 {
+				continue
+			}
+			if dnsConfig.Disabled {
+				released[ingress.Hostname] = struct{}{}
+				continue
+			}
+			hostnames[ingress.Hostname] = dnsConfig
+		}
+	}
+
+	if config.KubernetesApiTunnelConfig.Enabled {
+		hostnames[config.KubernetesApiTunnelConfig.Domain] = NewIngressDNSConfig(kubernetesApiTunnelResource)
+	}
+
+	for hostname := range hostnames {
+		delete(released, hostname)
+	}
+
+	return hostnames, released
+}
+
+// synchronizeDns creates the DNS records of the desired hostnames and removes the records owned by the controller
+// which are no longer desired. Besides the zones of the desired hostnames, the zones of scanHostnames are checked
+// for records to remove. Hostnames and zones not matching the domain filter are never touched.
+//
+// The changes are planned per zone and written in batches. Conflicting hostnames are skipped and hostnames whose
+// records failed to be written are returned, neither fails the synchronization.
+func (c *Client) synchronizeDns(ctx context.Context, logger logr.Logger, config *Config, zone_map map[string]string, scanHostnames []string) (map[string]*DNSConflictError, map[string]error, error) {
+	desired, released := c.desiredHostnames(config)
+
+	dns_zone_map := make(map[string]string)
+	for name, id := range zone_map {
+		if c.domainFilter.MatchZone(name) {
+			dns_zone_map[name] = id
+		}
+	}
+
+	zones := make(map[string]*zoneRecords)
+	plans := make(map[string]*dnsPlan)
+	loadZone := func(hostname string) (*zoneRecords, error) {
+		if !c.domainFilter.Match(hostname) {
+			logger.V(1).Info("Hostname excluded by domain filter, skipping DNS", "hostname", hostname)
+			return nil, nil
+		}
+		zoneID := c.zoneForHostname(hostname, dns_zone_map)
+		if len(zoneID) == 0 {
+			logger.Info("Failed to find zone ID", "hostname", hostname)
+			return nil, nil
+		}
+		if zr, ok := zones[zoneID]; ok {
+			return zr, nil
+		}
+		zr, err := c.listZoneRecords(ctx, logger, zoneID)
+		if err != nil {
+			return nil, err
+		}
+		zones[zoneID] = zr
+		plans[zoneID] = &dnsPlan{zoneID: zoneID}
+		return zr, nil
+	}
+
+	conflicts := make(map[string]*DNSConflictError)
+	planned := make([]string, 0, len(desired))
+
+	for _, hostname := range slices.Sorted(maps.Keys(desired)) {
+		zr, err := loadZone(hostname)
+		if err != nil {
+			return nil, nil, err
+		}
+		if zr == nil {
+			continue
+		}
+
+		err = c.planDNSRecord(logger, zr, plans[zr.zoneID], hostname, desired[hostname])
+		var conflict *DNSConflictError
+		if errors.As(err, &conflict) {
+			logger.Error(err, "DNS record is not owned by the controller, skipping hostname", "hostname", hostname)
+			conflicts[hostname] = conflict
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		planned = append(planned, hostname)
+	}
+
+	for _, hostname := range slices.Concat(scanHostnames, slices.Sorted(maps.Keys(released))) {
+		if _, err := loadZone(hostname); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	for _, zr := range zones {
+		for _, hostname := range slices.Sorted(maps.Keys(zr.owners)) {
+			owner := zr.owners[hostname]
+			if _, ok := desired[hostname]; ok || owner.owner.Owner != c.dnsOwnerID || !c.domainFilter.Match(hostname) {
+				continue
+			}
+			if _, ok := released[hostname]; ok {
+				// the records are managed elsewhere now, only give up the ownership
+				logger.Info("Releasing DNS record ownership", "hostname", hostname)
+				plans[zr.zoneID].delete(hostname, owner.record)
+				continue
+			}
+			c.planDeleteDNSRecord(logger, zr, plans[zr.zoneID], hostname, owner)
+		}
+	}
+
+	failures := make(map[string]error)
+	for _, zoneID := range slices.Sorted(maps.Keys(plans)) {
+		plan := plans[zoneID]
+		if len(plan.changes) == 0 {
+			continue
+		}
+		// Cached listings do not contain the written records
+		c.recordCache.invalidate(zoneID)
+		maps.Copy(failures, c.applyDNSPlan(ctx, logger, plan))
+	}
+
+	managed := 0
+	for _, hostname := range planned {
+		if _, ok := failures[hostname]; !ok {
+			managed++
+		}
+	}
+	managedDNSHostnames.Set(float64(managed))
+	dnsConflicts.Set(float64(len(conflicts)))
+
+	return conflicts, failures, nil
+}
+
+func (c *Client) listZoneRecords(ctx context.Context, logger logr.Logger, zoneID string) (*zoneRecords, error) {
+	if zr, ok := c.recordCache.get(zoneID); ok {
+		return zr, nil
+	}
+
+	zr := &zoneRecords{
+		zoneID:  zoneID,
+		records: make(map[string][]*dns.RecordResponse),
+		owners:  make(map[string]*ownerTXTRecord),
+	}
+
+	records, err := listAll(func(page, perPage int64) (*pagination.V4PagePaginationArray[dns.RecordResponse], error) {
+		return call(ctx, c, "dns.records.list", func() (*pagination.V4PagePaginationArray[dns.RecordResponse], error) {
+			return c.cloudflareAPI.DNSRecords.List(ctx, dns.RecordListParams{
+				ZoneID:  cloudflare.F(zoneID),
+				Page:    cloudflare.F(float64(page)),
+				PerPage: cloudflare.F(float64(perPage)),
+			})
+		})
+	})
+	if err != nil {
+		logger.Error(err, "Failed to list DNS records")
+		return nil, err
+	}
+	for _, r := range records {
+		switch r.Type {
+		case dns.RecordResponseTypeA, dns.RecordResponseTypeAAAA, dns.RecordResponseTypeCNAME:
+			zr.records[r.Name] = append(zr.records[r.Name], &r)
+		case dns.RecordResponseTypeTXT:
+			hostname, ok := hostnameFromOwnerRecordName(r.Name)
+			if !ok {
+				continue
+			}
+			if owner, ok := parseOwnerRecord(r.Content); ok {
+				zr.owners[hostname] = &ownerTXTRecord{record: &r, owner: owner}
+			}
+		}
+	}
+
+	c.recordCache.set(zoneID, zr)
+	return zr, nil
+}
+
+// planDNSRecord plans the changes making sure the hostname has a CNAME record pointing to the tunnel with the
+// configured settings and an ownership record. Existing records are only changed when owned by the controller,
+// which the ownership record proves whatever they point to, when they already point to the tunnel without any
+// ownership record (created by an older version of the controller) or when taking over is allowed.
+func (c *Client) planDNSRecord(logger logr.Logger, zr *zoneRecords, plan *dnsPlan, hostname string, dnsConfig *IngressDNSConfig) error {
+	owner := zr.owners[hostname]
+	owned := owner != nil && owner.owner.Owner == c.dnsOwnerID
+	if owner != nil && !owned {
+		if !dnsConfig.AllowTakeover {
+			return &DNSConflictError{Hostname: hostname, Reason: fmt.Sprintf("owned by %q", owner.owner.Owner)}
+		}
+		logger.Info("Taking over DNS record owned by another owner", "hostname", hostname, "owner", owner.owner.Owner)
+		owned = true
+	}
+
+	target := c.tunnelTarget()
+	existing := zr.records[hostname]
+
+	switch {
+	case len(existing) == 0:
+		logger.Info("Creating DNS record", "hostname", hostname)
+		plan.createCNAME(hostname, c.cnameRecordParam(hostname, dnsConfig))
+	case len(existing) == 1 && existing[0].Type == dns.RecordResponseTypeCNAME && existing[0].Content == target:
+		fields := recordSettingsDiff(existing[0], dnsConfig)
+		if len(fields) == 0 {
+			break
+		}
+		logger.Info("Updating DNS record settings", "hostname", hostname, "fields", fields)
+		plan.updateCNAME(hostname, existing[0], c.cnameRecordParam(hostname, dnsConfig))
+	case owned || dnsConfig.AllowTakeover:
+		logger.Info("Replacing existing DNS record", "hostname", hostname, "type", existing[0].Type, "content", existing[0].Content)
+		for _, extra := range existing[1:] {
+			plan.delete(hostname, extra)
+		}
+		plan.updateCNAME(hostname, existing[0], c.cnameRecordParam(hostname, dnsConfig))
+	default:
+		return &DNSConflictError{Hostname: hostname, Reason: fmt.Sprintf("%s record with content %q exists", existing[0].Type, existing[0].Content)}
+	}
+
+	c.planOwnerRecord(zr, plan, hostname, ownerRecord{
+		Owner:    c.dnsOwnerID,
+		Instance: c.tunnelID,
+		Resource: dnsConfig.Resource,
+	})
+	return nil
+}
+
+func (c *Client) planOwnerRecord(zr *zoneRecords, plan *dnsPlan, hostname string, owner ownerRecord) {
+	current, ok := zr.owners[hostname]
+	if ok && current.owner == owner {
+		return
+	}
+
+	body := dns.TXTRecordParam{
+		Type:    cloudflare.F(dns.TXTRecordTypeTXT),
+		Name:    cloudflare.String(ownerRecordName(hostname)),
+		Content: cloudflare.String(owner.content()),
+		TTL:     cloudflare.F(dns.TTL1),
+		Comment: cloudflare.String("Ownership record of Cloudflare Tunnel Ingress Controller"),
+	}
+
+	if ok {
+		plan.updateTXT(hostname, current.record, body)
+	} else {
+		plan.createTXT(hostname, body)
+	}
+}
+
+// planDeleteDNSRecord plans the removal of the records of an owned hostname together with its ownership record.
+// The ownership record proves the ownership of all the records of the hostname, like when updating them, so records
+// pointing somewhere else, e.g. to a previous tunnel, are removed as well.
+func (c *Client) planDeleteDNSRecord(logger logr.Logger, zr *zoneRecords, plan *dnsPlan, hostname string, owner *ownerTXTRecord) {
+	logger.Info("Deleting DNS record", "hostname", hostname)
+
+	for _, r := range zr.records[hostname] {
+		plan.delete(hostname, r)
+	}
+
+	plan.delete(hostname, owner.record)
+}
+
+func (c *Client) cnameRecordParam(hostname string, dnsConfig *IngressDNSConfig) dns.CNAMERecordParam {
+	return dns.CNAMERecordParam{
+		Proxied: cloudflare.Bool(dnsConfig.Proxied),
+		Type:    cloudflare.F(dns.CNAMERecordTypeCNAME),
+		Name:    cloudflare.String(hostname),
+		Content: cloudflare.String(c.tunnelTarget()),
+		TTL:     cloudflare.F(dnsConfig.TTL),
+		Comment: cloudflare.String(dnsConfig.Comment),
+		Tags:    cloudflare.F(sortedTags(dnsConfig.Tags)),
+	}
+}
+
+// recordSettingsDiff returns the names of the settings of the record which differ from the desired ones.
+func recordSettingsDiff(record *dns.RecordResponse, dnsConfig *IngressDNSConfig) []string {
+	var fields []string
+	if record.Proxied != dnsConfig.Proxied {
+		fields = append(fields, "proxied")
+	}
+	if record.TTL != dnsConfig.TTL {
+		fields = append(fields, "ttl")
+	}
+	if record.Comment != dnsConfig.Comment {
+		fields = append(fields, "comment")
+	}
+	if !slices.Equal(sortedTags(recordTags(record)), sortedTags(dnsConfig.Tags)) {
+		fields = append(fields, "tags")
+	}
+	return fields
+}
+
+// recordTags returns the tags of the record, the response leaves their type undetermined.
+func recordTags(record *dns.RecordResponse) []string {
+	switch tags := record.Tags.(type) {
+	case []string:
+		return tags
+	case []any:
+		result := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			if s, ok := tag.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func sortedTags(tags []string) []string {
+	result := append([]string{}, tags...)
+	slices.Sort(result)
+	return result
+}
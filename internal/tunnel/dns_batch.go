@@ -0,0 +1,218 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/dns"
+	"github.com/go-logr/logr"
+)
+
+// maxDNSBatchSize is the number of changes sent in a single batch request, within the limits of all plans.
+const maxDNSBatchSize = 200
+
+// The order of the actions is the order the batch endpoint applies them in.
+type dnsAction int
+
+const (
+	dnsActionDelete dnsAction = iota
+	dnsActionUpdate
+	dnsActionCreate
+)
+
+// dnsChange is a single write of a DNS record.
+type dnsChange struct {
+	action dnsAction
+	// hostname the record belongs to, changes are grouped and failures reported by it
+	hostname string
+	// record is the existing record, set for updates and deletes
+	record *dns.RecordResponse
+	// cname or txt is the desired record, set for creates and updates
+	cname *dns.CNAMERecordParam
+	txt   *dns.TXTRecordParam
+}
+
+// dnsPlan collects the changes of the DNS records of a single zone.
+type dnsPlan struct {
+	zoneID  string
+	changes []*dnsChange
+}
+
+func (p *dnsPlan) createCNAME(hostname string, body dns.CNAMERecordParam) {
+	p.changes = append(p.changes, &dnsChange{action: dnsActionCreate, hostname: hostname, cname: &body})
+}
+
+func (p *dnsPlan) updateCNAME(hostname string, record *dns.RecordResponse, body dns.CNAMERecordParam) {
+	p.changes = append(p.changes, &dnsChange{action: dnsActionUpdate, hostname: hostname, record: record, cname: &body})
+}
+
+func (p *dnsPlan) createTXT(hostname string, body dns.TXTRecordParam) {
+	p.changes = append(p.changes, &dnsChange{action: dnsActionCreate, hostname: hostname, txt: &body})
+}
+
+func (p *dnsPlan) updateTXT(hostname string, record *dns.RecordResponse, body dns.TXTRecordParam) {
+	p.changes = append(p.changes, &dnsChange{action: dnsActionUpdate, hostname: hostname, record: record, txt: &body})
+}
+
+func (p *dnsPlan) delete(hostname string, record *dns.RecordResponse) {
+	p.changes = append(p.changes, &dnsChange{action: dnsActionDelete, hostname: hostname, record: record})
+}
+
+// batches splits the changes into batches of at most size changes. The changes of a hostname are never split,
+// as the records of a hostname depend on each other, e.g. an A record has to be deleted before a CNAME is created.
+func (p *dnsPlan) batches(size int) [][]*dnsChange {
+	var batches [][]*dnsChange
+	var batch []*dnsChange
+	for start := 0; start < len(p.changes); {
+		end := start + 1
+		for end < len(p.changes) && p.changes[end].hostname == p.changes[start].hostname {
+			end++
+		}
+		if len(batch) > 0 && len(batch)+end-start > size {
+			batches = append(batches, batch)
+			batch = nil
+		}
+		batch = append(batch, p.changes[start:end]...)
+		start = end
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// applyDNSPlan writes the planned changes using the batch endpoint. When a batch is rejected, its changes are
+// retried one by one, so a single bad record does not block the others. A batch which may have been applied is not,
+// its records are listed again on the next reconciliation instead. The hostnames whose changes failed are returned.
+func (c *Client) applyDNSPlan(ctx context.Context, logger logr.Logger, plan *dnsPlan) map[string]error {
+	failures := make(map[string]error)
+
+	for _, batch := range plan.batches(maxDNSBatchSize) {
+		err := c.applyDNSBatch(ctx, plan.zoneID, batch)
+		if err == nil {
+			logger.Info("DNS records updated", "zoneID", plan.zoneID, "changes", len(batch))
+			continue
+		}
+		if !notProcessed(err) {
+			logger.Error(err, "Failed to apply DNS batch, the records are listed again on the next reconciliation", "zoneID", plan.zoneID, "changes", len(batch))
+			for _, change := range batch {
+				failures[change.hostname] = err
+			}
+			continue
+		}
+		logger.Error(err, "Failed to apply DNS batch, applying changes one by one", "zoneID", plan.zoneID, "changes", len(batch))
+
+		slices.SortStableFunc(batch, func(a, b *dnsChange) int { return int(a.action) - int(b.action) })
+		for _, change := range batch {
+			if _, failed := failures[change.hostname]; failed {
+				continue
+			}
+			if err := c.applyDNSChange(ctx, plan.zoneID, change); err != nil {
+				logger.Error(err, "Failed to write DNS record", "hostname", change.hostname, "name", change.name())
+				failures[change.hostname] = err
+			}
+		}
+	}
+
+	return failures
+}
+
+func (c *Client) applyDNSBatch(ctx context.Context, zoneID string, batch []*dnsChange) error {
+	var deletes []dns.RecordBatchParamsDelete
+	var puts []dns.BatchPutUnionParam
+	var posts []dns.RecordBatchParamsPostUnion
+	for _, change := range batch {
+		switch change.action {
+		case dnsActionDelete:
+			deletes = append(deletes, dns.RecordBatchParamsDelete{ID: cloudflare.F(change.record.ID)})
+		case dnsActionUpdate:
+			if change.cname != nil {
+				puts = append(puts, dns.BatchPutCNAMERecordParam{ID: cloudflare.F(change.record.ID), CNAMERecordParam: *change.cname})
+			} else {
+				puts = append(puts, dns.BatchPutTXTRecordParam{ID: cloudflare.F(change.record.ID), TXTRecordParam: *change.txt})
+			}
+		case dnsActionCreate:
+			if change.cname != nil {
+				posts = append(posts, *change.cname)
+			} else {
+				posts = append(posts, *change.txt)
+			}
+		}
+	}
+
+	params := dns.RecordBatchParams{
+		ZoneID: cloudflare.F(zoneID),
+	}
+	if len(deletes) > 0 {
+		params.Deletes = cloudflare.F(deletes)
+	}
+	if len(puts) > 0 {
+		params.Puts = cloudflare.F(puts)
+	}
+	if len(posts) > 0 {
+		params.Posts = cloudflare.F(posts)
+	}
+
+	_, err := create(ctx, c, "dns.records.batch", func() (*dns.RecordBatchResponse, error) {
+		return c.cloudflareAPI.DNSRecords.Batch(ctx, params)
+	})
+	return err
+}
+
+func (c *Client) applyDNSChange(ctx context.Context, zoneID string, change *dnsChange) error {
+	var err error
+	switch change.action {
+	case dnsActionDelete:
+		_, err = call(ctx, c, "dns.records.delete", func() (*dns.RecordDeleteResponse, error) {
+			return c.cloudflareAPI.DNSRecords.Delete(ctx, change.record.ID, dns.RecordDeleteParams{
+				ZoneID: cloudflare.F(zoneID),
+			})
+		})
+	case dnsActionUpdate:
+		_, err = call(ctx, c, "dns.records.update", func() (*dns.RecordResponse, error) {
+			return c.cloudflareAPI.DNSRecords.Update(ctx, change.record.ID, dns.RecordUpdateParams{
+				ZoneID: cloudflare.F(zoneID),
+				Body:   change.updateBody(),
+			})
+		})
+	case dnsActionCreate:
+		_, err = create(ctx, c, "dns.records.new", func() (*dns.RecordResponse, error) {
+			return c.cloudflareAPI.DNSRecords.New(ctx, dns.RecordNewParams{
+				ZoneID: cloudflare.F(zoneID),
+				Body:   change.newBody(),
+			})
+		})
+	default:
+		err = errors.New("unknown DNS change")
+	}
+	return err
+}
+
+func (change *dnsChange) newBody() dns.RecordNewParamsBodyUnion {
+	if change.cname != nil {
+		return *change.cname
+	}
+	return *change.txt
+}
+
+func (change *dnsChange) updateBody() dns.RecordUpdateParamsBodyUnion {
+	if change.cname != nil {
+		return *change.cname
+	}
+	return *change.txt
+}
+
+// name returns the name of the written record.
+func (change *dnsChange) name() string {
+	switch {
+	case change.record != nil:
+		return change.record.Name
+	case change.cname != nil:
+		return change.cname.Name.Value
+	case change.txt != nil:
+		return change.txt.Name.Value
+	}
+	return change.hostname
+}
@@ -0,0 +1,99 @@
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go/v6/dns"
+	"github.com/go-logr/logr"
+)
+
+func TestDNSPlanBatches(t *testing.T) {
+	plan := &dnsPlan{zoneID: "zone"}
+	plan.delete("a.example.com", &dns.RecordResponse{ID: "1"})
+	plan.createCNAME("a.example.com", dns.CNAMERecordParam{})
+	plan.createTXT("a.example.com", dns.TXTRecordParam{})
+	plan.createCNAME("b.example.com", dns.CNAMERecordParam{})
+	plan.createTXT("b.example.com", dns.TXTRecordParam{})
+
+	batches := plan.batches(4)
+	if len(batches) != 2 {
+		t.Fatalf("expected 2 batches, got %d", len(batches))
+	}
+	if len(batches[0]) != 3 || len(batches[1]) != 2 {
+		t.Errorf("expected changes of a hostname to stay together, got batches of %d and %d", len(batches[0]), len(batches[1]))
+	}
+
+	if batches := plan.batches(maxDNSBatchSize); len(batches) != 1 {
+		t.Errorf("expected a single batch, got %d", len(batches))
+	}
+}
+
+func TestPlanDNSRecord(t *testing.T) {
+	c := &Client{tunnelID: "tunnel", dnsOwnerID: "owner"}
+	zr := &zoneRecords{
+		zoneID: "zone",
+		records: map[string][]*dns.RecordResponse{
+			"app.example.com":   {{ID: "a", Type: dns.RecordResponseTypeA, Content: "192.0.2.1"}, {ID: "b", Type: dns.RecordResponseTypeA, Content: "192.0.2.2"}},
+			"other.example.com": {{ID: "c", Type: dns.RecordResponseTypeA, Content: "192.0.2.3"}},
+			"new.example.com":   nil,
+		},
+		owners: map[string]*ownerTXTRecord{
+			"app.example.com": {record: &dns.RecordResponse{ID: "txt"}, owner: ownerRecord{Owner: "owner", Instance: "tunnel", Resource: "ingress/default/app"}},
+		},
+	}
+	dnsConfig := NewIngressDNSConfig("ingress/default/app")
+
+	plan := &dnsPlan{zoneID: "zone"}
+	if err := c.planDNSRecord(logr.Discard(), zr, plan, "app.example.com", dnsConfig); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(plan.changes) != 2 || plan.changes[0].action != dnsActionDelete || plan.changes[0].record.ID != "b" ||
+		plan.changes[1].action != dnsActionUpdate || plan.changes[1].record.ID != "a" {
+		t.Errorf("expected owned records to be replaced, got %+v", plan.changes)
+	}
+
+	plan = &dnsPlan{zoneID: "zone"}
+	if err := c.planDNSRecord(logr.Discard(), zr, plan, "other.example.com", dnsConfig); err == nil {
+		t.Error("expected a conflict for a record not owned by the controller")
+	}
+	if len(plan.changes) != 0 {
+		t.Errorf("expected no changes on conflict, got %+v", plan.changes)
+	}
+
+	plan = &dnsPlan{zoneID: "zone"}
+	if err := c.planDNSRecord(logr.Discard(), zr, plan, "new.example.com", dnsConfig); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(plan.changes) != 2 || plan.changes[0].cname == nil || plan.changes[1].txt == nil {
+		t.Errorf("expected CNAME and ownership record to be created, got %+v", plan.changes)
+	}
+}
+
+func TestPlanDNSRecord_RepointedRecord(t *testing.T) {
+	c := &Client{tunnelID: "tunnel", dnsOwnerID: "owner"}
+	zr := &zoneRecords{
+		zoneID: "zone",
+		records: map[string][]*dns.RecordResponse{
+			"app.example.com": {{ID: "cname", Type: dns.RecordResponseTypeCNAME, Content: "previous.cfargotunnel.com"}},
+		},
+		owners: map[string]*ownerTXTRecord{
+			"app.example.com": {record: &dns.RecordResponse{ID: "txt"}, owner: ownerRecord{Owner: "owner", Instance: "previous", Resource: "ingress/default/app"}},
+		},
+	}
+
+	plan := &dnsPlan{zoneID: "zone"}
+	if err := c.planDNSRecord(logr.Discard(), zr, plan, "app.example.com", NewIngressDNSConfig("ingress/default/app")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(plan.changes) != 2 || plan.changes[0].action != dnsActionUpdate || plan.changes[0].record.ID != "cname" ||
+		plan.changes[1].action != dnsActionUpdate || plan.changes[1].record.ID != "txt" {
+		t.Errorf("expected the owned record to be repointed to the tunnel, got %+v", plan.changes)
+	}
+
+	plan = &dnsPlan{zoneID: "zone"}
+	c.planDeleteDNSRecord(logr.Discard(), zr, plan, "app.example.com", zr.owners["app.example.com"])
+	if len(plan.changes) != 2 || plan.changes[0].action != dnsActionDelete || plan.changes[0].record.ID != "cname" ||
+		plan.changes[1].action != dnsActionDelete || plan.changes[1].record.ID != "txt" {
+		t.Errorf("expected the owned record to be deleted with its ownership record, got %+v", plan.changes)
+	}
+}
@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go/v6/dns"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRecordSettingsDiff(t *testing.T) {
+	dnsConfig := NewIngressDNSConfig("ingress/default/app")
+	dnsConfig.Tags = []string{"team:web", "env:prod"}
+
+	record := &dns.RecordResponse{
+		Proxied: true,
+		TTL:     dns.TTL1,
+		Comment: DefaultDNSRecordComment,
+		Tags:    []any{"env:prod", "team:web"},
+	}
+	if fields := recordSettingsDiff(record, dnsConfig); len(fields) != 0 {
+		t.Errorf("expected no differences, got %v", fields)
+	}
+
+	record.Proxied = false
+	record.Comment = "manual"
+	record.Tags = nil
+	expected := []string{"proxied", "comment", "tags"}
+	if fields := recordSettingsDiff(record, dnsConfig); !slices.Equal(fields, expected) {
+		t.Errorf("expected fields %v, got %v", expected, fields)
+	}
+}
+
+func TestDesiredHostnames_Disabled(t *testing.T) {
+	disabled := NewIngressDNSConfig("ingress/default/terraform")
+	disabled.Disabled = true
+
+	config := &Config{
+		Ingresses: map[types.UID]*IngressRecords{
+			"a": {{Hostname: "tf.example.com"}, {Hostname: "shared.example.com"}},
+			"b": {{Hostname: "shared.example.com"}, {Hostname: "app.example.com"}},
+		},
+		IngressDNS: map[types.UID]*IngressDNSConfig{
+			"a": disabled,
+			"b": NewIngressDNSConfig("ingress/default/app"),
+		},
+	}
+
+	desired, released := (&Client{}).desiredHostnames(config)
+
+	if !slices.Equal(slices.Sorted(maps.Keys(desired)), []string{"app.example.com", "shared.example.com"}) {
+		t.Errorf("unexpected desired hostnames %v", slices.Sorted(maps.Keys(desired)))
+	}
+	if !slices.Equal(slices.Sorted(maps.Keys(released)), []string{"tf.example.com"}) {
+		t.Errorf("unexpected released hostnames %v", slices.Sorted(maps.Keys(released)))
+	}
+}
@@ -0,0 +1,346 @@
+// Package fake provides an in-memory implementation of the Cloudflare API services used by the tunnel client,
+// either called directly or served over HTTP.
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/dns"
+	"github.com/cloudflare/cloudflare-go/v6/packages/pagination"
+	"github.com/cloudflare/cloudflare-go/v6/shared"
+	"github.com/cloudflare/cloudflare-go/v6/zero_trust"
+	"github.com/cloudflare/cloudflare-go/v6/zones"
+)
+
+// Operation names a single Cloudflare API call, used to inject errors and count calls.
+type Operation string
+
+const (
+	OpTunnelsList                Operation = "tunnels.list"
+	OpTunnelsNew                 Operation = "tunnels.new"
+	OpTunnelsGet                 Operation = "tunnels.get"
+	OpTunnelsEdit                Operation = "tunnels.edit"
+	OpTunnelTokensGet            Operation = "tunnels.token.get"
+	OpTunnelConnectionsGet       Operation = "tunnels.connections.get"
+	OpTunnelConfigurationsGet    Operation = "tunnels.configurations.get"
+	OpTunnelConfigurationsUpdate Operation = "tunnels.configurations.update"
+	OpZonesList                  Operation = "zones.list"
+	OpDNSRecordsList             Operation = "dns.records.list"
+	OpDNSRecordsNew              Operation = "dns.records.new"
+	OpDNSRecordsUpdate           Operation = "dns.records.update"
+	OpDNSRecordsDelete           Operation = "dns.records.delete"
+	OpDNSRecordsBatch            Operation = "dns.records.batch"
+	OpAccessApplicationsList     Operation = "access.applications.list"
+	OpAccessApplicationsNew      Operation = "access.applications.new"
+)
+
+// Page sizes of the list endpoints
+const defaultPerPage = 20
+const maxPerPage = 50
+
+// Error codes returned by the API
+const errorCodeRateLimited = 971
+const errorCodeTunnelNotFound = 1003
+const errorCodeApplicationAlreadyExists = 12130
+const errorCodeRecordNotFound = 81044
+const errorCodeRecordAlreadyExists = 81053
+const errorCodeIdenticalRecordExists = 81058
+
+// Cloudflare keeps the state of a single Cloudflare account in memory. Its services are safe for concurrent use.
+type Cloudflare struct {
+	mu sync.Mutex
+
+	// MaxPerPage caps the page size of list responses, to exercise pagination with few objects
+	MaxPerPage int
+
+	nextID int
+	calls  map[Operation]int
+	errors map[Operation][]error
+	// lost are the errors replacing the responses of applied operations
+	lost    map[Operation][]error
+	tunnels []*shared.CloudflareTunnel
+	deleted map[string]bool
+	// rotations counts the secret rotations of each tunnel, the token changes with every rotation
+	rotations map[string]int
+	// connectors are the cloudflared instances connected to each tunnel
+	connectors map[string][]zero_trust.Client
+	configs    map[string]*zero_trust.TunnelCloudflaredConfigurationGetResponse
+	zones      []zones.Zone
+	records    map[string][]dns.RecordResponse
+	apps       []zero_trust.AccessApplicationListResponse
+
+	Tunnels              *TunnelsService
+	CloudflaredTunnels   *CloudflaredTunnelsService
+	TunnelTokens         *TunnelTokensService
+	TunnelConnections    *TunnelConnectionsService
+	TunnelConfigurations *TunnelConfigurationsService
+	Zones                *ZonesService
+	DNSRecords           *DNSRecordsService
+	AccessApplications   *AccessApplicationsService
+}
+
+// New returns an empty account.
+func New() *Cloudflare {
+	f := &Cloudflare{
+		MaxPerPage: maxPerPage,
+		calls:      make(map[Operation]int),
+		errors:     make(map[Operation][]error),
+		lost:       make(map[Operation][]error),
+		deleted:    make(map[string]bool),
+		rotations:  make(map[string]int),
+		connectors: make(map[string][]zero_trust.Client),
+		configs:    make(map[string]*zero_trust.TunnelCloudflaredConfigurationGetResponse),
+		records:    make(map[string][]dns.RecordResponse),
+	}
+	f.Tunnels = &TunnelsService{f}
+	f.CloudflaredTunnels = &CloudflaredTunnelsService{f}
+	f.TunnelTokens = &TunnelTokensService{f}
+	f.TunnelConnections = &TunnelConnectionsService{f}
+	f.TunnelConfigurations = &TunnelConfigurationsService{f}
+	f.Zones = &ZonesService{f}
+	f.DNSRecords = &DNSRecordsService{f}
+	f.AccessApplications = &AccessApplicationsService{f}
+	return f
+}
+
+// InjectError makes the next call of the operation fail with err. Errors injected for the same operation are
+// returned in order.
+func (f *Cloudflare) InjectError(op Operation, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[op] = append(f.errors[op], err)
+}
+
+// InjectLostResponse makes the next call of the operation fail with err after it was applied, like a response lost
+// on the way back. It is supported by the operations creating resources.
+func (f *Cloudflare) InjectLostResponse(op Operation, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lost[op] = append(f.lost[op], err)
+}
+
+// Calls returns the number of calls of the operation, including the failed ones.
+func (f *Cloudflare) Calls(op Operation) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// call records the call of the operation and returns the injected error, if any. It is called with the lock held.
+func (f *Cloudflare) call(op Operation) error {
+	f.calls[op]++
+	if errs := f.errors[op]; len(errs) > 0 {
+		f.errors[op] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+// respond returns the result of the applied operation, or the error injected to replace its response. It is called
+// with the lock held.
+func respond[T any](f *Cloudflare, op Operation, res *T, err error) (*T, error) {
+	if err != nil {
+		return nil, err
+	}
+	if errs := f.lost[op]; len(errs) > 0 {
+		f.lost[op] = errs[1:]
+		return nil, errs[0]
+	}
+	return res, nil
+}
+
+func (f *Cloudflare) newID() string {
+	f.nextID++
+	return fmt.Sprintf("%032x", f.nextID)
+}
+
+// APIError returns an error as returned by cloudflare-go for a failed API request.
+func APIError(method string, statusCode int, code int64, message string) *cloudflare.Error {
+	req := httptest.NewRequest(method, "https://api.cloudflare.com/client/v4/", nil)
+	body := fmt.Sprintf(`{"success":false,"errors":[{"code":%d,"message":%q}],"messages":[],"result":null}`, code, message)
+
+	apiErr := &cloudflare.Error{
+		StatusCode: statusCode,
+		Request:    req,
+		Response: &http.Response{
+			StatusCode: statusCode,
+			Header:     make(http.Header),
+			Request:    req,
+		},
+	}
+	_ = json.Unmarshal([]byte(body), apiErr)
+	return apiErr
+}
+
+// RateLimitError returns the error of a rate limited API request, telling the client when to retry.
+func RateLimitError(method string, retryAfter time.Duration) *cloudflare.Error {
+	apiErr := APIError(method, http.StatusTooManyRequests, errorCodeRateLimited, "Rate limited. Please wait and consider throttling your request speed")
+	apiErr.Response.Header.Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	return apiErr
+}
+
+// AddZone adds a zone to the account and returns its ID.
+func (f *Cloudflare) AddZone(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var zone zones.Zone
+	mustConvert(map[string]any{"id": f.newID(), "name": name, "status": "active"}, &zone)
+	f.zones = append(f.zones, zone)
+	return zone.ID
+}
+
+// AddTunnel adds a tunnel to the account and returns its ID. Deleted tunnels are listed with a deletion time.
+func (f *Cloudflare) AddTunnel(name string, deleted bool) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.newID()
+	f.tunnels = append(f.tunnels, &shared.CloudflareTunnel{ID: id, Name: name, ConfigSrc: shared.CloudflareTunnelConfigSrcCloudflare, CreatedAt: now()})
+	f.deleted[id] = deleted
+	return id
+}
+
+// AddConnector connects a cloudflared instance of the given version to the tunnel and returns its ID. Like
+// cloudflared, it has two active connections to the same data center.
+func (f *Cloudflare) AddConnector(tunnelID string, version string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	id := f.newID()
+	conns := make([]zero_trust.ClientConn, 0, 2)
+	for range 2 {
+		conns = append(conns, zero_trust.ClientConn{
+			ID:            f.newID(),
+			ClientID:      id,
+			ClientVersion: version,
+			ColoName:      "fra08",
+			OpenedAt:      now(),
+			OriginIP:      "203.0.113.1",
+		})
+	}
+	f.connectors[tunnelID] = append(f.connectors[tunnelID], zero_trust.Client{
+		ID:      id,
+		Version: version,
+		RunAt:   now(),
+		Conns:   conns,
+	})
+	return id
+}
+
+// DisconnectConnector marks the connections of the connector as pending reconnect, as reported by the API for a
+// while after a connector disconnects.
+func (f *Cloudflare) DisconnectConnector(tunnelID string, connectorID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, connector := range f.connectors[tunnelID] {
+		if connector.ID != connectorID {
+			continue
+		}
+		for j := range connector.Conns {
+			f.connectors[tunnelID][i].Conns[j].IsPendingReconnect = true
+		}
+	}
+}
+
+// AddRecord adds a DNS record to the zone and returns its ID. No constraints are checked.
+func (f *Cloudflare) AddRecord(zoneID string, recordType string, name string, content string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var r dns.RecordResponse
+	mustConvert(map[string]any{"type": recordType, "name": name, "content": content, "ttl": 1}, &r)
+	r.ID = f.newID()
+	f.records[zoneID] = append(f.records[zoneID], r)
+	return r.ID
+}
+
+// Records returns the DNS records of the zone.
+func (f *Cloudflare) Records(zoneID string) []dns.RecordResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.records[zoneID])
+}
+
+// Record returns the DNS record of the zone with the given type and name.
+func (f *Cloudflare) Record(zoneID string, recordType dns.RecordResponseType, name string) (dns.RecordResponse, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.records[zoneID] {
+		if r.Type == recordType && r.Name == name {
+			return r, true
+		}
+	}
+	return dns.RecordResponse{}, false
+}
+
+// TunnelIngress returns the ingress rules of the tunnel configuration.
+func (f *Cloudflare) TunnelIngress(tunnelID string) []zero_trust.TunnelCloudflaredConfigurationGetResponseConfigIngress {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if tc, ok := f.configs[tunnelID]; ok {
+		return slices.Clone(tc.Config.Ingress)
+	}
+	return nil
+}
+
+// AccessApplicationDomains returns the domains of the Access applications.
+func (f *Cloudflare) AccessApplicationDomains() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	domains := make([]string, 0, len(f.apps))
+	for _, app := range f.apps {
+		domains = append(domains, app.Domain)
+	}
+	return domains
+}
+
+// paginate returns the requested page of items.
+func paginate[T any](f *Cloudflare, items []T, page, perPage int64) *pagination.V4PagePaginationArray[T] {
+	if page < 1 {
+		page = 1
+	}
+	if perPage < 1 {
+		perPage = defaultPerPage
+	}
+	perPage = min(perPage, int64(f.MaxPerPage))
+
+	start := min((page-1)*perPage, int64(len(items)))
+	end := min(start+perPage, int64(len(items)))
+
+	return &pagination.V4PagePaginationArray[T]{
+		Result: slices.Clone(items[start:end]),
+		ResultInfo: pagination.V4PagePaginationArrayResultInfo{
+			Page:    page,
+			PerPage: perPage,
+		},
+	}
+}
+
+// convert turns params into API objects by their JSON form, the same way the API does.
+func convert(from any, to any) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+func mustConvert(from any, to any) {
+	if err := convert(from, to); err != nil {
+		panic(err)
+	}
+}
+
+func now() time.Time {
+	return time.Now().UTC()
+}
@@ -0,0 +1,207 @@
+package fake
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/cloudflare/cloudflare-go/v6/packages/pagination"
+	"github.com/cloudflare/cloudflare-go/v6/shared"
+)
+
+// NewServer starts a server serving the Cloudflare v4 REST API endpoints used by the tunnel client from the
+// in-memory account, so the real cloudflare-go client can be tested against it. Pass BaseURL(server) to
+// option.WithBaseURL. Injected errors are returned as API error responses, including their headers.
+func NewServer(f *Cloudflare) *httptest.Server {
+	h := &handler{f}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /client/v4/accounts/{account}/tunnels", h.handle(OpTunnelsList, h.listTunnels))
+	mux.HandleFunc("POST /client/v4/accounts/{account}/cfd_tunnel", h.handle(OpTunnelsNew, h.newTunnel))
+	mux.HandleFunc("GET /client/v4/accounts/{account}/cfd_tunnel/{tunnel}", h.handle(OpTunnelsGet, h.getTunnel))
+	mux.HandleFunc("PATCH /client/v4/accounts/{account}/cfd_tunnel/{tunnel}", h.handle(OpTunnelsEdit, h.editTunnel))
+	mux.HandleFunc("GET /client/v4/accounts/{account}/cfd_tunnel/{tunnel}/token", h.handle(OpTunnelTokensGet, h.getTunnelToken))
+	mux.HandleFunc("GET /client/v4/accounts/{account}/cfd_tunnel/{tunnel}/connections", h.handle(OpTunnelConnectionsGet, h.getTunnelConnectors))
+	mux.HandleFunc("GET /client/v4/accounts/{account}/cfd_tunnel/{tunnel}/configurations", h.handle(OpTunnelConfigurationsGet, h.getTunnelConfiguration))
+	mux.HandleFunc("PUT /client/v4/accounts/{account}/cfd_tunnel/{tunnel}/configurations", h.handle(OpTunnelConfigurationsUpdate, h.updateTunnelConfiguration))
+	mux.HandleFunc("GET /client/v4/zones", h.handle(OpZonesList, h.listZones))
+	mux.HandleFunc("GET /client/v4/zones/{zone}/dns_records", h.handle(OpDNSRecordsList, h.listRecords))
+	mux.HandleFunc("POST /client/v4/zones/{zone}/dns_records", h.handle(OpDNSRecordsNew, h.newRecord))
+	mux.HandleFunc("PUT /client/v4/zones/{zone}/dns_records/{record}", h.handle(OpDNSRecordsUpdate, h.updateRecord))
+	mux.HandleFunc("DELETE /client/v4/zones/{zone}/dns_records/{record}", h.handle(OpDNSRecordsDelete, h.deleteRecord))
+	mux.HandleFunc("POST /client/v4/zones/{zone}/dns_records/batch", h.handle(OpDNSRecordsBatch, h.batchRecords))
+	mux.HandleFunc("GET /client/v4/accounts/{account}/access/apps", h.handle(OpAccessApplicationsList, h.listAccessApplications))
+	mux.HandleFunc("POST /client/v4/accounts/{account}/access/apps", h.handle(OpAccessApplicationsNew, h.newAccessApplication))
+
+	return httptest.NewServer(mux)
+}
+
+// BaseURL returns the base URL of the API served by the server.
+func BaseURL(server *httptest.Server) string {
+	return server.URL + "/client/v4/"
+}
+
+type handler struct {
+	f *Cloudflare
+}
+
+// envelope is the body of every API response.
+type envelope struct {
+	Success    bool                                        `json:"success"`
+	Errors     []shared.ErrorData                          `json:"errors"`
+	Messages   []shared.ResponseInfo                       `json:"messages"`
+	Result     any                                         `json:"result"`
+	ResultInfo *pagination.V4PagePaginationArrayResultInfo `json:"result_info,omitempty"`
+}
+
+// page is the result of a list endpoint.
+type page struct {
+	result any
+	info   pagination.V4PagePaginationArrayResultInfo
+}
+
+func newPage[T any](p *pagination.V4PagePaginationArray[T]) page {
+	return page{result: p.Result, info: p.ResultInfo}
+}
+
+// handle records the call of the operation and serves its result, or the injected error.
+func (h *handler) handle(op Operation, serve func(r *http.Request, body json.RawMessage) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		if r.Body != nil {
+			data, err := io.ReadAll(r.Body)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if len(data) > 0 {
+				body = data
+			}
+		}
+
+		h.f.mu.Lock()
+		err := h.f.call(op)
+		var res any
+		if err == nil {
+			res, err = serve(r, body)
+		}
+		h.f.mu.Unlock()
+
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		env := envelope{Success: true, Errors: []shared.ErrorData{}, Messages: []shared.ResponseInfo{}, Result: res}
+		if p, ok := res.(page); ok {
+			env.Result = p.result
+			env.ResultInfo = &p.info
+		}
+		writeJSON(w, http.StatusOK, env)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes API errors with their status code and headers, any other error as an internal server error.
+func writeError(w http.ResponseWriter, err error) {
+	env := envelope{Errors: []shared.ErrorData{}, Messages: []shared.ResponseInfo{}}
+
+	var apiErr *cloudflare.Error
+	if !errors.As(err, &apiErr) {
+		env.Errors = append(env.Errors, shared.ErrorData{Code: 10000, Message: err.Error()})
+		writeJSON(w, http.StatusInternalServerError, env)
+		return
+	}
+
+	if apiErr.Response != nil {
+		for k, v := range apiErr.Response.Header {
+			w.Header()[k] = v
+		}
+	}
+	env.Errors = append(env.Errors, apiErr.Errors...)
+	writeJSON(w, apiErr.StatusCode, env)
+}
+
+// pageQuery returns the page and page size requested by the query parameters, zero if absent.
+func pageQuery(r *http.Request) (int64, int64) {
+	page, _ := strconv.ParseInt(r.URL.Query().Get("page"), 10, 64)
+	perPage, _ := strconv.ParseInt(r.URL.Query().Get("per_page"), 10, 64)
+	return page, perPage
+}
+
+func (h *handler) listTunnels(r *http.Request, _ json.RawMessage) (any, error) {
+	p, perPage := pageQuery(r)
+	return newPage(paginate(h.f, h.f.listTunnels(), p, perPage)), nil
+}
+
+func (h *handler) newTunnel(r *http.Request, body json.RawMessage) (any, error) {
+	return h.f.newTunnel(r.PathValue("account"), body)
+}
+
+func (h *handler) getTunnel(r *http.Request, _ json.RawMessage) (any, error) {
+	return h.f.tunnel(r.Method, r.PathValue("tunnel"))
+}
+
+func (h *handler) editTunnel(r *http.Request, body json.RawMessage) (any, error) {
+	return h.f.editTunnel(r.Method, r.PathValue("tunnel"), body)
+}
+
+func (h *handler) getTunnelToken(r *http.Request, _ json.RawMessage) (any, error) {
+	return h.f.tunnelToken(r.PathValue("tunnel"))
+}
+
+func (h *handler) getTunnelConnectors(r *http.Request, _ json.RawMessage) (any, error) {
+	return h.f.tunnelConnectors(r.PathValue("tunnel"))
+}
+
+func (h *handler) getTunnelConfiguration(r *http.Request, _ json.RawMessage) (any, error) {
+	return h.f.tunnelConfiguration(r.PathValue("account"), r.PathValue("tunnel"))
+}
+
+func (h *handler) updateTunnelConfiguration(r *http.Request, body json.RawMessage) (any, error) {
+	return h.f.updateTunnelConfiguration(r.PathValue("account"), r.PathValue("tunnel"), body)
+}
+
+func (h *handler) listZones(r *http.Request, _ json.RawMessage) (any, error) {
+	p, perPage := pageQuery(r)
+	return newPage(paginate(h.f, h.f.zones, p, perPage)), nil
+}
+
+func (h *handler) listRecords(r *http.Request, _ json.RawMessage) (any, error) {
+	p, perPage := pageQuery(r)
+	return newPage(paginate(h.f, h.f.records[r.PathValue("zone")], p, perPage)), nil
+}
+
+func (h *handler) newRecord(r *http.Request, body json.RawMessage) (any, error) {
+	return h.f.newRecord(r.PathValue("zone"), body)
+}
+
+func (h *handler) updateRecord(r *http.Request, body json.RawMessage) (any, error) {
+	return h.f.putRecord(r.PathValue("zone"), r.PathValue("record"), body)
+}
+
+func (h *handler) deleteRecord(r *http.Request, _ json.RawMessage) (any, error) {
+	return h.f.removeRecord(r.PathValue("zone"), r.PathValue("record"))
+}
+
+func (h *handler) batchRecords(r *http.Request, body json.RawMessage) (any, error) {
+	return h.f.batchRecords(r.PathValue("zone"), body)
+}
+
+func (h *handler) listAccessApplications(r *http.Request, _ json.RawMessage) (any, error) {
+	p, perPage := pageQuery(r)
+	return newPage(paginate(h.f, h.f.apps, p, perPage)), nil
+}
+
+func (h *handler) newAccessApplication(r *http.Request, body json.RawMessage) (any, error) {
+	return h.f.newAccessApplication(body)
+}
@@ -0,0 +1,506 @@
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/cloudflare/cloudflare-go/v6/dns"
+	"github.com/cloudflare/cloudflare-go/v6/option"
+	"github.com/cloudflare/cloudflare-go/v6/packages/pagination"
+	"github.com/cloudflare/cloudflare-go/v6/shared"
+	"github.com/cloudflare/cloudflare-go/v6/zero_trust"
+	"github.com/cloudflare/cloudflare-go/v6/zones"
+)
+
+// The services implement the interfaces of the tunnel package. They share their logic with the REST server,
+// the request bodies are handled in their JSON form.
+
+type TunnelsService struct{ f *Cloudflare }
+
+func (s *TunnelsService) List(ctx context.Context, params zero_trust.TunnelListParams, opts ...option.RequestOption) (*pagination.V4PagePaginationArray[zero_trust.TunnelListResponse], error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpTunnelsList); err != nil {
+		return nil, err
+	}
+	return paginate(s.f, s.f.listTunnels(), int64(params.Page.Value), int64(params.PerPage.Value)), nil
+}
+
+type CloudflaredTunnelsService struct{ f *Cloudflare }
+
+func (s *CloudflaredTunnelsService) New(ctx context.Context, params zero_trust.TunnelCloudflaredNewParams, opts ...option.RequestOption) (*shared.CloudflareTunnel, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpTunnelsNew); err != nil {
+		return nil, err
+	}
+	tunnel, err := s.f.newTunnel(params.AccountID.Value, params)
+	return respond(s.f, OpTunnelsNew, tunnel, err)
+}
+
+func (s *CloudflaredTunnelsService) Get(ctx context.Context, tunnelID string, query zero_trust.TunnelCloudflaredGetParams, opts ...option.RequestOption) (*shared.CloudflareTunnel, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpTunnelsGet); err != nil {
+		return nil, err
+	}
+	t, err := s.f.tunnel(http.MethodGet, tunnelID)
+	if err != nil {
+		return nil, err
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (s *CloudflaredTunnelsService) Edit(ctx context.Context, tunnelID string, params zero_trust.TunnelCloudflaredEditParams, opts ...option.RequestOption) (*shared.CloudflareTunnel, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpTunnelsEdit); err != nil {
+		return nil, err
+	}
+	return s.f.editTunnel(http.MethodPatch, tunnelID, params)
+}
+
+type TunnelTokensService struct{ f *Cloudflare }
+
+func (s *TunnelTokensService) Get(ctx context.Context, tunnelID string, query zero_trust.TunnelCloudflaredTokenGetParams, opts ...option.RequestOption) (*string, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpTunnelTokensGet); err != nil {
+		return nil, err
+	}
+	return s.f.tunnelToken(tunnelID)
+}
+
+type TunnelConnectionsService struct{ f *Cloudflare }
+
+func (s *TunnelConnectionsService) Get(ctx context.Context, tunnelID string, query zero_trust.TunnelCloudflaredConnectionGetParams, opts ...option.RequestOption) (*pagination.SinglePage[zero_trust.Client], error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpTunnelConnectionsGet); err != nil {
+		return nil, err
+	}
+	connectors, err := s.f.tunnelConnectors(tunnelID)
+	if err != nil {
+		return nil, err
+	}
+	return &pagination.SinglePage[zero_trust.Client]{Result: connectors}, nil
+}
+
+type TunnelConfigurationsService struct{ f *Cloudflare }
+
+func (s *TunnelConfigurationsService) Get(ctx context.Context, tunnelID string, query zero_trust.TunnelCloudflaredConfigurationGetParams, opts ...option.RequestOption) (*zero_trust.TunnelCloudflaredConfigurationGetResponse, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpTunnelConfigurationsGet); err != nil {
+		return nil, err
+	}
+	return s.f.tunnelConfiguration(query.AccountID.Value, tunnelID)
+}
+
+func (s *TunnelConfigurationsService) Update(ctx context.Context, tunnelID string, params zero_trust.TunnelCloudflaredConfigurationUpdateParams, opts ...option.RequestOption) (*zero_trust.TunnelCloudflaredConfigurationUpdateResponse, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpTunnelConfigurationsUpdate); err != nil {
+		return nil, err
+	}
+	tc, err := s.f.updateTunnelConfiguration(params.AccountID.Value, tunnelID, params)
+	if err != nil {
+		return nil, err
+	}
+	var res zero_trust.TunnelCloudflaredConfigurationUpdateResponse
+	if err := convert(tc, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+type ZonesService struct{ f *Cloudflare }
+
+func (s *ZonesService) List(ctx context.Context, query zones.ZoneListParams, opts ...option.RequestOption) (*pagination.V4PagePaginationArray[zones.Zone], error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpZonesList); err != nil {
+		return nil, err
+	}
+	return paginate(s.f, s.f.zones, int64(query.Page.Value), int64(query.PerPage.Value)), nil
+}
+
+type DNSRecordsService struct{ f *Cloudflare }
+
+func (s *DNSRecordsService) List(ctx context.Context, params dns.RecordListParams, opts ...option.RequestOption) (*pagination.V4PagePaginationArray[dns.RecordResponse], error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpDNSRecordsList); err != nil {
+		return nil, err
+	}
+	return paginate(s.f, s.f.records[params.ZoneID.Value], int64(params.Page.Value), int64(params.PerPage.Value)), nil
+}
+
+func (s *DNSRecordsService) New(ctx context.Context, params dns.RecordNewParams, opts ...option.RequestOption) (*dns.RecordResponse, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpDNSRecordsNew); err != nil {
+		return nil, err
+	}
+	record, err := s.f.newRecord(params.ZoneID.Value, params.Body)
+	return respond(s.f, OpDNSRecordsNew, record, err)
+}
+
+func (s *DNSRecordsService) Update(ctx context.Context, dnsRecordID string, params dns.RecordUpdateParams, opts ...option.RequestOption) (*dns.RecordResponse, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpDNSRecordsUpdate); err != nil {
+		return nil, err
+	}
+	return s.f.putRecord(params.ZoneID.Value, dnsRecordID, params.Body)
+}
+
+func (s *DNSRecordsService) Delete(ctx context.Context, dnsRecordID string, body dns.RecordDeleteParams, opts ...option.RequestOption) (*dns.RecordDeleteResponse, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpDNSRecordsDelete); err != nil {
+		return nil, err
+	}
+	return s.f.removeRecord(body.ZoneID.Value, dnsRecordID)
+}
+
+func (s *DNSRecordsService) Batch(ctx context.Context, params dns.RecordBatchParams, opts ...option.RequestOption) (*dns.RecordBatchResponse, error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpDNSRecordsBatch); err != nil {
+		return nil, err
+	}
+	batch, err := s.f.batchRecords(params.ZoneID.Value, params)
+	return respond(s.f, OpDNSRecordsBatch, batch, err)
+}
+
+type AccessApplicationsService struct{ f *Cloudflare }
+
+func (s *AccessApplicationsService) List(ctx context.Context, params zero_trust.AccessApplicationListParams, opts ...option.RequestOption) (*pagination.V4PagePaginationArray[zero_trust.AccessApplicationListResponse], error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpAccessApplicationsList); err != nil {
+		return nil, err
+	}
+	return paginate(s.f, s.f.apps, params.Page.Value, params.PerPage.Value), nil
+}
+
+func (s *AccessApplicationsService) New(ctx context.Context, params zero_trust.AccessApplicationNewParams, opts ...option.RequestOption) (*zero_trust.AccessApplicationNewResponse, error) {
+	// Checked by cloudflare-go before sending the request
+	if params.AccountID.Value != "" && params.ZoneID.Value != "" {
+		return nil, errors.New("account ID and zone ID are mutually exclusive")
+	}
+
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if err := s.f.call(OpAccessApplicationsNew); err != nil {
+		return nil, err
+	}
+	app, err := s.f.newAccessApplication(params.Body)
+	return respond(s.f, OpAccessApplicationsNew, app, err)
+}
+
+// The methods below are called with the lock held.
+
+func (f *Cloudflare) listTunnels() []zero_trust.TunnelListResponse {
+	tunnels := make([]zero_trust.TunnelListResponse, 0, len(f.tunnels))
+	for _, t := range f.tunnels {
+		r := zero_trust.TunnelListResponse{ID: t.ID, Name: t.Name, CreatedAt: t.CreatedAt}
+		if f.deleted[t.ID] {
+			r.DeletedAt = t.CreatedAt.Add(1)
+		}
+		tunnels = append(tunnels, r)
+	}
+	return tunnels
+}
+
+func (f *Cloudflare) newTunnel(accountID string, body any) (*shared.CloudflareTunnel, error) {
+	var params struct {
+		Name      string `json:"name"`
+		ConfigSrc string `json:"config_src"`
+	}
+	if err := convert(body, &params); err != nil {
+		return nil, err
+	}
+
+	t := &shared.CloudflareTunnel{
+		ID:         f.newID(),
+		AccountTag: accountID,
+		Name:       params.Name,
+		ConfigSrc:  shared.CloudflareTunnelConfigSrc(params.ConfigSrc),
+		CreatedAt:  now(),
+	}
+	f.tunnels = append(f.tunnels, t)
+	copied := *t
+	return &copied, nil
+}
+
+func (f *Cloudflare) tunnel(method string, tunnelID string) (*shared.CloudflareTunnel, error) {
+	for _, t := range f.tunnels {
+		if t.ID == tunnelID && !f.deleted[t.ID] {
+			return t, nil
+		}
+	}
+	return nil, APIError(method, http.StatusNotFound, errorCodeTunnelNotFound, "Tunnel not found")
+}
+
+// editTunnel renames the tunnel and rotates its secret, the token of the tunnel changes with the secret.
+func (f *Cloudflare) editTunnel(method string, tunnelID string, body any) (*shared.CloudflareTunnel, error) {
+	var params struct {
+		Name         string `json:"name"`
+		TunnelSecret string `json:"tunnel_secret"`
+	}
+	if err := convert(body, &params); err != nil {
+		return nil, err
+	}
+
+	t, err := f.tunnel(method, tunnelID)
+	if err != nil {
+		return nil, err
+	}
+	if params.Name != "" {
+		t.Name = params.Name
+	}
+	if params.TunnelSecret != "" {
+		f.rotations[tunnelID]++
+	}
+	copied := *t
+	return &copied, nil
+}
+
+func (f *Cloudflare) tunnelToken(tunnelID string) (*string, error) {
+	if _, err := f.tunnel(http.MethodGet, tunnelID); err != nil {
+		return nil, err
+	}
+	token := "token-" + tunnelID
+	if n := f.rotations[tunnelID]; n > 0 {
+		token = fmt.Sprintf("%s-%d", token, n)
+	}
+	return &token, nil
+}
+
+func (f *Cloudflare) tunnelConnectors(tunnelID string) ([]zero_trust.Client, error) {
+	if _, err := f.tunnel(http.MethodGet, tunnelID); err != nil {
+		return nil, err
+	}
+	connectors := make([]zero_trust.Client, 0, len(f.connectors[tunnelID]))
+	for _, connector := range f.connectors[tunnelID] {
+		connector.Conns = slices.Clone(connector.Conns)
+		connectors = append(connectors, connector)
+	}
+	return connectors, nil
+}
+
+func (f *Cloudflare) tunnelConfiguration(accountID string, tunnelID string) (*zero_trust.TunnelCloudflaredConfigurationGetResponse, error) {
+	if _, err := f.tunnel(http.MethodGet, tunnelID); err != nil {
+		return nil, err
+	}
+	tc, ok := f.configs[tunnelID]
+	if !ok {
+		return &zero_trust.TunnelCloudflaredConfigurationGetResponse{AccountID: accountID, TunnelID: tunnelID}, nil
+	}
+	copied := *tc
+	copied.Config.Ingress = slices.Clone(tc.Config.Ingress)
+	return &copied, nil
+}
+
+func (f *Cloudflare) updateTunnelConfiguration(accountID string, tunnelID string, body any) (*zero_trust.TunnelCloudflaredConfigurationGetResponse, error) {
+	if _, err := f.tunnel(http.MethodPut, tunnelID); err != nil {
+		return nil, err
+	}
+
+	var params struct {
+		Config json.RawMessage `json:"config"`
+	}
+	if err := convert(body, &params); err != nil {
+		return nil, err
+	}
+
+	version := int64(1)
+	if tc, ok := f.configs[tunnelID]; ok {
+		version = tc.Version + 1
+	}
+
+	var tc zero_trust.TunnelCloudflaredConfigurationGetResponse
+	err := convert(map[string]any{
+		"account_id": accountID,
+		"tunnel_id":  tunnelID,
+		"config":     params.Config,
+		"version":    version,
+		"source":     "cloudflare",
+		"created_at": now(),
+	}, &tc)
+	if err != nil {
+		return nil, err
+	}
+	f.configs[tunnelID] = &tc
+	return &tc, nil
+}
+
+func (f *Cloudflare) newRecord(zoneID string, body any) (*dns.RecordResponse, error) {
+	records, r, err := f.createRecord(f.records[zoneID], body)
+	if err != nil {
+		return nil, err
+	}
+	f.records[zoneID] = records
+	return &r, nil
+}
+
+func (f *Cloudflare) putRecord(zoneID string, id string, body any) (*dns.RecordResponse, error) {
+	records, r, err := f.updateRecord(f.records[zoneID], id, body)
+	if err != nil {
+		return nil, err
+	}
+	f.records[zoneID] = records
+	return &r, nil
+}
+
+func (f *Cloudflare) removeRecord(zoneID string, id string) (*dns.RecordDeleteResponse, error) {
+	records, err := deleteRecord(f.records[zoneID], id)
+	if err != nil {
+		return nil, err
+	}
+	f.records[zoneID] = records
+	return &dns.RecordDeleteResponse{ID: id}, nil
+}
+
+// batchRecords applies the deletes, puts and posts in this order. Like the API, the batch is applied atomically.
+func (f *Cloudflare) batchRecords(zoneID string, body any) (*dns.RecordBatchResponse, error) {
+	var params struct {
+		Deletes []struct {
+			ID string `json:"id"`
+		} `json:"deletes"`
+		Puts  []json.RawMessage `json:"puts"`
+		Posts []json.RawMessage `json:"posts"`
+	}
+	if err := convert(body, &params); err != nil {
+		return nil, err
+	}
+
+	res := &dns.RecordBatchResponse{}
+	records := slices.Clone(f.records[zoneID])
+	var err error
+	for _, d := range params.Deletes {
+		if records, err = deleteRecord(records, d.ID); err != nil {
+			return nil, err
+		}
+		res.Deletes = append(res.Deletes, dns.RecordResponse{ID: d.ID})
+	}
+	for _, put := range params.Puts {
+		var id struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(put, &id); err != nil {
+			return nil, err
+		}
+		var r dns.RecordResponse
+		if records, r, err = f.updateRecord(records, id.ID, put); err != nil {
+			return nil, err
+		}
+		res.Puts = append(res.Puts, r)
+	}
+	for _, post := range params.Posts {
+		var r dns.RecordResponse
+		if records, r, err = f.createRecord(records, post); err != nil {
+			return nil, err
+		}
+		res.Posts = append(res.Posts, r)
+	}
+
+	f.records[zoneID] = records
+	return res, nil
+}
+
+func (f *Cloudflare) createRecord(records []dns.RecordResponse, body any) ([]dns.RecordResponse, dns.RecordResponse, error) {
+	var r dns.RecordResponse
+	if err := convert(body, &r); err != nil {
+		return nil, r, err
+	}
+	r.ID = f.newID()
+	r.CreatedOn = now()
+	r.ModifiedOn = r.CreatedOn
+
+	if err := checkRecord(http.MethodPost, records, r); err != nil {
+		return nil, r, err
+	}
+	return append(slices.Clone(records), r), r, nil
+}
+
+func (f *Cloudflare) updateRecord(records []dns.RecordResponse, id string, body any) ([]dns.RecordResponse, dns.RecordResponse, error) {
+	i := slices.IndexFunc(records, func(r dns.RecordResponse) bool { return r.ID == id })
+	if i < 0 {
+		return nil, dns.RecordResponse{}, APIError(http.MethodPut, http.StatusNotFound, errorCodeRecordNotFound, "Record does not exist.")
+	}
+
+	var r dns.RecordResponse
+	if err := convert(body, &r); err != nil {
+		return nil, r, err
+	}
+	r.ID = id
+	r.CreatedOn = records[i].CreatedOn
+	r.ModifiedOn = now()
+
+	others := slices.Delete(slices.Clone(records), i, i+1)
+	if err := checkRecord(http.MethodPut, others, r); err != nil {
+		return nil, r, err
+	}
+	records = slices.Clone(records)
+	records[i] = r
+	return records, r, nil
+}
+
+func deleteRecord(records []dns.RecordResponse, id string) ([]dns.RecordResponse, error) {
+	i := slices.IndexFunc(records, func(r dns.RecordResponse) bool { return r.ID == id })
+	if i < 0 {
+		return nil, APIError(http.MethodDelete, http.StatusNotFound, errorCodeRecordNotFound, "Record does not exist.")
+	}
+	return slices.Delete(slices.Clone(records), i, i+1), nil
+}
+
+// checkRecord enforces the constraints of the API: a CNAME record cannot share its name with any other record
+// and identical records are rejected.
+func checkRecord(method string, records []dns.RecordResponse, r dns.RecordResponse) error {
+	for _, existing := range records {
+		if existing.Name != r.Name {
+			continue
+		}
+		if existing.Type == dns.RecordResponseTypeCNAME || r.Type == dns.RecordResponseTypeCNAME {
+			return APIError(method, http.StatusBadRequest, errorCodeRecordAlreadyExists, "An A, AAAA, or CNAME record with that host already exists.")
+		}
+		if existing.Type == r.Type && existing.Content == r.Content {
+			return APIError(method, http.StatusBadRequest, errorCodeIdenticalRecordExists, "An identical record already exists.")
+		}
+	}
+	return nil
+}
+
+func (f *Cloudflare) newAccessApplication(body any) (*zero_trust.AccessApplicationNewResponse, error) {
+	var app map[string]any
+	if err := convert(body, &app); err != nil {
+		return nil, err
+	}
+	for _, existing := range f.apps {
+		if existing.Domain == app["domain"] {
+			return nil, APIError(http.MethodPost, http.StatusBadRequest, errorCodeApplicationAlreadyExists, fmt.Sprintf("An application with the domain %s already exists.", existing.Domain))
+		}
+	}
+	app["id"] = f.newID()
+	app["created_at"] = now()
+
+	var listed zero_trust.AccessApplicationListResponse
+	if err := convert(app, &listed); err != nil {
+		return nil, err
+	}
+	f.apps = append(f.apps, listed)
+
+	var res zero_trust.AccessApplicationNewResponse
+	if err := convert(app, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
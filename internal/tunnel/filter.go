@@ -0,0 +1,81 @@
+package tunnel
+
+import (
+	"strings"
+)
+
+// DomainFilter restricts the DNS records managed by the controller, similar to the domain filters of external-dns.
+// A domain matches itself and all its subdomains, excluded domains take precedence over included ones.
+type DomainFilter struct {
+	// Include lists the domains to manage, all domains are managed when empty
+	Include []string
+	// Exclude lists the domains never to manage
+	Exclude []string
+}
+
+// NewDomainFilter creates a filter from comma-separated lists of domains.
+func NewDomainFilter(include, exclude string) DomainFilter {
+	return DomainFilter{
+		Include: splitDomains(include),
+		Exclude: splitDomains(exclude),
+	}
+}
+
+func splitDomains(s string) []string {
+	var domains []string
+	for domain := range strings.SplitSeq(s, ",") {
+		domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+		if len(domain) > 0 {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
+
+func isSubdomain(name, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// Match reports whether the DNS records of the hostname may be managed.
+func (f DomainFilter) Match(hostname string) bool {
+	hostname = strings.ToLower(hostname)
+	for _, domain := range f.Exclude {
+		if isSubdomain(hostname, domain) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, domain := range f.Include {
+		if isSubdomain(hostname, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchZone reports whether the zone may contain DNS records to manage. A zone is kept when it is included itself
+// or when it contains an included domain.
+func (f DomainFilter) MatchZone(zoneName string) bool {
+	zoneName = strings.ToLower(zoneName)
+	for _, domain := range f.Exclude {
+		if isSubdomain(zoneName, domain) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, domain := range f.Include {
+		if isSubdomain(zoneName, domain) || isSubdomain(domain, zoneName) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetDomainFilter restricts the DNS records managed by the client to the domains matching the filter.
+func (c *Client) SetDomainFilter(filter DomainFilter) {
+	c.domainFilter = filter
+}
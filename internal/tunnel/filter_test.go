@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"testing"
+)
+
+func TestDomainFilter_Match(t *testing.T) {
+	f := NewDomainFilter("example.com, example.org.", "legacy.example.com")
+
+	tests := []struct {
+		hostname string
+		match    bool
+	}{
+		{hostname: "example.com", match: true},
+		{hostname: "app.example.com", match: true},
+		{hostname: "*.example.org", match: true},
+		{hostname: "legacy.example.com", match: false},
+		{hostname: "app.legacy.example.com", match: false},
+		{hostname: "app.example.net", match: false},
+		{hostname: "notexample.com", match: false},
+	}
+
+	for _, tt := range tests {
+		if got := f.Match(tt.hostname); got != tt.match {
+			t.Errorf("Match(%q) = %v, want %v", tt.hostname, got, tt.match)
+		}
+	}
+}
+
+func TestDomainFilter_MatchZone(t *testing.T) {
+	f := NewDomainFilter("app.example.com", "example.org")
+
+	if !f.MatchZone("example.com") {
+		t.Error("expected zone containing an included domain to match")
+	}
+	if f.MatchZone("example.net") {
+		t.Error("expected zone outside of included domains not to match")
+	}
+	if f.MatchZone("example.org") {
+		t.Error("expected excluded zone not to match")
+	}
+	if !NewDomainFilter("", "").MatchZone("example.net") {
+		t.Error("expected empty filter to match every zone")
+	}
+}
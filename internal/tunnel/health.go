@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const DefaultHealthCheckInterval = 30 * time.Second
+const DefaultUnhealthyThreshold = 2 * time.Minute
+
+// HealthStatus is the health of the tunnel connectors last seen by the HealthMonitor.
+type HealthStatus struct {
+	// Healthy is false once the tunnel had no healthy connection for longer than the threshold
+	Healthy bool `json:"healthy"`
+	// HealthyConnections are the connections serving traffic, not pending reconnect
+	HealthyConnections int         `json:"healthyConnections"`
+	Connectors         []Connector `json:"connectors"`
+	// CheckedAt is the time of the last successful poll, zero before the first one
+	CheckedAt time.Time `json:"checkedAt"`
+	// UnhealthySince is when the tunnel was first seen without healthy connections, zero while it has some
+	UnhealthySince time.Time `json:"unhealthySince,omitzero"`
+	// LastError of the last poll, empty when it succeeded
+	LastError string `json:"lastError,omitempty"`
+}
+
+// HealthMonitor polls the connections of the tunnel in the background. A tunnel without healthy connections is only
+// reported unhealthy after the threshold, so connectors restarting or reconnecting do not flap its health. Failing
+// polls leave the health unchanged, an unreachable API says nothing about the connectors.
+type HealthMonitor struct {
+	logger    logr.Logger
+	client    *Client
+	interval  time.Duration
+	threshold time.Duration
+	now       func() time.Time
+
+	mu     sync.RWMutex
+	status HealthStatus
+}
+
+func NewHealthMonitor(client *Client, interval, threshold time.Duration, logger logr.Logger) *HealthMonitor {
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	if threshold <= 0 {
+		threshold = DefaultUnhealthyThreshold
+	}
+	return &HealthMonitor{
+		logger:    logger,
+		client:    client,
+		interval:  interval,
+		threshold: threshold,
+		now:       time.Now,
+		status:    HealthStatus{Healthy: true},
+	}
+}
+
+// NeedLeaderElection keeps the polling to the leader, the only replica knowing the tunnel.
+func (m *HealthMonitor) NeedLeaderElection() bool {
+	return true
+}
+
+func (m *HealthMonitor) Start(ctx context.Context) error {
+	m.logger.Info("Monitoring the tunnel connections", "interval", m.interval, "unhealthyThreshold", m.threshold)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll refreshes the status and the metrics from the connections of the tunnel.
+func (m *HealthMonitor) poll(ctx context.Context) {
+	connectors, err := m.client.ListConnectors(ctx)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if errors.Is(err, errNoTunnel) {
+		// Not bootstrapped yet
+		return
+	}
+	if err != nil {
+		m.logger.Error(err, "Failed to list the tunnel connections")
+		m.status.LastError = err.Error()
+		return
+	}
+
+	now := m.now()
+	healthy := 0
+	tunnelConnections.Reset()
+	tunnelConnectionOpenedTimestamp.Reset()
+	for _, connector := range connectors {
+		for _, conn := range connector.Connections {
+			if conn.PendingReconnect {
+				continue
+			}
+			healthy++
+			tunnelConnections.WithLabelValues(conn.ColoName, conn.ClientVersion, conn.OriginIP).Inc()
+			tunnelConnectionOpenedTimestamp.WithLabelValues(connector.ID, conn.ID, conn.ColoName, conn.ClientVersion, conn.OriginIP).Set(float64(conn.OpenedAt.Unix()))
+		}
+	}
+
+	status := HealthStatus{
+		Healthy:            true,
+		HealthyConnections: healthy,
+		Connectors:         connectors,
+		CheckedAt:          now,
+	}
+	if healthy == 0 {
+		status.UnhealthySince = m.status.UnhealthySince
+		if status.UnhealthySince.IsZero() {
+			m.logger.Info("The tunnel has no healthy connection")
+			status.UnhealthySince = now
+		}
+		status.Healthy = now.Sub(status.UnhealthySince) < m.threshold
+	} else if !m.status.UnhealthySince.IsZero() {
+		m.logger.Info("The tunnel has healthy connections again", "healthyConnections", healthy)
+	}
+	if m.status.Healthy && !status.Healthy {
+		m.logger.Info("The tunnel is unhealthy", "unhealthySince", status.UnhealthySince, "threshold", m.threshold)
+	}
+
+	if status.Healthy {
+		tunnelHealthy.Set(1)
+	} else {
+		tunnelHealthy.Set(0)
+	}
+	m.status = status
+}
+
+// Status returns the health of the tunnel last seen.
+func (m *HealthMonitor) Status() HealthStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.status
+}
+
+// Check reports the health of the tunnel along with its status, as expected by health.Server.AddCheck.
+func (m *HealthMonitor) Check() (bool, any) {
+	status := m.Status()
+	return status.Healthy, status
+}
@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel/fake"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHealthMonitor(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	tunnelID := f.AddTunnel("test-tunnel", false)
+
+	c := NewClient(&CloudflareAPI{
+		Tunnels:            f.Tunnels,
+		CloudflaredTunnels: f.CloudflaredTunnels,
+		TunnelTokens:       f.TunnelTokens,
+		TunnelConnections:  f.TunnelConnections,
+	}, "account", "test-tunnel", "owner", logr.Discard())
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewHealthMonitor(c, time.Minute, 2*time.Minute, logr.Discard())
+	m.now = func() time.Time { return now }
+
+	assertHealth := func(healthy bool, connections int) {
+		t.Helper()
+		m.poll(ctx)
+		status := m.Status()
+		if status.Healthy != healthy || status.HealthyConnections != connections {
+			t.Fatalf("expected healthy %v with %d connections, got %+v", healthy, connections, status)
+		}
+	}
+
+	// before the bootstrap
+	assertHealth(true, 0)
+	if !m.Status().CheckedAt.IsZero() {
+		t.Error("expected no check before the tunnel is known")
+	}
+
+	if err := c.EnsureTunnelExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("failed to ensure tunnel exists: %v", err)
+	}
+
+	connector := f.AddConnector(tunnelID, "2026.6.0")
+	assertHealth(true, 2)
+	if got := testutil.ToFloat64(tunnelConnections.WithLabelValues("fra08", "2026.6.0", "203.0.113.1")); got != 2 {
+		t.Errorf("expected the connections in the metrics, got %v", got)
+	}
+	if got := testutil.CollectAndCount(tunnelConnectionOpenedTimestamp); got != 2 {
+		t.Errorf("expected the opening time of both connections to the data center, got %d", got)
+	}
+	if got := testutil.ToFloat64(tunnelHealthy); got != 1 {
+		t.Errorf("expected the tunnel healthy metric, got %v", got)
+	}
+
+	// no healthy connection, within the threshold
+	f.DisconnectConnector(tunnelID, connector)
+	assertHealth(true, 0)
+	now = now.Add(time.Minute)
+	assertHealth(true, 0)
+
+	// an unreachable API says nothing
+	f.InjectError(fake.OpTunnelConnectionsGet, errors.New("unavailable"))
+	now = now.Add(5 * time.Minute)
+	m.poll(ctx)
+	if status := m.Status(); !status.Healthy || status.LastError == "" {
+		t.Fatalf("expected the health to be kept with the error, got %+v", status)
+	}
+
+	// beyond the threshold
+	assertHealth(false, 0)
+	if got := testutil.ToFloat64(tunnelHealthy); got != 0 {
+		t.Errorf("expected the tunnel unhealthy metric, got %v", got)
+	}
+	if healthy, _ := m.Check(); healthy {
+		t.Error("expected the check to fail")
+	}
+
+	f.AddConnector(tunnelID, "2026.6.0")
+	assertHealth(true, 2)
+	if !m.Status().UnhealthySince.IsZero() {
+		t.Error("expected the unhealthy time to be reset")
+	}
+}
@@ -0,0 +1,124 @@
+package tunnel
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var cacheRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloudflare_tunnel_ingress_controller_cache_requests_total",
+	Help: "Number of lookups in the Cloudflare API cache by cache and result (hit, miss).",
+}, []string{"cache", "result"})
+
+var apiRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloudflare_tunnel_ingress_controller_cloudflare_api_requests_total",
+	Help: "Number of Cloudflare API requests by endpoint and status code (2xx for successes, error when no response was received), retries included.",
+}, []string{"endpoint", "status_code"})
+
+var apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "cloudflare_tunnel_ingress_controller_cloudflare_api_request_duration_seconds",
+	Help:    "Latency of the Cloudflare API requests by endpoint, without the time waiting for the rate limiter.",
+	Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+}, []string{"endpoint"})
+
+var managedHostnames = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "cloudflare_tunnel_ingress_controller_managed_hostnames",
+	Help: "Number of hostnames routed through the tunnel by the controller.",
+})
+
+var managedRules = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "cloudflare_tunnel_ingress_controller_managed_rules",
+	Help: "Number of tunnel ingress rules managed by the controller.",
+})
+
+var managedDNSHostnames = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "cloudflare_tunnel_ingress_controller_managed_dns_hostnames",
+	Help: "Number of hostnames whose DNS records, a CNAME to the tunnel and its ownership record, are managed by the controller.",
+})
+
+var managedAccessApplications = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "cloudflare_tunnel_ingress_controller_managed_access_applications",
+	Help: "Number of Cloudflare Access applications requested by the controller.",
+})
+
+var dnsConflicts = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "cloudflare_tunnel_ingress_controller_dns_conflicts",
+	Help: "Number of hostnames whose DNS records are not managed because of conflicting records.",
+})
+
+var tunnelConfigurationUpdatesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "cloudflare_tunnel_ingress_controller_tunnel_configuration_updates_total",
+	Help: "Number of tunnel configuration versions pushed by the controller.",
+})
+
+var tunnelConfigurationVersion = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "cloudflare_tunnel_ingress_controller_tunnel_configuration_version",
+	Help: "Version of the tunnel configuration last seen by the controller.",
+})
+
+var driftCorrectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "cloudflare_tunnel_ingress_controller_drift_corrections_total",
+	Help: "Number of changes made outside of the controller reverted by it, by resource.",
+}, []string{"resource"})
+
+var tunnelConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cloudflare_tunnel_ingress_controller_tunnel_connections",
+	Help: "Number of healthy connections of the tunnel by Cloudflare data center, cloudflared version and origin IP.",
+}, []string{"colo", "client_version", "origin_ip"})
+
+var tunnelConnectionOpenedTimestamp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "cloudflare_tunnel_ingress_controller_tunnel_connection_opened_timestamp_seconds",
+	Help: "Time the healthy connections of the tunnel were opened at, by connection.",
+}, []string{"connector_id", "connection_id", "colo", "client_version", "origin_ip"})
+
+var tunnelHealthy = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "cloudflare_tunnel_ingress_controller_tunnel_healthy",
+	Help: "Whether the tunnel had a healthy connection within the unhealthy threshold (1) or not (0).",
+})
+
+func init() {
+	metrics.Registry.MustRegister(
+		cacheRequestsTotal,
+		apiRequestsTotal,
+		apiRequestDuration,
+		managedHostnames,
+		managedRules,
+		managedDNSHostnames,
+		managedAccessApplications,
+		dnsConflicts,
+		tunnelConfigurationUpdatesTotal,
+		tunnelConfigurationVersion,
+		driftCorrectionsTotal,
+		tunnelConnections,
+		tunnelConnectionOpenedTimestamp,
+		tunnelHealthy,
+	)
+}
+
+// Resources whose drift is corrected by the controller
+const DriftResourceTunnelIngressRule = "tunnel_ingress_rule"
+const DriftResourceCloudflared = "cloudflared"
+
+// ObserveDriftCorrection records a change made outside of the controller to the resource, which it reverted.
+func ObserveDriftCorrection(resource string) {
+	driftCorrectionsTotal.WithLabelValues(resource).Inc()
+}
+
+// observeAPIRequest records a Cloudflare API request of the endpoint which took the duration and failed with err.
+func observeAPIRequest(endpoint string, duration time.Duration, err error) {
+	statusCode := "2xx"
+	if err != nil {
+		statusCode = "error"
+		var apiErr *cloudflare.Error
+		if errors.As(err, &apiErr) {
+			statusCode = strconv.Itoa(apiErr.StatusCode)
+		}
+	}
+	apiRequestsTotal.WithLabelValues(endpoint, statusCode).Inc()
+	apiRequestDuration.WithLabelValues(endpoint).Observe(duration.Seconds())
+}
@@ -0,0 +1,90 @@
+package tunnel
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel/fake"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestSyncMetrics(t *testing.T) {
+	ctx := context.Background()
+	f := fake.New()
+	f.AddTunnel("test-tunnel", false)
+	zoneID := f.AddZone("example.com")
+	f.AddRecord(zoneID, "A", "taken.example.com", "192.0.2.1")
+
+	c := NewClient(&CloudflareAPI{
+		Tunnels:              f.Tunnels,
+		CloudflaredTunnels:   f.CloudflaredTunnels,
+		TunnelTokens:         f.TunnelTokens,
+		TunnelConfigurations: f.TunnelConfigurations,
+		Zones:                f.Zones,
+		DNSRecords:           f.DNSRecords,
+		AccessApplications:   f.AccessApplications,
+	}, "account", "test-tunnel", "owner", logr.Discard())
+	c.SetCacheTTL(0)
+	if err := c.EnsureTunnelExists(ctx, logr.Discard()); err != nil {
+		t.Fatalf("failed to ensure tunnel exists: %v", err)
+	}
+
+	records := IngressRecords{
+		{Hostname: "app.example.com", Path: "^/", Service: "http://app.default:80"},
+		{Hostname: "app.example.com", Path: "^/api", Service: "http://api.default:80"},
+		{Hostname: "taken.example.com", Path: "^/", Service: "http://app.default:80"},
+	}
+	config := &Config{
+		Ingresses:         map[types.UID]*IngressRecords{"uid-app": &records},
+		IngressDNS:        map[types.UID]*IngressDNSConfig{"uid-app": NewIngressDNSConfig("ingress/default/app")},
+		AccessAppRequests: map[string]string{"app.example.com": "app"},
+	}
+
+	updated := testutil.ToFloat64(tunnelConfigurationUpdatesTotal)
+	succeeded := testutil.ToFloat64(apiRequestsTotal.WithLabelValues("tunnels.configurations.update", "2xx"))
+	forbidden := testutil.ToFloat64(apiRequestsTotal.WithLabelValues("tunnels.configurations.update", "403"))
+
+	if _, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	gauges := []struct {
+		name string
+		got  prometheus.Collector
+		want float64
+	}{
+		{"rules", managedRules, 3},
+		{"hostnames", managedHostnames, 2},
+		{"DNS hostnames", managedDNSHostnames, 1},
+		{"Access applications", managedAccessApplications, 1},
+		{"DNS conflicts", dnsConflicts, 1},
+		{"configuration version", tunnelConfigurationVersion, 1},
+	}
+	for _, g := range gauges {
+		if got := testutil.ToFloat64(g.got); got != g.want {
+			t.Errorf("expected %v managed %s, got %v", g.want, g.name, got)
+		}
+	}
+	if got := testutil.ToFloat64(tunnelConfigurationUpdatesTotal) - updated; got != 1 {
+		t.Errorf("expected a configuration update, got %v", got)
+	}
+	if got := testutil.ToFloat64(apiRequestsTotal.WithLabelValues("tunnels.configurations.update", "2xx")) - succeeded; got != 1 {
+		t.Errorf("expected a successful request, got %v", got)
+	}
+
+	f.InjectError(fake.OpTunnelConfigurationsUpdate, fake.APIError(http.MethodPut, http.StatusForbidden, 10000, "Authentication error"))
+	records[0].Service = "http://app.default:8080"
+	if _, err := c.EnsureTunnelConfiguration(ctx, logr.Discard(), config); err == nil {
+		t.Fatal("expected the update to fail")
+	}
+	if got := testutil.ToFloat64(apiRequestsTotal.WithLabelValues("tunnels.configurations.update", "403")) - forbidden; got != 1 {
+		t.Errorf("expected a forbidden request, got %v", got)
+	}
+	if got := testutil.ToFloat64(tunnelConfigurationUpdatesTotal) - updated; got != 1 {
+		t.Errorf("expected no further configuration update, got %v", got)
+	}
+}
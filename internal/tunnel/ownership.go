@@ -0,0 +1,149 @@
+package tunnel
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+// RuleOwnershipStore persists the keys of the tunnel ingress rules created by
+// the controller. Rules that are not listed belong to someone else (the
+// dashboard, another tool) and are never modified or removed.
+type RuleOwnershipStore interface {
+	LoadManagedRules(ctx context.Context) ([]RuleKey, error)
+	SaveManagedRules(ctx context.Context, keys []RuleKey) error
+	// LoadRulesAdopted reports whether the rules of the previous versions of the controller were adopted, see adoptedRule.
+	LoadRulesAdopted(ctx context.Context) (bool, error)
+	SaveRulesAdopted(ctx context.Context) error
+}
+
+// SetRuleOwnershipStore configures where the managed rule keys are persisted.
+// Without a store the ownership is only tracked in memory.
+func (c *Client) SetRuleOwnershipStore(store RuleOwnershipStore) {
+	c.ownershipStore = store
+}
+
+func (c *Client) loadManagedRules(ctx context.Context, logger logr.Logger) error {
+	if c.managedRules != nil {
+		return nil
+	}
+
+	managed := make(map[RuleKey]struct{})
+	adopted := false
+	if c.ownershipStore != nil {
+		keys, err := c.ownershipStore.LoadManagedRules(ctx)
+		if err != nil {
+			logger.Error(err, "Failed to load managed tunnel ingress rules")
+			return err
+		}
+		for _, key := range keys {
+			managed[key] = dummy
+		}
+
+		adopted, err = c.ownershipStore.LoadRulesAdopted(ctx)
+		if err != nil {
+			logger.Error(err, "Failed to load the adoption of tunnel ingress rules")
+			return err
+		}
+	}
+
+	c.managedRules = managed
+	c.adoptRules = !adopted
+	return nil
+}
+
+// adoptedRule reports whether the live rule was created by a version of the controller predating the ownership
+// tracking, which would shadow the rule replacing it when left alone. Such versions wrote the raw Prefix and
+// ImplementationSpecific Ingress paths instead of regular expressions, so only a rule with the raw path and the
+// service of a desired rule is adopted, any other rule is kept as not owned. The rules are adopted on the first
+// synchronization only, which is recorded in the ownership store.
+func (c *Client) adoptedRule(logger logr.Logger, r *IngressRecord, desired IngressRecords, paths map[*IngressRecord]RulePath) bool {
+	if !c.adoptRules {
+		return false
+	}
+	for _, d := range desired {
+		p, ok := paths[d]
+		if !ok || p.PathType == networkingv1.PathTypeExact {
+			continue
+		}
+		if d.Hostname == r.Hostname && p.Path == r.Path && d.Service == r.Service {
+			logger.Info("Adopting tunnel ingress rule created by a previous version of the controller", "hostname", r.Hostname, "path", r.Path)
+			return true
+		}
+	}
+	return false
+}
+
+// rulesAdopted records that the rules of the previous versions of the controller were adopted.
+func (c *Client) rulesAdopted(ctx context.Context, logger logr.Logger) error {
+	if c.ownershipStore != nil && c.adoptRules {
+		if err := c.ownershipStore.SaveRulesAdopted(ctx); err != nil {
+			logger.Error(err, "Failed to save the adoption of tunnel ingress rules")
+			return err
+		}
+	}
+
+	c.adoptRules = false
+	return nil
+}
+
+func (c *Client) saveManagedRules(ctx context.Context, logger logr.Logger, managed map[RuleKey]struct{}) error {
+	if c.ownershipStore != nil && !sameKeys(managed, c.managedRules) {
+		keys := make([]RuleKey, 0, len(managed))
+		for key := range managed {
+			keys = append(keys, key)
+		}
+		slices.SortFunc(keys, compareRuleKeys)
+
+		err := c.ownershipStore.SaveManagedRules(ctx, keys)
+		if err != nil {
+			logger.Error(err, "Failed to save managed tunnel ingress rules")
+			return err
+		}
+	}
+
+	c.managedRules = managed
+	return nil
+}
+
+func sameKeys(a, b map[RuleKey]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func compareRuleKeys(a, b RuleKey) int {
+	return cmp.Or(strings.Compare(a.Hostname, b.Hostname), strings.Compare(a.Path, b.Path))
+}
+
+// mergeIngressRules builds the complete tunnel ingress list. Unmanaged rules
+// keep their position, the managed rules are placed where the first managed
+// rule used to be, or after the unmanaged rules when there was none.
+func mergeIngressRules(live IngressRecords, owned map[RuleKey]struct{}, managed IngressRecords) IngressRecords {
+	rules := make(IngressRecords, 0, len(live)+len(managed))
+	inserted := false
+	for _, r := range live {
+		if _, ok := owned[keyOf(r)]; !ok {
+			rules = append(rules, r)
+			continue
+		}
+		if !inserted {
+			rules = append(rules, managed...)
+			inserted = true
+		}
+	}
+	if !inserted {
+		rules = append(rules, managed...)
+	}
+	return rules
+}
@@ -0,0 +1,81 @@
+package tunnel
+
+import (
+	"testing"
+
+	"github.com/go-logr/logr"
+	networkingv1 "k8s.io/api/networking/v1"
+)
+
+func TestMergeIngressRules_KeepsUnmanagedRulesInPlace(t *testing.T) {
+	live := IngressRecords{
+		{Hostname: "legacy.example.com", Service: "http://10.0.0.1:80"},
+		{Hostname: "app.example.com", Service: "http://app.default:80"},
+		{Hostname: "legacy2.example.com", Service: "http://10.0.0.2:80"},
+		{Hostname: "old.example.com", Service: "http://old.default:80"},
+	}
+	owned := map[RuleKey]struct{}{
+		{Hostname: "app.example.com"}: {},
+		{Hostname: "old.example.com"}: {},
+		{Hostname: "new.example.com"}: {},
+	}
+	managed := IngressRecords{
+		{Hostname: "app.example.com", Service: "http://app.default:80"},
+		{Hostname: "new.example.com", Service: "http://new.default:80"},
+	}
+
+	rules := mergeIngressRules(live, owned, managed)
+
+	expected := []string{"legacy.example.com", "app.example.com", "new.example.com", "legacy2.example.com"}
+	if len(rules) != len(expected) {
+		t.Fatalf("expected %d rules, got %d", len(expected), len(rules))
+	}
+	for i, hostname := range expected {
+		if rules[i].Hostname != hostname {
+			t.Errorf("expected rules[%d] = %q, got %q", i, hostname, rules[i].Hostname)
+		}
+	}
+}
+
+func TestMergeIngressRules_NoManagedRulesYet(t *testing.T) {
+	live := IngressRecords{
+		{Hostname: "legacy.example.com", Service: "http://10.0.0.1:80"},
+	}
+	managed := IngressRecords{
+		{Hostname: "app.example.com", Service: "http://app.default:80"},
+	}
+
+	rules := mergeIngressRules(live, ruleKeys(managed), managed)
+
+	if len(rules) != 2 || rules[0].Hostname != "legacy.example.com" || rules[1].Hostname != "app.example.com" {
+		t.Errorf("expected managed rules after unmanaged ones, got %+v", rules)
+	}
+}
+
+func TestAdoptedRule(t *testing.T) {
+	desired := IngressRecords{
+		{Hostname: "app.example.com", Path: "^/api(/|$)", Service: "http://app.default:80"},
+	}
+	paths := map[*IngressRecord]RulePath{
+		desired[0]: {Path: "/api", PathType: networkingv1.PathTypePrefix},
+	}
+	legacy := &IngressRecord{Hostname: "app.example.com", Path: "/api", Service: "http://app.default:80"}
+	handMade := &IngressRecord{Hostname: "app.example.com", Path: "/admin", Service: "http://10.0.0.2:80"}
+	other := &IngressRecord{Hostname: "other.example.com", Path: "/api", Service: "http://app.default:80"}
+
+	c := &Client{adoptRules: true}
+	if !c.adoptedRule(logr.Discard(), legacy, desired, paths) {
+		t.Error("expected the rule generated by a previous version to be adopted")
+	}
+	if c.adoptedRule(logr.Discard(), handMade, desired, paths) {
+		t.Error("expected a hand-made rule of a desired hostname not to be adopted")
+	}
+	if c.adoptedRule(logr.Discard(), other, desired, paths) {
+		t.Error("expected the rule of another hostname not to be adopted")
+	}
+
+	c.adoptRules = false
+	if c.adoptedRule(logr.Discard(), legacy, desired, paths) {
+		t.Error("expected no adoption once it was recorded")
+	}
+}
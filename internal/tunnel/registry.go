@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The DNS records created by the controller are accompanied by a TXT record carrying the ownership,
+// similar to the external-dns TXT registry. A TXT record cannot share its name with a CNAME record,
+// so it is stored under a prefixed name: "_tunnel-owner.app.example.com" for "app.example.com" and
+// "_tunnel-owner._wildcard.example.com" for "*.example.com".
+const ownerRecordPrefix = "_tunnel-owner."
+const ownerRecordWildcard = "_wildcard."
+const ownerRecordHeritage = "cloudflare-tunnel-ingress-controller"
+
+// ownerRecord is the content of the ownership TXT record.
+type ownerRecord struct {
+	// Owner is the configured owner ID of the controller, only records with a matching owner are managed
+	Owner string
+	// Instance is the ID of the tunnel the record points to
+	Instance string
+	// Resource references the Kubernetes resource the record was created for, e.g. "ingress/default/app"
+	Resource string
+}
+
+func ownerRecordName(hostname string) string {
+	if rest, ok := strings.CutPrefix(hostname, "*."); ok {
+		return ownerRecordPrefix + ownerRecordWildcard + rest
+	}
+	return ownerRecordPrefix + hostname
+}
+
+// hostnameFromOwnerRecordName is the inverse of ownerRecordName.
+func hostnameFromOwnerRecordName(name string) (string, bool) {
+	hostname, ok := strings.CutPrefix(name, ownerRecordPrefix)
+	if !ok {
+		return "", false
+	}
+	if rest, ok := strings.CutPrefix(hostname, ownerRecordWildcard); ok {
+		return "*." + rest, true
+	}
+	return hostname, true
+}
+
+func (o ownerRecord) content() string {
+	return fmt.Sprintf("\"heritage=%s,owner=%s,instance=%s,resource=%s\"", ownerRecordHeritage, o.Owner, o.Instance, o.Resource)
+}
+
+// parseOwnerRecord parses the content of an ownership TXT record, records of other heritage are rejected.
+func parseOwnerRecord(content string) (ownerRecord, bool) {
+	var o ownerRecord
+	heritage := ""
+	for field := range strings.SplitSeq(strings.Trim(content, "\""), ",") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "heritage":
+			heritage = value
+		case "owner":
+			o.Owner = value
+		case "instance":
+			o.Instance = value
+		case "resource":
+			o.Resource = value
+		}
+	}
+	if heritage != ownerRecordHeritage || o.Owner == "" {
+		return ownerRecord{}, false
+	}
+	return o, true
+}
@@ -0,0 +1,52 @@
+package tunnel
+
+import (
+	"testing"
+)
+
+func TestOwnerRecordName(t *testing.T) {
+	tests := []struct {
+		hostname string
+		expected string
+	}{
+		{"app.example.com", "_tunnel-owner.app.example.com"},
+		{"example.com", "_tunnel-owner.example.com"},
+		{"*.example.com", "_tunnel-owner._wildcard.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			name := ownerRecordName(tt.hostname)
+			if name != tt.expected {
+				t.Errorf("ownerRecordName(%q) = %q, want %q", tt.hostname, name, tt.expected)
+			}
+			hostname, ok := hostnameFromOwnerRecordName(name)
+			if !ok || hostname != tt.hostname {
+				t.Errorf("hostnameFromOwnerRecordName(%q) = %q, %v, want %q", name, hostname, ok, tt.hostname)
+			}
+		})
+	}
+
+	if _, ok := hostnameFromOwnerRecordName("_acme-challenge.example.com"); ok {
+		t.Error("expected unrelated TXT record name to be rejected")
+	}
+}
+
+func TestParseOwnerRecord(t *testing.T) {
+	owner := ownerRecord{Owner: "my-tunnel", Instance: "tunnel-id", Resource: "ingress/default/app"}
+
+	parsed, ok := parseOwnerRecord(owner.content())
+	if !ok {
+		t.Fatal("expected ownership record to be parsed")
+	}
+	if parsed != owner {
+		t.Errorf("expected %+v, got %+v", owner, parsed)
+	}
+
+	if _, ok := parseOwnerRecord("\"heritage=external-dns,external-dns/owner=default\""); ok {
+		t.Error("expected record of other heritage to be rejected")
+	}
+	if _, ok := parseOwnerRecord("v=spf1 -all"); ok {
+		t.Error("expected unrelated TXT record to be rejected")
+	}
+}
@@ -0,0 +1,194 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go/v6"
+	"golang.org/x/time/rate"
+)
+
+// Cloudflare allows 1200 API requests per five minutes for a user. The token bucket refills at that rate and
+// allows short bursts.
+const DefaultRateLimit = 1200
+const DefaultRateLimitPeriod = 5 * time.Minute
+const defaultRateLimitBurst = 50
+
+// Transient errors are retried with exponential backoff, unless the API tells when to retry
+const maxRequestAttempts = 5
+const initialRetryDelay = 1 * time.Second
+const maxRetryDelay = 1 * time.Minute
+const maxRetryAfter = 5 * time.Minute
+
+// rateLimiter is shared by all requests of the client. A rate limited response pauses all requests until the
+// time the API asked to retry after.
+type rateLimiter struct {
+	limiter *rate.Limiter
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+func newRateLimiter(requests int, period time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limiter: rate.NewLimiter(rate.Limit(float64(requests)/period.Seconds()), min(defaultRateLimitBurst, requests)),
+	}
+}
+
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	pause := time.Until(l.pausedUntil)
+	l.mu.Unlock()
+
+	if pause > 0 {
+		if err := sleep(ctx, pause); err != nil {
+			return err
+		}
+	}
+	return l.limiter.Wait(ctx)
+}
+
+func (l *rateLimiter) pause(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until := time.Now().Add(d); until.After(l.pausedUntil) {
+		l.pausedUntil = until
+	}
+}
+
+// SetRateLimit limits the client to the number of Cloudflare API requests per period.
+func (c *Client) SetRateLimit(requests int, period time.Duration) {
+	c.rateLimiter = newRateLimiter(requests, period)
+}
+
+// call performs a Cloudflare API request of the endpoint. It waits for the rate limiter and retries transient
+// errors with exponential backoff, honoring the Retry-After header of the response. Every attempt is recorded in
+// the API request metrics.
+func call[T any](ctx context.Context, c *Client, endpoint string, request func() (T, error)) (T, error) {
+	return retry(ctx, c, endpoint, request, isRetryable)
+}
+
+// create performs a Cloudflare API request of an endpoint creating a resource, like call. Such a request is not
+// idempotent, so it is only retried when it was not processed, see isRetryableCreate. After any other failure the
+// resource may exist, the caller looks it up again on the next reconciliation before creating it.
+func create[T any](ctx context.Context, c *Client, endpoint string, request func() (T, error)) (T, error) {
+	return retry(ctx, c, endpoint, request, isRetryableCreate)
+}
+
+func retry[T any](ctx context.Context, c *Client, endpoint string, request func() (T, error), retryable func(error) bool) (T, error) {
+	var res T
+	var err error
+
+	delay := initialRetryDelay
+	for attempt := 1; ; attempt++ {
+		if err := c.rateLimiter.wait(ctx); err != nil {
+			return res, err
+		}
+
+		start := time.Now()
+		res, err = request()
+		observeAPIRequest(endpoint, time.Since(start), err)
+		if err == nil || !retryable(err) || attempt == maxRequestAttempts {
+			return res, err
+		}
+
+		wait := delay
+		if retryAfter, ok := retryAfter(err); ok {
+			wait = retryAfter
+			c.rateLimiter.pause(retryAfter)
+		}
+		delay = min(2*delay, maxRetryDelay)
+
+		c.logger.V(1).Info("Retrying Cloudflare API request", "endpoint", endpoint, "attempt", attempt, "delay", wait, "error", err.Error())
+		if err := sleep(ctx, wait); err != nil {
+			return res, err
+		}
+	}
+}
+
+// IsPermanentError reports whether the Cloudflare API rejected a request in a way retrying does not fix, like
+// invalid or unauthorized requests. Such errors need a change of the configuration or the resources.
+func IsPermanentError(err error) bool {
+	var apiErr *cloudflare.Error
+	return errors.As(err, &apiErr) && !isRetryable(err)
+}
+
+// isRetryable reports whether the request may succeed when repeated: timeouts, rate limits, server errors and
+// network failures.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *cloudflare.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusRequestTimeout ||
+			apiErr.StatusCode == http.StatusTooManyRequests ||
+			apiErr.StatusCode >= http.StatusInternalServerError
+	}
+
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
+
+// isRetryableCreate reports whether the request was not processed and may be repeated without creating the
+// resource twice: it was rate limited, or the connection to the API could not be established. A timeout, a server
+// error or a connection lost on the way may happen after the resource was created.
+func isRetryableCreate(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var apiErr *cloudflare.Error
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusTooManyRequests
+	}
+
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// notProcessed reports whether the failed request provably had no effect, as it was rejected or not processed.
+func notProcessed(err error) bool {
+	return IsPermanentError(err) || isRetryableCreate(err)
+}
+
+// retryAfter returns the delay of the Retry-After header of a failed response, in seconds or as a date.
+func retryAfter(err error) (time.Duration, bool) {
+	var apiErr *cloudflare.Error
+	if !errors.As(err, &apiErr) || apiErr.Response == nil {
+		return 0, false
+	}
+
+	value := apiErr.Response.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return min(max(time.Duration(seconds)*time.Second, 0), maxRetryAfter), true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return min(max(time.Until(t), 0), maxRetryAfter), true
+	}
+	return 0, false
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
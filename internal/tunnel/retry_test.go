@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/clbs-io/cloudflare-tunnel-ingress-controller/internal/tunnel/fake"
+	"github.com/cloudflare/cloudflare-go/v6"
+	"github.com/go-logr/logr"
+)
+
+func apiError(statusCode int, header http.Header) *cloudflare.Error {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &cloudflare.Error{
+		StatusCode: statusCode,
+		Response:   &http.Response{StatusCode: statusCode, Header: header},
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+		permanent bool
+	}{
+		{name: "rate limited", err: apiError(http.StatusTooManyRequests, nil), retryable: true},
+		{name: "server error", err: apiError(http.StatusBadGateway, nil), retryable: true},
+		{name: "timeout", err: apiError(http.StatusRequestTimeout, nil), retryable: true},
+		{name: "wrapped", err: fmt.Errorf("failed: %w", apiError(http.StatusServiceUnavailable, nil)), retryable: true},
+		{name: "bad request", err: apiError(http.StatusBadRequest, nil), permanent: true},
+		{name: "forbidden", err: apiError(http.StatusForbidden, nil), permanent: true},
+		{name: "not found", err: apiError(http.StatusNotFound, nil), permanent: true},
+		{name: "conflict", err: apiError(http.StatusConflict, nil), permanent: true},
+		{name: "network", err: &url.Error{Op: "Get", URL: "https://api.cloudflare.com", Err: errors.New("connection reset")}, retryable: true},
+		{name: "canceled", err: &url.Error{Op: "Get", URL: "https://api.cloudflare.com", Err: context.Canceled}},
+		{name: "other", err: errors.New("tunnel token not found")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.retryable {
+				t.Errorf("isRetryable() = %v, want %v", got, tt.retryable)
+			}
+			if got := IsPermanentError(tt.err); got != tt.permanent {
+				t.Errorf("IsPermanentError() = %v, want %v", got, tt.permanent)
+			}
+		})
+	}
+}
+
+func TestIsRetryableCreate(t *testing.T) {
+	refused := &url.Error{Op: "Post", URL: "https://api.cloudflare.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	reset := &url.Error{Op: "Post", URL: "https://api.cloudflare.com", Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}
+
+	tests := []struct {
+		name      string
+		err       error
+		retryable bool
+	}{
+		{name: "rate limited", err: apiError(http.StatusTooManyRequests, nil), retryable: true},
+		{name: "connection refused", err: refused, retryable: true},
+		{name: "server error", err: apiError(http.StatusBadGateway, nil)},
+		{name: "timeout", err: apiError(http.StatusRequestTimeout, nil)},
+		{name: "conflict", err: apiError(http.StatusConflict, nil)},
+		{name: "connection reset", err: reset},
+		{name: "canceled", err: &url.Error{Op: "Post", URL: "https://api.cloudflare.com", Err: context.Canceled}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableCreate(tt.err); got != tt.retryable {
+				t.Errorf("isRetryableCreate() = %v, want %v", got, tt.retryable)
+			}
+		})
+	}
+}
+
+func TestCreate(t *testing.T) {
+	c := NewClient(&CloudflareAPI{}, "account", "test-tunnel", "owner", logr.Discard())
+	unavailable := fake.APIError(http.MethodPost, http.StatusServiceUnavailable, 10000, "Service unavailable")
+	unavailable.Response.Header.Set("Retry-After", "0")
+
+	tests := []struct {
+		name     string
+		errs     []error
+		attempts int
+	}{
+		{name: "rate limited", errs: []error{fake.RateLimitError(http.MethodPost, 0)}, attempts: 2},
+		{name: "server error", errs: []error{unavailable}, attempts: 1},
+		{name: "conflict", errs: []error{fake.APIError(http.MethodPost, http.StatusConflict, 1013, "Tunnel already exists")}, attempts: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			_, _ = create(context.Background(), c, "tunnels.new", func() (string, error) {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return "", tt.errs[attempts-1]
+				}
+				return "created", nil
+			})
+			if attempts != tt.attempts {
+				t.Errorf("expected %d attempts, got %d", tt.attempts, attempts)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   time.Duration
+		ok     bool
+	}{
+		{name: "seconds", header: "30", want: 30 * time.Second, ok: true},
+		{name: "zero", header: "0", want: 0, ok: true},
+		{name: "capped", header: "3600", want: maxRetryAfter, ok: true},
+		{name: "past date", header: "Mon, 01 Jan 2024 00:00:00 GMT", want: 0, ok: true},
+		{name: "invalid", header: "soon"},
+		{name: "missing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := make(http.Header)
+			if tt.header != "" {
+				header.Set("Retry-After", tt.header)
+			}
+			got, ok := retryAfter(apiError(http.StatusTooManyRequests, header))
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("retryAfter() = %v, %v, want %v, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	for range 2 {
+		if err := l.wait(ctx); err != nil {
+			t.Fatalf("expected the burst to be allowed, got %v", err)
+		}
+	}
+	if err := l.wait(ctx); err == nil {
+		t.Error("expected the request to wait for the bucket to refill")
+	}
+
+	l = newRateLimiter(DefaultRateLimit, DefaultRateLimitPeriod)
+	l.pause(time.Hour)
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected requests to be paused, got %v", err)
+	}
+}